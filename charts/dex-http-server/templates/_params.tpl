@@ -2,4 +2,88 @@
 {{- if .Values.grpc.server -}}
 - --grpc-server={{.Values.grpc.server | trim }}
 {{- end }}
+{{- with .Values.tls }}
+{{- if .enabled }}
+- --tls-certs-path=/etc/dex-http-server/tls
+{{- if .minVersion }}
+- --tls-min-version={{ .minVersion | trim }}
+{{- end }}
+{{- if .cipherSuites }}
+- --tls-cipher-suites={{ join "," .cipherSuites }}
+{{- end }}
+{{- if .clientAuth }}
+- --tls-client-auth={{ .clientAuth | trim }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- with .Values.oidc }}
+{{- if .issuerURL }}
+- --oidc-issuer-url={{ .issuerURL | trim }}
+{{- end }}
+{{- if .jwksURL }}
+- --oidc-jwks-url={{ .jwksURL | trim }}
+{{- end }}
+{{- if .groupsPrefix }}
+- --oidc-groups-prefix={{ .groupsPrefix | trim }}
+{{- end }}
+{{- if .clientIDs }}
+- --oidc-client-ids={{ join "," .clientIDs }}
+{{- end }}
+- --oidc-skip-issuer-check={{ .skipIssuerCheck | default false }}
+{{- end }}
+{{- if .Values.authz.mode }}
+- --authz-mode={{ .Values.authz.mode | trim }}
+{{- end }}
+{{- if .Values.authz.adminNamespaces }}
+- --rbac-admin-namespaces={{ join "," .Values.authz.adminNamespaces }}
+{{- end }}
+{{- if .Values.authz.policy }}
+- --authz-policy-file=/etc/dex-http-server/policy/policy.yaml
+{{- end }}
+{{- with .Values.audit }}
+{{- if .sink }}
+- --audit-sink={{ .sink | trim }}
+{{- end }}
+{{- if .filePath }}
+- --audit-file-path={{ .filePath | trim }}
+{{- end }}
+{{- if .webhookURL }}
+- --audit-webhook-url={{ .webhookURL | trim }}
+{{- end }}
+{{- if .webhookTimeout }}
+- --audit-webhook-timeout={{ .webhookTimeout | trim }}
+{{- end }}
+{{- end }}
+{{- if .Values.userFields }}
+- --user-fields={{ join "," .Values.userFields }}
+{{- end }}
+{{- if .Values.passwordPolicy }}
+- --password-policy-file=/etc/dex-http-server/password-policy/password-policy.yaml
+{{- end }}
+{{- if .Values.importConcurrency }}
+- --import-concurrency={{ .Values.importConcurrency }}
+{{- end }}
+{{- if .Values.legacyResultFlags }}
+- --legacy-result-flags=true
+{{- end }}
+{{- with .Values.logging }}
+{{- if .level }}
+- --log-level={{ .level | trim }}
+{{- end }}
+{{- if .format }}
+- --log-format={{ .format | trim }}
+{{- end }}
+{{- end }}
+{{- with .Values.shutdown }}
+{{- if .delay }}
+- --shutdown-delay={{ .delay | trim }}
+{{- end }}
+{{- if .timeout }}
+- --shutdown-timeout={{ .timeout | trim }}
+{{- end }}
+{{- end }}
+{{- if .Values.events.enabled }}
+- --k8s-events-object={{ .Values.events.object | default (printf "deployment/%s" (include "dex-http-server.fullname" .)) | trim }}
+- --k8s-events-namespace={{ .Release.Namespace }}
+{{- end }}
 {{- end -}}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/backup"
+	"github.com/mirantiscontainers/dex-http-server/internal/middlewares"
+)
+
+// passphraseEnv is the environment variable of the passphrase of the encrypted backups,
+// the passphrase is never passed as a flag, so that it does not show in the process list
+const passphraseEnv = "BACKUP_PASSPHRASE"
+
+// commands are the subcommands of the binary, the server is run without a subcommand
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"export":  runExport,
+	"restore": runRestore,
+}
+
+// dexFlags are the flags of the connection of the subcommands to the gRPC server of Dex
+type dexFlags struct {
+	endpoint  *string
+	certsPath *string
+}
+
+func newDexFlags(fs *flag.FlagSet) dexFlags {
+	return dexFlags{
+		endpoint:  fs.String("grpc-server", "dex:5557", "gRPC server endpoint"),
+		certsPath: fs.String("grpc-certs-path", "", "Path to the directory containing the grpc certs"),
+	}
+}
+
+// dial returns the Dex client of the flags, and the connection to close once done
+func (f dexFlags) dial(ctx context.Context) (api.DexClient, io.Closer, error) {
+	creds := insecure.NewCredentials()
+	if *f.certsPath != "" {
+		var err error
+		if creds, err = getDexGrpcCredentials(ctx, *f.certsPath); err != nil {
+			return nil, nil, fmt.Errorf("failed to get grpc credentials: %w", err)
+		}
+	}
+
+	conn, err := grpc.NewClient(*f.endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create grpc client: %w", err)
+	}
+	return api.NewDexClient(conn), conn, nil
+}
+
+// runExport writes all the users of Dex as NDJSON or CSV, without the hashes of the passwords,
+// or a full backup of the users, with the hashes and the user ids, encrypted with the passphrase
+func runExport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dex := newDexFlags(fs)
+	formatName := fs.String("format", string(backup.FormatNDJSON), "Format of the users, ndjson or csv")
+	output := fs.String("output", "-", "Path of the file the users are written to, the standard output when -")
+	full := fs.Bool("full", false, "Write a full backup, with the bcrypt hashes of the passwords and the user ids, encrypted with the passphrase")
+	passphraseFile := fs.String("passphrase-file", "", "Path of the file of the passphrase of the full backups (env "+passphraseEnv+")")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	format, err := backup.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	var passphrase []byte
+	if *full {
+		if passphrase, err = readPassphrase(*passphraseFile); err != nil {
+			return err
+		}
+	}
+
+	client, conn, err := dex.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := client.ListPasswords(ctx, &api.ListPasswordReq{})
+	if err != nil {
+		return fmt.Errorf("failed to list users: %w", err)
+	}
+
+	fields := middlewares.DefaultUserFields
+	if *full {
+		if err := backup.Check(resp.GetPasswords()); err != nil {
+			return fmt.Errorf("cannot write a full backup, Dex did not send the hashes of the passwords: %w", err)
+		}
+		fields = backup.FullBackupFields
+	}
+
+	var buf bytes.Buffer
+	w, err := backup.NewWriter(&buf, format, fields)
+	if err != nil {
+		return err
+	}
+	for _, p := range resp.GetPasswords() {
+		if err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+	if *full {
+		if data, err = backup.Encrypt(data, passphrase); err != nil {
+			return err
+		}
+	}
+
+	if *output == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(*output, data, 0o600)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write users: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d users\n", len(resp.GetPasswords()))
+	return nil
+}
+
+// runRestore re-creates the users of a full backup in Dex, with their hashes and user ids
+func runRestore(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dex := newDexFlags(fs)
+	input := fs.String("input", "-", "Path of the full backup, the standard input when -")
+	passphraseFile := fs.String("passphrase-file", "", "Path of the file of the passphrase of the encrypted backups (env "+passphraseEnv+")")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var data []byte
+	var err error
+	if *input == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*input)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	if backup.IsEncrypted(data) {
+		passphrase, err := readPassphrase(*passphraseFile)
+		if err != nil {
+			return err
+		}
+		if data, err = backup.Decrypt(data, passphrase); err != nil {
+			return err
+		}
+	}
+
+	passwords, err := backup.Read(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	client, conn, err := dex.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	result, err := backup.Restore(ctx, client, passwords)
+	fmt.Fprintf(os.Stderr, "created %d users, %d already existed\n", result.Created, result.AlreadyExists)
+	return err
+}
+
+// readPassphrase reads the passphrase of the encrypted backups from the file, or from the environment when no file is set
+func readPassphrase(path string) ([]byte, error) {
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		return []byte(strings.TrimRight(string(b), "\r\n")), nil
+	}
+
+	if v := os.Getenv(passphraseEnv); v != "" {
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("no passphrase, set --passphrase-file or %s", passphraseEnv)
+}
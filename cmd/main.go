@@ -2,9 +2,17 @@ package main
 
 import (
 	"context"
+	cryptotls "crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/rs/zerolog/log"
@@ -14,8 +22,17 @@ import (
 	"google.golang.org/grpc/grpclog"
 
 	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/audit"
+	"github.com/mirantiscontainers/dex-http-server/internal/health"
+	"github.com/mirantiscontainers/dex-http-server/internal/k8s"
+	"github.com/mirantiscontainers/dex-http-server/internal/logging"
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
 	"github.com/mirantiscontainers/dex-http-server/internal/middlewares"
+	"github.com/mirantiscontainers/dex-http-server/internal/passwordpolicy"
+	"github.com/mirantiscontainers/dex-http-server/internal/policy"
+	"github.com/mirantiscontainers/dex-http-server/internal/server"
 	"github.com/mirantiscontainers/dex-http-server/internal/tls"
+	"github.com/mirantiscontainers/dex-http-server/internal/tracing"
 )
 
 var (
@@ -26,24 +43,114 @@ var (
 	// HTTP server port
 	port = flag.String("http-port", "8080", "HTTP server port")
 
+	// Port of the health and metrics endpoints, separate from the API so that they are not exposed with it
+	metricsPort = flag.String("metrics-port", "8081", "Port of the /metrics, /healthz and /readyz endpoints, served over HTTP without authentication, it must differ from the HTTP server port")
+
 	// HTTP server port
 	certsPath = flag.String("grpc-certs-path", "", "Path to the directory containing the grpc certs")
 
+	// HTTPS server settings, the server uses plain HTTP when no certs path is provided
+	tlsCertsPath    = flag.String("tls-certs-path", "", "Path to the directory containing the tls.crt and tls.key of the HTTPS server (and the ca.crt used to verify the client certificates), reloaded on change")
+	tlsMinVersion   = flag.String("tls-min-version", "1.2", "Minimum TLS version of the HTTPS server, one of 1.0, 1.1, 1.2 or 1.3")
+	tlsCipherSuites = flag.String("tls-cipher-suites", "", "Comma separated list of TLS 1.0-1.2 cipher suites of the HTTPS server, the Go defaults are used when empty")
+	tlsClientAuth   = flag.String("tls-client-auth", "none", "Client certificates policy of the HTTPS server, one of 'none', 'verify-if-given' or 'require', verified against ca.crt")
+
+	// OIDC settings used to verify the ID tokens of the requests
+	// The defaults can be overridden with environment variables
+	oidcIssuerURL       = flag.String("oidc-issuer-url", envOrDefault("OIDC_ISSUER_URL", "http://authentication-dex:5556/dex"), "URL of the OIDC issuer, must match the 'iss' claim of the ID tokens (env OIDC_ISSUER_URL)")
+	oidcJWKSURL         = flag.String("oidc-jwks-url", envOrDefault("OIDC_JWKS_URL", ""), "URL of the JSON Web Key Set, discovered from the issuer when empty (env OIDC_JWKS_URL)")
+	oidcClientIDs       = flag.String("oidc-client-ids", envOrDefault("OIDC_CLIENT_IDS", "mke-dashboard"), "Comma separated list of OIDC client ids (audiences) allowed to call the API (env OIDC_CLIENT_IDS)")
+	oidcGroupsPrefix    = flag.String("oidc-groups-prefix", envOrDefault("OIDC_GROUPS_PREFIX", ""), "Prefix prepended to the groups of the ID tokens, like the kube-apiserver --oidc-groups-prefix flag (env OIDC_GROUPS_PREFIX)")
+	oidcSkipIssuerCheck = flag.Bool("oidc-skip-issuer-check", envBoolOrDefault("OIDC_SKIP_ISSUER_CHECK", false), "Skip the check of the 'iss' claim of the ID tokens (env OIDC_SKIP_ISSUER_CHECK)")
+
+	// Authorization mode
+	authzMode = flag.String("authz-mode", string(middlewares.AuthzModePolicy), "Authorization mode, one of 'policy' (authorization policy) or 'subjectaccessreview' (delegated to Kubernetes RBAC)")
+
+	// Namespaces whose RoleBindings to ClusterRoles grant the ClusterRoles, like the ClusterRoleBindings
+	rbacAdminNamespaces = flag.String("rbac-admin-namespaces", "", "Comma separated list of namespaces whose RoleBindings to ClusterRoles are taken into account, in addition to the ClusterRoleBindings")
+
+	// RBAC cache
+	rbacCache             = flag.Bool("rbac-cache", true, "Resolve the ClusterRoles of the users from an informer cache instead of listing the bindings on every request")
+	rbacCacheMaxStaleness = flag.Duration("rbac-cache-max-staleness", time.Minute, "How long the RBAC cache is used while its watch is failing, before falling back to listing the bindings")
+	rbacCacheSyncTimeout  = flag.Duration("rbac-cache-sync-timeout", 30*time.Second, "How long to wait for the initial sync of the RBAC cache before serving requests")
+
+	// Logging settings
+	logLevel  = flag.String("log-level", envOrDefault("LOG_LEVEL", "info"), "Log level, one of trace, debug, info, warn or error (env LOG_LEVEL)")
+	logFormat = flag.String("log-format", envOrDefault("LOG_FORMAT", logging.FormatJSON), "Log format, json or console (env LOG_FORMAT)")
+
+	// HTTP server timeouts
+	httpReadHeaderTimeout = flag.Duration("http-read-header-timeout", 10*time.Second, "Maximum duration for reading the headers of a request")
+	httpReadTimeout       = flag.Duration("http-read-timeout", 30*time.Second, "Maximum duration for reading an entire request, including the body")
+	httpWriteTimeout      = flag.Duration("http-write-timeout", time.Minute, "Maximum duration before timing out the writes of a response, from the end of the headers of the request")
+	httpIdleTimeout       = flag.Duration("http-idle-timeout", 2*time.Minute, "Maximum duration to wait for the next request on a keep-alive connection")
+	httpBulkWriteTimeout  = flag.Duration("http-bulk-write-timeout", middlewares.DefaultBulkWriteTimeout, "Maximum duration before timing out the writes of the responses of the imports, exports and backups of users, that can take longer than the write timeout")
+
+	// Graceful shutdown
+	shutdownDelay   = flag.Duration("shutdown-delay", 5*time.Second, "How long the requests are still accepted after SIGTERM while the readiness checks fail, so that the pod is removed from the endpoints")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 20*time.Second, "How long the in-flight requests are drained on shutdown, before they are cut off")
+
+	// Timeout of each readiness check
+	healthCheckTimeout = flag.Duration("health-check-timeout", 5*time.Second, "Timeout of each check of the /readyz endpoint")
+
+	// Audit events of the user-management mutations
+	auditSinkType       = flag.String("audit-sink", string(audit.SinkNone), "Sink of the audit events of the user-management mutations, one of 'none', 'stdout', 'file' or 'webhook'")
+	auditFilePath       = flag.String("audit-file-path", "", "Path of the file the audit events are appended to, with the 'file' sink")
+	auditWebhookURL     = flag.String("audit-webhook-url", "", "URL the audit events are posted to, with the 'webhook' sink")
+	auditWebhookTimeout = flag.Duration("audit-webhook-timeout", 5*time.Second, "Timeout of each post of an audit event to the webhook")
+
+	// Kubernetes Events of the user lifecycle changes
+	k8sEventsObject    = flag.String("k8s-events-object", "", "Object the Kubernetes Events of the user creations, updates, password resets and deletions are recorded against, deployment/<name> or configmap/<name>, disabled when empty")
+	k8sEventsNamespace = flag.String("k8s-events-namespace", "", "Namespace of the object of the Kubernetes Events, the namespace of the pod when empty")
+
+	// Compatibility with the callers checking the result flags of the Dex responses
+	legacyResultFlags = flag.Bool("legacy-result-flags", envBoolOrDefault("LEGACY_RESULT_FLAGS", false), "Answer the already_exists and not_found results of Dex with 200 and the flag in the body, instead of 409 and 404 (env LEGACY_RESULT_FLAGS)")
+
+	// Fields of the users exposed by the list and get users responses
+	userFields = flag.String("user-fields", strings.Join(middlewares.DefaultUserFields, ","), "Comma separated list of the fields of the users exposed by the list and get users responses, among email, username and user_id, the password hashes are never exposed")
+
+	// Number of users created at the same time by the imports
+	importConcurrency = flag.Int("import-concurrency", middlewares.DefaultImportConcurrency, "Number of users created at the same time in Dex by each import of users")
+
+	// Password policy file
+	passwordPolicyFile = flag.String("password-policy-file", "", "Path to the YAML password policy file, the passwords must be 8 to 64 characters without white spaces when empty")
+
+	// Authorization policy file
+	authzPolicyFile = flag.String("authz-policy-file", "", "Path to the YAML authorization policy file, only cluster-admin users are allowed when empty")
+
 	version, commit, date = "", "", "" // These are always injected at build time
 )
 
 func run() error {
+	// The context of the informers, certs reloaders and event recorder is canceled once the
+	// in-flight requests are drained, so that they can still use them
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	var err error
+	// The shutdown starts on SIGTERM or SIGINT, a second signal kills the process
+	signalCtx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	context.AfterFunc(signalCtx, stop)
+
+	// Configure the tracing from the OTEL_ environment variables
+	shutdownTracing, err := tracing.Setup(ctx, version)
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			log.Err(err).Msg("failed to flush the spans")
+		}
+	}()
+
 	var creds credentials.TransportCredentials
 
 	// Load the cert from the file, if provided
 	if *certsPath != "" {
 		log.Info().Msgf("Using cert for grpc connect from %s", *certsPath)
-		creds, err = getDexGrpcCredentials(*certsPath)
+		creds, err = getDexGrpcCredentials(ctx, *certsPath)
 		if err != nil {
 			return fmt.Errorf("failed to get grpc credentials: %w", err)
 		}
@@ -52,46 +159,319 @@ func run() error {
 		creds = insecure.NewCredentials()
 	}
 
+	// Load the authorization policy, if provided
+	var authzPolicy *policy.Policy
+	if *authzPolicyFile != "" {
+		log.Info().Msgf("Using authorization policy from %s", *authzPolicyFile)
+		authzPolicy, err = policy.Load(*authzPolicyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load authorization policy: %w", err)
+		}
+	}
+
+	// Load the password policy, if provided
+	var pwPolicy *passwordpolicy.Policy
+	if *passwordPolicyFile != "" {
+		log.Info().Msgf("Using password policy from %s", *passwordPolicyFile)
+		pwPolicy, err = passwordpolicy.Load(*passwordPolicyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load password policy: %w", err)
+		}
+	}
+
+	// Create the Kubernetes client used for authorization
+	log.Info().Msg("Initialize kubernetes client")
+	kubeClient, err := k8s.NewClientSet()
+	if err != nil {
+		return fmt.Errorf("failed to initialize kubernetes client: %w", err)
+	}
+
+	// Create the sinks of the audit events, if enabled
+	auditSink, err := audit.NewSink(audit.Config{
+		Sink:           audit.SinkType(*auditSinkType),
+		FilePath:       *auditFilePath,
+		WebhookURL:     *auditWebhookURL,
+		WebhookTimeout: *auditWebhookTimeout,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create audit sink: %w", err)
+	}
+	if auditSink != nil {
+		log.Info().Msgf("Recording audit events with the %s sink", *auditSinkType)
+	}
+
+	// The Kubernetes Events of the user lifecycle changes are recorded by an audit sink too
+	if *k8sEventsObject != "" {
+		namespace := *k8sEventsNamespace
+		if namespace == "" {
+			if namespace, err = k8s.CurrentNamespace(); err != nil {
+				return err
+			}
+		}
+
+		eventSink, err := k8s.NewEventSink(ctx, kubeClient, namespace, *k8sEventsObject)
+		if err != nil {
+			return fmt.Errorf("failed to create kubernetes events sink: %w", err)
+		}
+		log.Info().Msgf("Recording Kubernetes Events against %s in namespace %s", *k8sEventsObject, namespace)
+		auditSink = audit.NewMultiSink(auditSink, eventSink)
+	}
+	if auditSink != nil {
+		defer auditSink.Close()
+	}
+
+	// Start the RBAC cache, only the policy mode resolves the ClusterRoles of the users
+	adminNamespaces := splitList(*rbacAdminNamespaces)
+	var roles k8s.RoleResolver
+	var roleCache *k8s.RoleCache
+	if *rbacCache && middlewares.AuthzMode(*authzMode) != middlewares.AuthzModeSubjectAccessReview {
+		roleCache, err = k8s.NewRoleCache(kubeClient, k8s.ResolverOptions{AdminNamespaces: adminNamespaces}, *rbacCacheMaxStaleness)
+		if err != nil {
+			return fmt.Errorf("failed to create rbac cache: %w", err)
+		}
+		roleCache.Start(ctx)
+		defer roleCache.Stop()
+
+		// the requests are authorized by listing the bindings until the cache is synced,
+		// so a sync timeout is not fatal
+		syncCtx, syncCancel := context.WithTimeout(ctx, *rbacCacheSyncTimeout)
+		if roleCache.WaitForSync(syncCtx) {
+			log.Info().Msg("RBAC cache synced")
+		} else {
+			log.Warn().Msg("Timed out waiting for the RBAC cache to sync")
+		}
+		syncCancel()
+
+		roles = roleCache
+	}
+
+	// Create the gRPC client connection to the Dex server
+	// The connection is shared by the gateway and the middlewares that need to call Dex
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithChainUnaryInterceptor(metrics.UnaryClientInterceptor(), middlewares.RequestIDClientInterceptor()),
+		grpc.WithStatsHandler(tracing.GRPCClientHandler()),
+	}
+	conn, err := grpc.NewClient(*grpcServerEndpoint, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create grpc client: %w", err)
+	}
+	defer conn.Close()
+
 	// Create a gRPC server mux with the custom middlewares
 	// These middlewares are called before the generated gRPC middlewares
 	// Doing this in this way ensures that authn/authz can be done before the request
 	// hit the remaining gRPC middlewares
-	mws := middlewares.GetMiddlewares()
-	mux := runtime.NewServeMux(runtime.WithMiddlewares(mws...))
+	dexClient := api.NewDexClient(conn)
+	mws, err := middlewares.GetMiddlewares(middlewares.Config{
+		DexClient: dexClient,
+		OIDC: middlewares.OIDCConfig{
+			IssuerURL:       *oidcIssuerURL,
+			JWKSURL:         *oidcJWKSURL,
+			ClientIDs:       splitList(*oidcClientIDs),
+			SkipIssuerCheck: *oidcSkipIssuerCheck,
+			GroupsPrefix:    *oidcGroupsPrefix,
+		},
+		Authz: middlewares.AuthzConfig{
+			Mode:            middlewares.AuthzMode(*authzMode),
+			Policy:          authzPolicy,
+			KubeClient:      kubeClient,
+			AdminNamespaces: adminNamespaces,
+			Roles:           roles,
+		},
+		Audit:             auditSink,
+		LegacyResultFlags: *legacyResultFlags,
+		UserFields:        splitList(*userFields),
+		ImportConcurrency: *importConcurrency,
+		PasswordPolicy:    pwPolicy,
+		BulkWriteTimeout:  *httpBulkWriteTimeout,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize middlewares: %w", err)
+	}
+	mux := runtime.NewServeMux(append(middlewares.ServeMuxOptions(), runtime.WithMiddlewares(mws...))...)
 
 	// Register gRPC server endpoint
-	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
-	if err = api.RegisterDexHandlerFromEndpoint(ctx, mux, *grpcServerEndpoint, opts); err != nil {
+	if err = api.RegisterDexHandler(ctx, mux, conn); err != nil {
 		return err
 	}
 	log.Info().Msgf("Registered gRPC server endpoint: %s", *grpcServerEndpoint)
 
+	// Register the routes served by the gateway itself, after the Dex routes so that they take precedence
+	if err = middlewares.RegisterHandlers(mux); err != nil {
+		return err
+	}
+
+	// The health and metrics endpoints are served outside of the gateway mux, on the metrics port, so they are not authenticated
+	checks := []health.Check{
+		health.GRPCConnection("grpc-connection", conn),
+		health.DexVersion("dex", dexClient),
+		{Name: "jwks", Func: middlewares.CheckJWKS},
+	}
+	if roleCache != nil {
+		checks = append(checks, health.Synced("rbac-cache", roleCache.HasSynced))
+	}
+
+	healthHandler := health.NewHandler(*healthCheckTimeout, checks...)
+
+	if *metricsPort == *port {
+		return fmt.Errorf("the metrics port must differ from the HTTP server port %s", *port)
+	}
+
+	// The health and metrics endpoints are served on their own port, so that the ingress of the API
+	// does not expose them. They keep answering while the API requests are drained on shutdown
+	ops := http.NewServeMux()
+	healthHandler.Register(ops)
+	ops.Handle(metrics.Path, metrics.Handler())
+	opsServer := &http.Server{
+		Addr:              fmt.Sprintf(":%s", *metricsPort),
+		Handler:           ops,
+		ReadHeaderTimeout: *httpReadHeaderTimeout,
+	}
+	if err := server.Start(opsServer); err != nil {
+		return fmt.Errorf("failed to serve the metrics and health endpoints: %w", err)
+	}
+	defer opsServer.Close()
+	log.Info().Msgf("Serving the metrics and health endpoints on %s", *metricsPort)
+
 	s := &http.Server{
-		Addr:    fmt.Sprintf(":%s", *port),
-		Handler: mux,
+		Addr:              fmt.Sprintf(":%s", *port),
+		Handler:           mux,
+		ReadHeaderTimeout: *httpReadHeaderTimeout,
+		ReadTimeout:       *httpReadTimeout,
+		WriteTimeout:      *httpWriteTimeout,
+		IdleTimeout:       *httpIdleTimeout,
+	}
+
+	if *tlsCertsPath != "" {
+		// The certificate is set by the TLS config
+		s.TLSConfig, err = getServerTLSConfig(ctx, *tlsCertsPath)
+		if err != nil {
+			return fmt.Errorf("failed to get server TLS config: %w", err)
+		}
+		log.Info().Msgf("Running HTTPS server on %s", *port)
+	} else {
+		log.Info().Msgf("Running HTTP server on %s", *port)
+	}
+
+	// Serve until a signal is received, then drain the in-flight requests
+	// The gRPC connection, the audit sinks and the RBAC informers are stopped by the deferred calls afterwards,
+	// also when the requests could not be drained, the error is returned to main once they are done
+	return server.Run(signalCtx, s, server.Options{
+		ShutdownDelay:   *shutdownDelay,
+		ShutdownTimeout: *shutdownTimeout,
+		OnShutdown:      healthHandler.Shutdown,
+	})
+}
+
+// getServerTLSConfig returns the TLS config of the HTTPS server, the certs are reloaded until the context is done
+func getServerTLSConfig(ctx context.Context, tlsDir string) (*cryptotls.Config, error) {
+	minVersion, err := tls.ParseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherSuites, err := tls.ParseCipherSuites(splitList(*tlsCipherSuites))
+	if err != nil {
+		return nil, err
+	}
+
+	clientAuth, err := tls.ParseClientAuth(*tlsClientAuth)
+	if err != nil {
+		return nil, err
 	}
-	// Start HTTP server (and proxy calls to gRPC server endpoint)
-	log.Info().Msgf("Running HTTP server on %s", *port)
-	return s.ListenAndServe()
+
+	log.Info().Msgf("Using certs for the HTTPS server from %s", tlsDir)
+	reloader, err := tls.NewReloader("server", tlsDir, clientAuth != cryptotls.NoClientCert)
+	if err != nil {
+		return nil, err
+	}
+	reloader.Start(ctx)
+
+	return tls.NewServerTLSConfig(reloader, tls.ServerOptions{
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		ClientAuth:   clientAuth,
+	})
 }
 
-func getDexGrpcCredentials(tlsDir string) (credentials.TransportCredentials, error) {
-	tlsConfig, err := tls.LoadTLSConfig(tlsDir)
+// getDexGrpcCredentials returns the credentials of the Dex gRPC client, the certs are reloaded until the context is done
+func getDexGrpcCredentials(ctx context.Context, tlsDir string) (credentials.TransportCredentials, error) {
+	reloader, err := tls.NewReloader("grpc", tlsDir, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS config: %w", err)
+	}
+	reloader.Start(ctx)
+
+	tlsConfig, err := tls.NewClientTLSConfig(reloader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load TLS config: %w", err)
 	}
 	return credentials.NewTLS(tlsConfig), nil
 }
 
+// envOrDefault returns the value of the environment variable named by the key,
+// or the default value when the variable is not set
+func envOrDefault(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// envBoolOrDefault is like envOrDefault for boolean values
+// An invalid value is ignored and the default value is returned
+func envBoolOrDefault(key string, def bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warn().Err(err).Msgf("ignoring invalid value of %s", key)
+		return def
+	}
+	return b
+}
+
+// splitList splits a comma separated list, dropping empty elements
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func main() {
+	// the export and restore subcommands have their own flags
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(context.Background(), os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
 
+	if err := logging.Setup(*logLevel, *logFormat); err != nil {
+		grpclog.Fatal(err)
+	}
+
 	log.Info().Msg("Starting dex-http-server")
 	log.Info().Msgf("Version: %s", version)
 	log.Info().Msgf("Commit: %s", commit)
 	log.Info().Msgf("Date: %s", date)
 
+	// the deferred calls of run are done when it returns, so the process exits only afterwards
 	if err := run(); err != nil {
-		grpclog.Fatal(err)
+		log.Error().Err(err).Msg("dex-http-server failed")
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,179 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Outcome is the outcome of an audited operation
+type Outcome string
+
+const (
+	// OutcomeSuccess is the outcome of the operations applied by Dex
+	OutcomeSuccess Outcome = "success"
+
+	// OutcomeAlreadyExists is the outcome of the creations of users that already exist in Dex
+	OutcomeAlreadyExists Outcome = "already_exists"
+
+	// OutcomeNotFound is the outcome of the updates and deletions of users that do not exist in Dex
+	OutcomeNotFound Outcome = "not_found"
+
+	// OutcomeDenied is the outcome of the requests rejected by the authorization
+	OutcomeDenied Outcome = "denied"
+
+	// OutcomeInvalid is the outcome of the requests rejected by the validation
+	OutcomeInvalid Outcome = "invalid"
+
+	// OutcomeError is the outcome of the requests that failed
+	OutcomeError Outcome = "error"
+)
+
+// Event is the audit event of a user-management mutation, written as a JSON object.
+// It never contains the passwords or their hashes, only the names of the changed fields.
+type Event struct {
+	// Time is the time the request was received
+	Time time.Time `json:"time"`
+
+	// RequestID is the id of the request, from the X-Request-Id header or generated
+	RequestID string `json:"request_id"`
+
+	// Actor is the authenticated user who sent the request
+	Actor Actor `json:"actor"`
+
+	// Operation is the operation of the request, e.g. CreateUser, UpdateUser or DeleteUser
+	Operation string `json:"operation"`
+
+	// Target is the username (email) of the created, updated or deleted user
+	Target string `json:"target"`
+
+	// Changes lists the fields set by the request, e.g. name or password
+	Changes []string `json:"changes,omitempty"`
+
+	// Outcome is the outcome of the operation
+	Outcome Outcome `json:"outcome"`
+
+	// Status is the HTTP status code of the response
+	Status int `json:"status"`
+
+	// SourceIP is the IP address of the client, or of the proxy in front of the server
+	SourceIP string `json:"source_ip"`
+
+	// ForwardedFor is the X-Forwarded-For header of the request, set by the proxies
+	ForwardedFor string `json:"forwarded_for,omitempty"`
+
+	// UserAgent is the User-Agent header of the request
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// Actor is the user who sent an audited request
+type Actor struct {
+	// Email is the email of the ID token of the user
+	Email string `json:"email"`
+
+	// Groups are the groups of the ID token of the user, with the groups prefix
+	Groups []string `json:"groups"`
+}
+
+// Sink writes the audit events
+type Sink interface {
+	// Emit writes the event, or queues it to be written
+	Emit(ctx context.Context, e *Event) error
+
+	// Close writes the queued events and releases the resources of the sink
+	Close() error
+}
+
+// SinkType is the type of sink of the audit events
+type SinkType string
+
+const (
+	// SinkNone disables the audit events
+	SinkNone SinkType = "none"
+
+	// SinkStdout writes the events to the standard output, one JSON object per line
+	SinkStdout SinkType = "stdout"
+
+	// SinkFile appends the events to a file, one JSON object per line
+	SinkFile SinkType = "file"
+
+	// SinkWebhook posts the events to a webhook, one JSON object per request
+	SinkWebhook SinkType = "webhook"
+)
+
+// Config contains the settings of the sink of the audit events
+type Config struct {
+	// Sink is the type of sink
+	Sink SinkType
+
+	// FilePath is the path of the file of the file sink
+	FilePath string
+
+	// WebhookURL is the URL of the webhook sink
+	WebhookURL string
+
+	// WebhookTimeout is the timeout of each request to the webhook
+	WebhookTimeout time.Duration
+}
+
+// NewSink returns the sink described by the config, or nil when the audit events are disabled
+func NewSink(cfg Config) (Sink, error) {
+	switch cfg.Sink {
+	case "", SinkNone:
+		return nil, nil
+	case SinkStdout:
+		return NewStdoutSink(), nil
+	case SinkFile:
+		if cfg.FilePath == "" {
+			return nil, fmt.Errorf("the file path is required by the file sink")
+		}
+		return NewFileSink(cfg.FilePath)
+	case SinkWebhook:
+		if cfg.WebhookURL == "" {
+			return nil, fmt.Errorf("the webhook URL is required by the webhook sink")
+		}
+		return NewWebhookSink(cfg.WebhookURL, cfg.WebhookTimeout), nil
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q, must be one of 'none', 'stdout', 'file' or 'webhook'", cfg.Sink)
+	}
+}
+
+// multiSink emits the events to several sinks
+type multiSink []Sink
+
+// NewMultiSink returns a sink emitting the events to each of the sinks, the nil ones are ignored.
+// It returns nil when there is no sink, like NewSink when the audit events are disabled
+func NewMultiSink(sinks ...Sink) Sink {
+	var m multiSink
+	for _, s := range sinks {
+		if s != nil {
+			m = append(m, s)
+		}
+	}
+
+	switch len(m) {
+	case 0:
+		return nil
+	case 1:
+		return m[0]
+	default:
+		return m
+	}
+}
+
+func (m multiSink) Emit(ctx context.Context, e *Event) error {
+	var errs []error
+	for _, s := range m {
+		errs = append(errs, s.Emit(ctx, e))
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiSink) Close() error {
+	var errs []error
+	for _, s := range m {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
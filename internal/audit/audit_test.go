@@ -0,0 +1,168 @@
+package audit_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/audit"
+)
+
+func testEvent(target string) *audit.Event {
+	return &audit.Event{
+		Time:      time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC),
+		RequestID: "0b6a6c4e-5d38-4f42-9d5c-3c0a1c4b6e2d",
+		Actor:     audit.Actor{Email: "admin@example.com", Groups: []string{"admins"}},
+		Operation: "CreateUser",
+		Target:    target,
+		Changes:   []string{"username", "password"},
+		Outcome:   audit.OutcomeSuccess,
+		Status:    http.StatusOK,
+		SourceIP:  "10.0.0.1",
+	}
+}
+
+func TestNewSink(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     audit.Config
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "disabled by default", cfg: audit.Config{}, wantNil: true},
+		{name: "none", cfg: audit.Config{Sink: audit.SinkNone}, wantNil: true},
+		{name: "stdout", cfg: audit.Config{Sink: audit.SinkStdout}},
+		{name: "file", cfg: audit.Config{Sink: audit.SinkFile, FilePath: filepath.Join(t.TempDir(), "audit.log")}},
+		{name: "file without path", cfg: audit.Config{Sink: audit.SinkFile}, wantErr: true},
+		{name: "webhook", cfg: audit.Config{Sink: audit.SinkWebhook, WebhookURL: "http://127.0.0.1:1/audit"}},
+		{name: "webhook without url", cfg: audit.Config{Sink: audit.SinkWebhook}, wantErr: true},
+		{name: "unknown sink", cfg: audit.Config{Sink: "syslog"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := audit.NewSink(tt.cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.wantNil {
+				assert.Nil(t, sink)
+				return
+			}
+			require.NotNil(t, sink)
+			assert.NoError(t, sink.Close())
+		})
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// the events are appended to the existing file
+	for _, target := range []string{"jane@example.com", "john@example.com"} {
+		sink, err := audit.NewFileSink(path)
+		require.NoError(t, err)
+		require.NoError(t, sink.Emit(context.Background(), testEvent(target)))
+		require.NoError(t, sink.Close())
+	}
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 2)
+
+	assert.JSONEq(t, `{
+		"time": "2024-10-01T12:00:00Z",
+		"request_id": "0b6a6c4e-5d38-4f42-9d5c-3c0a1c4b6e2d",
+		"actor": {"email": "admin@example.com", "groups": ["admins"]},
+		"operation": "CreateUser",
+		"target": "jane@example.com",
+		"changes": ["username", "password"],
+		"outcome": "success",
+		"status": 200,
+		"source_ip": "10.0.0.1"
+	}`, lines[0])
+
+	var e audit.Event
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &e))
+	assert.Equal(t, "john@example.com", e.Target)
+}
+
+func TestWebhookSink(t *testing.T) {
+	var mu sync.Mutex
+	var targets []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		b, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var e audit.Event
+		assert.NoError(t, json.Unmarshal(b, &e))
+
+		mu.Lock()
+		targets = append(targets, e.Target)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	sink := audit.NewWebhookSink(srv.URL, time.Second)
+	require.NoError(t, sink.Emit(context.Background(), testEvent("jane@example.com")))
+	require.NoError(t, sink.Emit(context.Background(), testEvent("john@example.com")))
+
+	// the queued events are posted before the sink is closed
+	require.NoError(t, sink.Close())
+	assert.Equal(t, []string{"jane@example.com", "john@example.com"}, targets)
+
+	assert.Error(t, sink.Emit(context.Background(), testEvent("jack@example.com")), "the sink is closed")
+}
+
+// recordingSink records the emitted events
+type recordingSink struct {
+	events []*audit.Event
+	closed bool
+}
+
+func (s *recordingSink) Emit(_ context.Context, e *audit.Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestNewMultiSink(t *testing.T) {
+	assert.Nil(t, audit.NewMultiSink(nil, nil))
+
+	single := &recordingSink{}
+	assert.Same(t, single, audit.NewMultiSink(nil, single))
+
+	first, second := &recordingSink{}, &recordingSink{}
+	sink := audit.NewMultiSink(first, nil, second)
+	e := testEvent("jane@example.com")
+	require.NoError(t, sink.Emit(context.Background(), e))
+	require.NoError(t, sink.Close())
+
+	for _, s := range []*recordingSink{first, second} {
+		assert.Equal(t, []*audit.Event{e}, s.events)
+		assert.True(t, s.closed)
+	}
+}
@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
+)
+
+// webhookQueueSize is the number of events queued by the webhook sink, the events are dropped when it is full
+const webhookQueueSize = 1000
+
+// writerSink writes the events to a writer, one JSON object per line
+type writerSink struct {
+	name   string
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewStdoutSink returns a sink writing the events to the standard output
+func NewStdoutSink() Sink {
+	return &writerSink{name: string(SinkStdout), w: os.Stdout}
+}
+
+// NewFileSink returns a sink appending the events to the file, created when it does not exist
+func NewFileSink(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %w", err)
+	}
+	return &writerSink{name: string(SinkFile), w: f, closer: f}, nil
+}
+
+func (s *writerSink) Emit(_ context.Context, e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(b, '\n'))
+	metrics.AuditEvents.WithLabelValues(s.name, metrics.Result(err)).Inc()
+	return err
+}
+
+func (s *writerSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// webhookSink posts the events to a webhook. The events are queued and posted in the background,
+// so that a slow webhook does not slow down the requests
+type webhookSink struct {
+	url    string
+	client *http.Client
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan []byte
+	done   chan struct{}
+}
+
+// NewWebhookSink returns a sink posting the events to the URL, each post with the timeout
+func NewWebhookSink(url string, timeout time.Duration) Sink {
+	s := &webhookSink{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan []byte, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *webhookSink) Emit(_ context.Context, e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return fmt.Errorf("audit webhook sink is closed")
+	}
+
+	select {
+	case s.queue <- b:
+		return nil
+	default:
+		metrics.AuditEvents.WithLabelValues(string(SinkWebhook), "dropped").Inc()
+		return fmt.Errorf("audit webhook queue is full, the event is dropped")
+	}
+}
+
+// run posts the queued events until the sink is closed
+func (s *webhookSink) run() {
+	defer close(s.done)
+	for b := range s.queue {
+		err := s.post(b)
+		if err != nil {
+			log.Err(err).Msg("failed to post audit event to the webhook")
+		}
+		metrics.AuditEvents.WithLabelValues(string(SinkWebhook), metrics.Result(err)).Inc()
+	}
+}
+
+func (s *webhookSink) post(b []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close posts the queued events and stops the sink
+func (s *webhookSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+	return nil
+}
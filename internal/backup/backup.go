@@ -0,0 +1,233 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+// Format is the format of the exported users
+type Format string
+
+const (
+	// FormatNDJSON writes one JSON object per user and per line
+	FormatNDJSON Format = "ndjson"
+
+	// FormatCSV writes one row per user, after a header row with the names of the fields
+	FormatCSV Format = "csv"
+)
+
+// ParseFormat parses the format of the exported users, NDJSON when empty
+func ParseFormat(s string) (Format, error) {
+	switch Format(strings.ToLower(s)) {
+	case "", FormatNDJSON:
+		return FormatNDJSON, nil
+	case FormatCSV:
+		return FormatCSV, nil
+	default:
+		return "", fmt.Errorf("unknown format %q, must be %s or %s", s, FormatNDJSON, FormatCSV)
+	}
+}
+
+// ContentType returns the media type of the format
+func (f Format) ContentType() string {
+	if f == FormatCSV {
+		return "text/csv"
+	}
+	return "application/x-ndjson"
+}
+
+// Fields of the password records, by proto name
+const (
+	FieldEmail    = "email"
+	FieldUsername = "username"
+	FieldUserID   = "user_id"
+	FieldHash     = "hash"
+)
+
+// FullBackupFields are the fields of the full backups, all the fields needed to restore the users
+var FullBackupFields = []string{FieldEmail, FieldUsername, FieldUserID, FieldHash}
+
+// field is a field of the password records written by the Writer
+type field struct {
+	// json is the name of the field in the NDJSON format, the name used by the gateway
+	json string
+
+	value func(*api.Password) string
+	set   func(*api.Password, string)
+}
+
+// fields are the fields of the password records, by proto name.
+// The hash is the bcrypt hash of the password, written as is
+var fields = map[string]field{
+	FieldEmail: {
+		json:  "email",
+		value: (*api.Password).GetEmail,
+		set:   func(p *api.Password, v string) { p.Email = v },
+	},
+	FieldUsername: {
+		json:  "username",
+		value: (*api.Password).GetUsername,
+		set:   func(p *api.Password, v string) { p.Username = v },
+	},
+	FieldUserID: {
+		json:  "userId",
+		value: (*api.Password).GetUserId,
+		set:   func(p *api.Password, v string) { p.UserId = v },
+	},
+	FieldHash: {
+		json:  "hash",
+		value: func(p *api.Password) string { return string(p.GetHash()) },
+		set:   func(p *api.Password, v string) { p.Hash = []byte(v) },
+	},
+}
+
+// Writer writes password records as NDJSON or CSV, with the chosen fields only
+type Writer struct {
+	format Format
+	fields []string
+	w      io.Writer
+	csv    *csv.Writer
+	header bool
+}
+
+// NewWriter returns a writer of the fields, by proto name, of the password records
+func NewWriter(w io.Writer, format Format, names []string) (*Writer, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no fields to export")
+	}
+	for _, name := range names {
+		if _, ok := fields[name]; !ok {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+	}
+
+	bw := &Writer{format: format, fields: names, w: w}
+	if format == FormatCSV {
+		bw.csv = csv.NewWriter(w)
+	}
+	return bw, nil
+}
+
+// Write writes a password record
+func (w *Writer) Write(p *api.Password) error {
+	if w.format == FormatCSV {
+		if !w.header {
+			if err := w.csv.Write(w.fields); err != nil {
+				return err
+			}
+			w.header = true
+		}
+
+		record := make([]string, 0, len(w.fields))
+		for _, name := range w.fields {
+			record = append(record, fields[name].value(p))
+		}
+		return w.csv.Write(record)
+	}
+
+	object := make(map[string]string, len(w.fields))
+	for _, name := range w.fields {
+		f := fields[name]
+		object[f.json] = f.value(p)
+	}
+	b, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(append(b, '\n'))
+	return err
+}
+
+// Flush writes the buffered records, and the CSV header when no record was written
+func (w *Writer) Flush() error {
+	if w.csv == nil {
+		return nil
+	}
+	if !w.header {
+		if err := w.csv.Write(w.fields); err != nil {
+			return err
+		}
+		w.header = true
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+// Read reads the password records written by a Writer, the format is detected from the content:
+// NDJSON when it starts with a JSON object, CSV otherwise
+func Read(r io.Reader) ([]*api.Password, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+	if trimmed[0] == '{' {
+		return readNDJSON(trimmed)
+	}
+	return readCSV(trimmed)
+}
+
+func readNDJSON(data []byte) ([]*api.Password, error) {
+	byJSON := make(map[string]field, len(fields))
+	for _, f := range fields {
+		byJSON[f.json] = f
+	}
+
+	var passwords []*api.Password
+	d := json.NewDecoder(bytes.NewReader(data))
+	for line := 1; ; line++ {
+		var object map[string]string
+		err := d.Decode(&object)
+		if errors.Is(err, io.EOF) {
+			return passwords, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid record %d: %w", line, err)
+		}
+
+		p := &api.Password{}
+		for name, v := range object {
+			f, ok := byJSON[name]
+			if !ok {
+				return nil, fmt.Errorf("invalid record %d: unknown field %q", line, name)
+			}
+			f.set(p, v)
+		}
+		passwords = append(passwords, p)
+	}
+}
+
+func readCSV(data []byte) ([]*api.Password, error) {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+
+	header := records[0]
+	for _, name := range header {
+		if _, ok := fields[name]; !ok {
+			return nil, fmt.Errorf("invalid CSV header: unknown field %q", name)
+		}
+	}
+
+	passwords := make([]*api.Password, 0, len(records)-1)
+	for _, record := range records[1:] {
+		p := &api.Password{}
+		for i, name := range header {
+			fields[name].set(p, record[i])
+		}
+		passwords = append(passwords, p)
+	}
+	return passwords, nil
+}
@@ -0,0 +1,228 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+const testHash = "$2a$10$33EMT0cVYVlPy6WAMCLsceLYjWhuHpbz5yuZxu/GAFj03J9Lytjuy"
+
+var testPasswords = []*api.Password{
+	{Email: "jane@example.com", Username: "Jane", UserId: "1", Hash: []byte(testHash)},
+	{Email: "john@example.com", Username: "John, Jr.", UserId: "2", Hash: []byte(testHash)},
+}
+
+func writeAll(t *testing.T, format Format, names []string, passwords []*api.Password) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, format, names)
+	require.NoError(t, err)
+	for _, p := range passwords {
+		require.NoError(t, w.Write(p))
+	}
+	require.NoError(t, w.Flush())
+	return buf.String()
+}
+
+func TestWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   Format
+		fields   []string
+		expected string
+	}{
+		{
+			name:   "ndjson",
+			format: FormatNDJSON,
+			fields: []string{FieldEmail, FieldUsername, FieldUserID},
+			expected: `{"email":"jane@example.com","userId":"1","username":"Jane"}
+{"email":"john@example.com","userId":"2","username":"John, Jr."}
+`,
+		},
+		{
+			name:   "csv",
+			format: FormatCSV,
+			fields: []string{FieldEmail, FieldUsername},
+			expected: `email,username
+jane@example.com,Jane
+john@example.com,"John, Jr."
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := writeAll(t, tt.format, tt.fields, testPasswords)
+			assert.Equal(t, tt.expected, out)
+			assert.NotContains(t, out, testHash)
+		})
+	}
+}
+
+func TestWriterUnknownField(t *testing.T) {
+	_, err := NewWriter(&bytes.Buffer{}, FormatCSV, []string{"email", "password"})
+	assert.EqualError(t, err, `unknown field "password"`)
+}
+
+func TestRead(t *testing.T) {
+	for _, format := range []Format{FormatNDJSON, FormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			out := writeAll(t, format, FullBackupFields, testPasswords)
+
+			passwords, err := Read(strings.NewReader(out))
+			require.NoError(t, err)
+			require.Len(t, passwords, len(testPasswords))
+			for i, p := range passwords {
+				assert.True(t, proto.Equal(testPasswords[i], p), "record %d", i)
+			}
+		})
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	_, err := Read(strings.NewReader(`{"email":"jane@example.com","password":"secret"}`))
+	assert.EqualError(t, err, `invalid record 1: unknown field "password"`)
+
+	_, err = Read(strings.NewReader("email,password\njane@example.com,secret\n"))
+	assert.EqualError(t, err, `invalid CSV header: unknown field "password"`)
+}
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("")
+	require.NoError(t, err)
+	assert.Equal(t, FormatNDJSON, f)
+
+	f, err = ParseFormat("CSV")
+	require.NoError(t, err)
+	assert.Equal(t, FormatCSV, f)
+
+	_, err = ParseFormat("xml")
+	assert.EqualError(t, err, `unknown format "xml", must be ndjson or csv`)
+}
+
+func TestEncrypt(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	plaintext := []byte(writeAll(t, FormatNDJSON, FullBackupFields, testPasswords))
+
+	encrypted, err := Encrypt(plaintext, passphrase)
+	require.NoError(t, err)
+	assert.True(t, IsEncrypted(encrypted))
+	assert.NotContains(t, string(encrypted), testHash)
+
+	decrypted, err := Decrypt(encrypted, passphrase)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	// wrong passphrase
+	_, err = Decrypt(encrypted, []byte("incorrect horse battery staple"))
+	assert.ErrorIs(t, err, ErrDecrypt)
+
+	// tampered salt
+	tampered := bytes.Clone(encrypted)
+	tampered[len(magic)] ^= 1
+	_, err = Decrypt(tampered, passphrase)
+	assert.ErrorIs(t, err, ErrDecrypt)
+
+	// plain backup
+	_, err = Decrypt(plaintext, passphrase)
+	assert.EqualError(t, err, "not an encrypted backup")
+
+	// short passphrase
+	_, err = Encrypt(plaintext, []byte("secret"))
+	assert.EqualError(t, err, "the passphrase must be at least 12 characters")
+}
+
+// fakeDexClient is a Dex client that creates the password records in memory
+// Calls to methods that are not overridden panic
+type fakeDexClient struct {
+	api.DexClient
+
+	passwords []*api.Password
+
+	// failing is the email of the user that Dex fails to create
+	failing string
+}
+
+func (f *fakeDexClient) CreatePassword(_ context.Context, req *api.CreatePasswordReq, _ ...grpc.CallOption) (*api.CreatePasswordResp, error) {
+	if req.Password.Email == f.failing {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+	for _, p := range f.passwords {
+		if p.Email == req.Password.Email {
+			return &api.CreatePasswordResp{AlreadyExists: true}, nil
+		}
+	}
+	f.passwords = append(f.passwords, req.Password)
+	return &api.CreatePasswordResp{}, nil
+}
+
+func TestRestore(t *testing.T) {
+	client := &fakeDexClient{passwords: []*api.Password{{Email: "jane@example.com"}}}
+
+	result, err := Restore(context.Background(), client, testPasswords)
+	require.NoError(t, err)
+	assert.Equal(t, RestoreResult{Created: 1, AlreadyExists: 1}, result)
+
+	// the hash and the user id are restored as is
+	require.Len(t, client.passwords, 2)
+	assert.True(t, proto.Equal(testPasswords[1], client.passwords[1]))
+}
+
+func TestRestoreErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		passwords []*api.Password
+		failing   string
+		expected  RestoreResult
+		wantErr   string
+	}{
+		{
+			name:      "without hash",
+			passwords: []*api.Password{testPasswords[0], {Email: "john@example.com", UserId: "2"}},
+			wantErr:   "invalid record 2: the hash of john@example.com is not a bcrypt hash, only the full backups can be restored",
+		},
+		{
+			name:      "without user id",
+			passwords: []*api.Password{{Email: "jane@example.com", Hash: []byte(testHash)}},
+			wantErr:   "invalid record 1: the user id of jane@example.com is empty, only the full backups can be restored",
+		},
+		{
+			name:      "dex error",
+			passwords: testPasswords,
+			failing:   "john@example.com",
+			expected:  RestoreResult{Created: 1},
+			wantErr:   "failed to create user john@example.com: " + status.Error(codes.Unavailable, "connection refused").Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeDexClient{failing: tt.failing}
+			result, err := Restore(context.Background(), client, tt.passwords)
+			assert.EqualError(t, err, tt.wantErr)
+			assert.Equal(t, tt.expected, result)
+			assert.Len(t, client.passwords, tt.expected.Created, fmt.Sprintf("created users: %v", client.passwords))
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	assert.NoError(t, Check(testPasswords))
+
+	// the records of the upstream Dex, ListPasswords does not send the hashes
+	err := Check([]*api.Password{{Email: "jane@example.com", Username: "Jane", UserId: "1"}})
+	assert.EqualError(t, err, "invalid record 1: the hash of jane@example.com is not a bcrypt hash, only the full backups can be restored")
+}
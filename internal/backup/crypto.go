@@ -0,0 +1,100 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// MinPassphraseLength is the minimum length of the passphrases of the encrypted backups
+	MinPassphraseLength = 12
+
+	saltSize = 16
+	keySize  = 32
+
+	// scrypt parameters, the ones recommended for interactive logins in 2017
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// magic is the header of the encrypted backups, followed by the salt, the nonce and the ciphertext
+var magic = []byte("dex-http-server backup v1\n")
+
+// ErrDecrypt is returned when a backup cannot be decrypted, the passphrase is wrong or the file is corrupted
+var ErrDecrypt = errors.New("failed to decrypt backup, wrong passphrase or corrupted file")
+
+// Encrypt encrypts the backup with AES-256-GCM, with a key derived from the passphrase with scrypt
+func Encrypt(plaintext, passphrase []byte) ([]byte, error) {
+	if len(passphrase) < MinPassphraseLength {
+		return nil, fmt.Errorf("the passphrase must be at least %d characters", MinPassphraseLength)
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	// the header is authenticated, so that the salt cannot be changed
+	header := append(append([]byte{}, magic...), salt...)
+	out := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(out, nonce, plaintext, header), nil
+}
+
+// Decrypt decrypts a backup encrypted by Encrypt
+func Decrypt(data, passphrase []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return nil, fmt.Errorf("not an encrypted backup")
+	}
+
+	header := data[:len(magic)+saltSize]
+	aead, err := newAEAD(passphrase, header[len(magic):])
+	if err != nil {
+		return nil, err
+	}
+
+	rest := data[len(header):]
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// IsEncrypted returns whether the data is an encrypted backup
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, magic) && len(data) >= len(magic)+saltSize
+}
+
+func newAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
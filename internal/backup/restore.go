@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+// RestoreResult is the number of users created and already existing in Dex
+type RestoreResult struct {
+	Created       int
+	AlreadyExists int
+}
+
+// Restore re-creates the users of a full backup in Dex. The bcrypt hashes and the user ids are
+// sent as is, the passwords are not hashed again. The existing users are left untouched.
+// All the records are checked before the first user is created, and the restore stops at the
+// first error of Dex, the users created before it are counted in the result
+func Restore(ctx context.Context, client api.DexClient, passwords []*api.Password) (RestoreResult, error) {
+	var result RestoreResult
+
+	if err := Check(passwords); err != nil {
+		return result, err
+	}
+
+	for _, p := range passwords {
+		resp, err := client.CreatePassword(ctx, &api.CreatePasswordReq{Password: p})
+		if err != nil {
+			return result, fmt.Errorf("failed to create user %s: %w", p.GetEmail(), err)
+		}
+
+		if resp.GetAlreadyExists() {
+			result.AlreadyExists++
+		} else {
+			result.Created++
+		}
+	}
+	return result, nil
+}
+
+// Check checks that all the records are records of a full backup, so that they can be restored.
+// The backups are checked before being written: the upstream Dex does not send the hashes of the
+// passwords with ListPasswords, and a backup without them could never be restored
+func Check(passwords []*api.Password) error {
+	for i, p := range passwords {
+		if err := checkRecord(p); err != nil {
+			return fmt.Errorf("invalid record %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// checkRecord checks that the record is a record of a full backup, with a user id and a bcrypt hash
+func checkRecord(p *api.Password) error {
+	if strings.TrimSpace(p.GetEmail()) == "" {
+		return fmt.Errorf("the email is empty")
+	}
+	if p.GetUserId() == "" {
+		return fmt.Errorf("the user id of %s is empty, only the full backups can be restored", p.GetEmail())
+	}
+	if _, err := bcrypt.Cost(p.GetHash()); err != nil {
+		return fmt.Errorf("the hash of %s is not a bcrypt hash, only the full backups can be restored", p.GetEmail())
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+const (
+	// LivenessPath is the path of the liveness endpoint
+	LivenessPath = "/healthz"
+
+	// ReadinessPath is the path of the readiness endpoint
+	ReadinessPath = "/readyz"
+)
+
+// Check is a named readiness check
+type Check struct {
+	// Name is the name of the check in the verbose output
+	Name string
+
+	// Func returns an error when the check fails
+	Func func(ctx context.Context) error
+}
+
+// Handler serves the liveness and readiness endpoints, like the kube-apiserver ones.
+//
+// The endpoints return 200 when the checks pass, or 503 otherwise. With the verbose
+// query parameter, the result of each check is listed in the response.
+type Handler struct {
+	checks       []Check
+	timeout      time.Duration
+	shuttingDown atomic.Bool
+}
+
+// NewHandler returns a Handler running the readiness checks, each of them with the timeout
+func NewHandler(timeout time.Duration, checks ...Check) *Handler {
+	return &Handler{
+		checks:  checks,
+		timeout: timeout,
+	}
+}
+
+// Register registers the liveness and readiness endpoints in the mux
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc(LivenessPath, h.serveLiveness)
+	mux.HandleFunc(ReadinessPath, h.serveReadiness)
+}
+
+// Shutdown makes the readiness checks fail, so that the pod is removed from the endpoints
+// of the services while the in-flight requests are drained
+func (h *Handler) Shutdown() {
+	h.shuttingDown.Store(true)
+}
+
+// serveLiveness reports that the server is running, it does not run the readiness checks,
+// so that the pods are not restarted when Dex or the issuer are not available
+func (h *Handler) serveLiveness(w http.ResponseWriter, r *http.Request) {
+	writeResults(w, r, "healthz", []result{{name: "ping"}})
+}
+
+// serveReadiness runs the readiness checks concurrently
+func (h *Handler) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	if h.shuttingDown.Load() {
+		writeResults(w, r, "readyz", []result{{name: "shutdown", err: fmt.Errorf("server is shutting down")}})
+		return
+	}
+
+	results := make([]result, len(h.checks))
+
+	var wg sync.WaitGroup
+	for i, c := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+			defer cancel()
+
+			results[i] = result{name: c.Name, err: c.Func(ctx)}
+		}()
+	}
+	wg.Wait()
+
+	writeResults(w, r, "readyz", results)
+}
+
+// result is the result of a check
+type result struct {
+	name string
+	err  error
+}
+
+// writeResults writes the results of the checks, in the kube-apiserver format
+func writeResults(w http.ResponseWriter, r *http.Request, endpoint string, results []result) {
+	var out strings.Builder
+	failed := false
+	for _, res := range results {
+		if res.err != nil {
+			failed = true
+			log.Warn().Err(res.err).Msgf("%s check %s failed", endpoint, res.name)
+			fmt.Fprintf(&out, "[-]%s failed: %v\n", res.name, res.err)
+		} else {
+			fmt.Fprintf(&out, "[+]%s ok\n", res.name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	_, verbose := r.URL.Query()["verbose"]
+	if failed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, out.String())
+		fmt.Fprintf(w, "%s check failed\n", endpoint)
+		return
+	}
+
+	if verbose {
+		fmt.Fprint(w, out.String())
+		fmt.Fprintf(w, "%s check passed\n", endpoint)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// GRPCConnection checks the state of the gRPC connection
+// An idle connection is asked to connect, and is ready unless it fails to connect
+func GRPCConnection(name string, conn *grpc.ClientConn) Check {
+	return Check{
+		Name: name,
+		Func: func(context.Context) error {
+			switch state := conn.GetState(); state {
+			case connectivity.Idle:
+				conn.Connect()
+				return nil
+			case connectivity.TransientFailure, connectivity.Shutdown:
+				return fmt.Errorf("connection state is %s", state)
+			default:
+				return nil
+			}
+		},
+	}
+}
+
+// DexVersion checks that Dex answers the GetVersion calls
+func DexVersion(name string, client api.DexClient) Check {
+	return Check{
+		Name: name,
+		Func: func(ctx context.Context) error {
+			if _, err := client.GetVersion(ctx, &api.VersionReq{}); err != nil {
+				return fmt.Errorf("failed to get dex version: %w", err)
+			}
+			return nil
+		},
+	}
+}
+
+// Synced checks that a cache has synced
+func Synced(name string, hasSynced func() bool) Check {
+	return Check{
+		Name: name,
+		Func: func(context.Context) error {
+			if !hasSynced() {
+				return fmt.Errorf("not synced")
+			}
+			return nil
+		},
+	}
+}
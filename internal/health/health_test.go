@@ -0,0 +1,140 @@
+package health_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/health"
+)
+
+func okCheck(name string) health.Check {
+	return health.Check{Name: name, Func: func(context.Context) error { return nil }}
+}
+
+func failingCheck(name string) health.Check {
+	return health.Check{Name: name, Func: func(context.Context) error { return fmt.Errorf("unavailable") }}
+}
+
+func serve(t *testing.T, h *health.Handler, target string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	h.Register(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		checks     []health.Check
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "ready",
+			checks:     []health.Check{okCheck("dex"), okCheck("jwks")},
+			target:     "/readyz",
+			wantStatus: http.StatusOK,
+			wantBody:   "ok",
+		},
+		{
+			name:       "ready verbose",
+			checks:     []health.Check{okCheck("dex"), okCheck("jwks")},
+			target:     "/readyz?verbose",
+			wantStatus: http.StatusOK,
+			wantBody:   "[+]dex ok\n[+]jwks ok\nreadyz check passed\n",
+		},
+		{
+			name:       "not ready",
+			checks:     []health.Check{okCheck("dex"), failingCheck("jwks")},
+			target:     "/readyz",
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "[+]dex ok\n[-]jwks failed: unavailable\nreadyz check failed\n",
+		},
+		{
+			name:       "liveness does not run the readiness checks",
+			checks:     []health.Check{failingCheck("jwks")},
+			target:     "/healthz?verbose",
+			wantStatus: http.StatusOK,
+			wantBody:   "[+]ping ok\nhealthz check passed\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(t, health.NewHandler(time.Second, tt.checks...), tt.target)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandlerShutdown(t *testing.T) {
+	h := health.NewHandler(time.Second, okCheck("dex"))
+	assert.Equal(t, http.StatusOK, serve(t, h, "/readyz").Code)
+
+	h.Shutdown()
+	w := serve(t, h, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "[-]shutdown failed: server is shutting down\nreadyz check failed\n", w.Body.String())
+
+	// the server is still alive while it drains the requests
+	assert.Equal(t, http.StatusOK, serve(t, h, "/healthz").Code)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	slow := health.Check{Name: "slow", Func: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+
+	w := serve(t, health.NewHandler(10*time.Millisecond, slow), "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "[-]slow failed: context deadline exceeded")
+}
+
+// fakeDexClient answers the GetVersion calls
+type fakeDexClient struct {
+	api.DexClient
+	err error
+}
+
+func (c *fakeDexClient) GetVersion(context.Context, *api.VersionReq, ...grpc.CallOption) (*api.VersionResp, error) {
+	return &api.VersionResp{Server: "v2.41.1", Api: 2}, c.err
+}
+
+func TestDexVersion(t *testing.T) {
+	assert.NoError(t, health.DexVersion("dex", &fakeDexClient{}).Func(context.Background()))
+	assert.Error(t, health.DexVersion("dex", &fakeDexClient{err: fmt.Errorf("unavailable")}).Func(context.Background()))
+}
+
+func TestGRPCConnection(t *testing.T) {
+	// nothing listens on the port, so the connection fails once it leaves the idle state
+	conn, err := grpc.NewClient("passthrough:///127.0.0.1:1", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	check := health.GRPCConnection("grpc", conn)
+	assert.NoError(t, check.Func(context.Background()), "an idle connection is ready")
+
+	assert.Eventually(t, func() bool {
+		return check.Func(context.Background()) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSynced(t *testing.T) {
+	assert.NoError(t, health.Synced("cache", func() bool { return true }).Func(context.Background()))
+	assert.Error(t, health.Synced("cache", func() bool { return false }).Func(context.Background()))
+}
@@ -0,0 +1,42 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ResourceGroup is the API group of the virtual resources checked with SubjectAccessReviews
+// The resources are not served by the Kubernetes API, they only exist to be referenced in RBAC rules
+const ResourceGroup = "dex.mirantis.com"
+
+// CheckAccess asks the Kubernetes API, with a SubjectAccessReview, if the user or any of the groups
+// is allowed to perform the action described by the resource attributes.
+// It returns whether the action is allowed and the reason given by the authorizer
+func CheckAccess(ctx context.Context, client kubernetes.Interface, user string, groups []string, attrs *authorizationv1.ResourceAttributes) (bool, string, error) {
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               user,
+			Groups:             groups,
+			ResourceAttributes: attrs,
+		},
+	}
+
+	ctx, done := startRequest(ctx, "create_subjectaccessreview")
+	resp, err := client.AuthorizationV1().SubjectAccessReviews().Create(ctx, sar, metav1.CreateOptions{})
+	done(err)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to create subject access review: %v", err)
+	}
+
+	// an evaluation error does not prevent the request from being allowed, e.g. when only some
+	// of the bindings failed to evaluate, so it is only reported for denied requests
+	if !resp.Status.Allowed && resp.Status.EvaluationError != "" {
+		return false, resp.Status.Reason, fmt.Errorf("subject access review evaluation error: %s", resp.Status.EvaluationError)
+	}
+
+	return resp.Status.Allowed && !resp.Status.Denied, resp.Status.Reason, nil
+}
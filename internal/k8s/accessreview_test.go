@@ -0,0 +1,103 @@
+package k8s_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/k8s"
+)
+
+// accessReviewReactor answers the SubjectAccessReviews, allowing the listed verbs on users to the group
+func accessReviewReactor(group string, verbs ...string) k8stesting.ReactionFunc {
+	return func(action k8stesting.Action) (bool, runtime.Object, error) {
+		sar := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attrs := sar.Spec.ResourceAttributes
+
+		if attrs.Group == k8s.ResourceGroup && attrs.Resource == "users" &&
+			slices.Contains(verbs, attrs.Verb) && slices.Contains(sar.Spec.Groups, group) {
+			sar.Status.Allowed = true
+			sar.Status.Reason = fmt.Sprintf("allowed to %s users through group %s", attrs.Verb, group)
+		}
+		return true, sar, nil
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	tests := []struct {
+		name        string
+		groups      []string
+		verb        string
+		reactor     k8stesting.ReactionFunc
+		wantAllowed bool
+		expectError bool
+	}{
+		{
+			name:        "allowed through group",
+			groups:      []string{"helpdesk"},
+			verb:        "list",
+			reactor:     accessReviewReactor("helpdesk", "list", "update"),
+			wantAllowed: true,
+		},
+		{
+			name:        "verb not allowed",
+			groups:      []string{"helpdesk"},
+			verb:        "delete",
+			reactor:     accessReviewReactor("helpdesk", "list", "update"),
+			wantAllowed: false,
+		},
+		{
+			name:        "group not allowed",
+			groups:      []string{"developers"},
+			verb:        "list",
+			reactor:     accessReviewReactor("helpdesk", "list", "update"),
+			wantAllowed: false,
+		},
+		{
+			name:   "evaluation error",
+			groups: []string{"helpdesk"},
+			verb:   "list",
+			reactor: func(action k8stesting.Action) (bool, runtime.Object, error) {
+				sar := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+				sar.Status.EvaluationError = "failed to get role"
+				return true, sar, nil
+			},
+			expectError: true,
+		},
+		{
+			name:   "api error",
+			groups: []string{"helpdesk"},
+			verb:   "list",
+			reactor: func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, fmt.Errorf("connection refused")
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewClientset()
+			clientset.PrependReactor("create", "subjectaccessreviews", tt.reactor)
+
+			allowed, _, err := k8s.CheckAccess(context.TODO(), clientset, "jane@example.com", tt.groups, &authorizationv1.ResourceAttributes{
+				Group:    k8s.ResourceGroup,
+				Resource: "users",
+				Verb:     tt.verb,
+			})
+			if tt.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantAllowed, allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	rbaclisters "k8s.io/client-go/listers/rbac/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// subjectIndex is the name of the index of the bindings by subject
+	subjectIndex = "subject"
+
+	// cacheResyncPeriod is the resync period of the informers
+	cacheResyncPeriod = 10 * time.Minute
+)
+
+// RoleResolver returns the grants of the ClusterRoles bound to a user or any of its groups
+type RoleResolver interface {
+	ResolveRoles(ctx context.Context, user string, groups []string) ([]RoleGrant, error)
+}
+
+// RoleResolverFunc is a function that implements RoleResolver
+type RoleResolverFunc func(ctx context.Context, user string, groups []string) ([]RoleGrant, error)
+
+// ResolveRoles calls f(ctx, user, groups)
+func (f RoleResolverFunc) ResolveRoles(ctx context.Context, user string, groups []string) ([]RoleGrant, error) {
+	return f(ctx, user, groups)
+}
+
+// NewRoleLister returns a RoleResolver that lists the RBAC objects from the Kubernetes API on every call
+func NewRoleLister(client kubernetes.Interface, opts ResolverOptions) RoleResolver {
+	return RoleResolverFunc(func(ctx context.Context, user string, groups []string) ([]RoleGrant, error) {
+		return ResolveRoles(ctx, client, user, groups, opts)
+	})
+}
+
+// RoleCache resolves the ClusterRoles of the users from informer caches of the ClusterRoleBindings,
+// the RoleBindings of the admin namespaces, both indexed by subject, and the ClusterRoles.
+//
+// The informers keep the cache up to date by watching the Kubernetes API. When the list or the
+// watch of any informer has been failing for longer than the max staleness, or before the initial
+// sync, the roles are resolved from the Kubernetes API instead, so that stale reads are bounded.
+type RoleCache struct {
+	client       kubernetes.Interface
+	opts         ResolverOptions
+	factories    []informers.SharedInformerFactory
+	maxStaleness time.Duration
+	cancel       context.CancelFunc
+
+	clusterRoleBindings cache.SharedIndexInformer
+	roleBindings        []cache.SharedIndexInformer
+	clusterRoles        rbaclisters.ClusterRoleLister
+	informers           []cache.SharedIndexInformer
+
+	mu sync.Mutex
+	// failingSince is the time of the first error of the list or watch of each informer, by name,
+	// since its last successful list or watch
+	failingSince map[string]time.Time
+}
+
+// NewRoleCache creates a RoleCache, Start must be called before it is used
+func NewRoleCache(client kubernetes.Interface, opts ResolverOptions, maxStaleness time.Duration) (*RoleCache, error) {
+	factory := informers.NewSharedInformerFactory(client, cacheResyncPeriod)
+
+	c := &RoleCache{
+		client:       client,
+		opts:         opts,
+		factories:    []informers.SharedInformerFactory{factory},
+		maxStaleness: maxStaleness,
+		failingSince: map[string]time.Time{},
+	}
+
+	var err error
+	crbs := client.RbacV1().ClusterRoleBindings()
+	if c.clusterRoleBindings, err = c.informerFor(factory, "clusterrolebindings", &rbacv1.ClusterRoleBinding{},
+		func(ctx context.Context, lo metav1.ListOptions) (runtime.Object, error) { return crbs.List(ctx, lo) }, crbs.Watch); err != nil {
+		return nil, err
+	}
+
+	crs := client.RbacV1().ClusterRoles()
+	clusterRoles, err := c.informerFor(factory, "clusterroles", &rbacv1.ClusterRole{},
+		func(ctx context.Context, lo metav1.ListOptions) (runtime.Object, error) { return crs.List(ctx, lo) }, crs.Watch)
+	if err != nil {
+		return nil, err
+	}
+	c.clusterRoles = rbaclisters.NewClusterRoleLister(clusterRoles.GetIndexer())
+
+	c.informers = append(c.informers, c.clusterRoleBindings, clusterRoles)
+
+	// the RoleBindings are only watched in the admin namespaces
+	for _, ns := range opts.AdminNamespaces {
+		nsFactory := informers.NewSharedInformerFactoryWithOptions(client, cacheResyncPeriod, informers.WithNamespace(ns))
+		rbs := client.RbacV1().RoleBindings(ns)
+		informer, err := c.informerFor(nsFactory, "rolebindings/"+ns, &rbacv1.RoleBinding{},
+			func(ctx context.Context, lo metav1.ListOptions) (runtime.Object, error) { return rbs.List(ctx, lo) }, rbs.Watch)
+		if err != nil {
+			return nil, err
+		}
+
+		c.factories = append(c.factories, nsFactory)
+		c.roleBindings = append(c.roleBindings, informer)
+		c.informers = append(c.informers, informer)
+	}
+
+	for _, informer := range append([]cache.SharedIndexInformer{c.clusterRoleBindings}, c.roleBindings...) {
+		if err := informer.AddIndexers(cache.Indexers{subjectIndex: subjectIndexFunc}); err != nil {
+			return nil, fmt.Errorf("failed to add subject index: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// informerFor registers in the factory an informer of the objects of the list and watch functions,
+// that tracks whether the cache is up to date from the results of the lists and watches against the
+// Kubernetes API. The notifications of the informer cannot be used for that, the periodic resyncs
+// replay the cached objects even when the watch is failing
+func (c *RoleCache) informerFor(
+	factory informers.SharedInformerFactory,
+	name string,
+	obj runtime.Object,
+	list func(context.Context, metav1.ListOptions) (runtime.Object, error),
+	watchFunc func(context.Context, metav1.ListOptions) (watch.Interface, error),
+) (cache.SharedIndexInformer, error) {
+	lw := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			objs, err := list(context.TODO(), opts)
+			c.track(name, err)
+			return objs, err
+		},
+		// a watch that is started again continues from the last synced resource version,
+		// so the cache is up to date again once it is started
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			w, err := watchFunc(context.TODO(), opts)
+			c.track(name, err)
+			return w, err
+		},
+	}
+
+	informer := factory.InformerFor(obj, func(_ kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return cache.NewSharedIndexInformer(lw, obj, resync, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	})
+
+	// the errors of the established watches end the watch, they are reported to the error handler
+	if err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		c.track(name, err)
+		cache.DefaultWatchErrorHandler(r, err)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to set watch error handler: %w", err)
+	}
+	return informer, nil
+}
+
+// Start starts the informers, they are stopped when the context is done
+func (c *RoleCache) Start(ctx context.Context) {
+	log.Info().Strs("adminNamespaces", c.opts.AdminNamespaces).Msg("Starting RBAC informers")
+	ctx, c.cancel = context.WithCancel(ctx)
+	for _, f := range c.factories {
+		f.Start(ctx.Done())
+	}
+}
+
+// Stop stops the informers started by Start, and waits for them to terminate
+func (c *RoleCache) Stop() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	for _, f := range c.factories {
+		f.Shutdown()
+	}
+	log.Info().Msg("Stopped RBAC informers")
+}
+
+// WaitForSync waits for the initial sync of the cache, it returns false if the context is done first
+func (c *RoleCache) WaitForSync(ctx context.Context) bool {
+	return cache.WaitForCacheSync(ctx.Done(), c.HasSynced)
+}
+
+// HasSynced returns true once the initial sync of all the informers is done
+func (c *RoleCache) HasSynced() bool {
+	for _, informer := range c.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveRoles returns the grants of the ClusterRoles bound to the user or any of the groups
+func (c *RoleCache) ResolveRoles(ctx context.Context, user string, groups []string) ([]RoleGrant, error) {
+	if !c.fresh() {
+		log.Warn().Msg("RBAC cache is not synced or is stale, resolving the roles from the api")
+		return ResolveRoles(ctx, c.client, user, groups, c.opts)
+	}
+
+	keys := []string{subjectKey(rbacv1.UserKind, user)}
+	for _, g := range groups {
+		keys = append(keys, subjectKey(rbacv1.GroupKind, g))
+	}
+
+	var grants []RoleGrant
+
+	objs, err := indexedBindings(c.clusterRoleBindings, keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster role bindings from cache: %w", err)
+	}
+	for _, obj := range objs {
+		if crb, ok := obj.(*rbacv1.ClusterRoleBinding); ok {
+			grants = appendClusterRoleBindingGrant(grants, crb, user, groups)
+		}
+	}
+
+	for _, informer := range c.roleBindings {
+		objs, err := indexedBindings(informer, keys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get role bindings from cache: %w", err)
+		}
+		for _, obj := range objs {
+			if rb, ok := obj.(*rbacv1.RoleBinding); ok {
+				grants = appendRoleBindingGrant(grants, rb, user, groups)
+			}
+		}
+	}
+
+	return expandAggregatedRoles(ctx, &listerClusterRoleSource{lister: c.clusterRoles}, grants)
+}
+
+// indexedBindings returns the bindings of the informer with any of the subject keys
+// A binding may match several keys, e.g. the user and one of its groups, it is returned once
+func indexedBindings(informer cache.SharedIndexInformer, keys []string) ([]interface{}, error) {
+	var bindings []interface{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		objs, err := informer.GetIndexer().ByIndex(subjectIndex, key)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range objs {
+			k, err := cache.MetaNamespaceKeyFunc(obj)
+			if err != nil || seen[k] {
+				continue
+			}
+			seen[k] = true
+			bindings = append(bindings, obj)
+		}
+	}
+	return bindings, nil
+}
+
+// fresh returns true if the cache is synced and not stale
+func (c *RoleCache) fresh() bool {
+	if !c.HasSynced() {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, since := range c.failingSince {
+		if time.Since(since) >= c.maxStaleness {
+			return false
+		}
+	}
+	return true
+}
+
+// track records the result of a list or a watch of the informer of the name, the cache becomes
+// stale when the informer has been failing for longer than the max staleness
+func (c *RoleCache) track(name string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		delete(c.failingSince, name)
+		return
+	}
+	if _, ok := c.failingSince[name]; !ok {
+		c.failingSince[name] = time.Now()
+	}
+}
+
+// listerClusterRoleSource gets the ClusterRoles from the informer cache
+type listerClusterRoleSource struct {
+	lister rbaclisters.ClusterRoleLister
+}
+
+func (s *listerClusterRoleSource) get(_ context.Context, name string) (*rbacv1.ClusterRole, error) {
+	cr, err := s.lister.Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return cr, err
+}
+
+func (s *listerClusterRoleSource) list(_ context.Context, selector labels.Selector) ([]*rbacv1.ClusterRole, error) {
+	return s.lister.List(selector)
+}
+
+// subjectIndexFunc indexes the ClusterRoleBindings and RoleBindings by the keys of their subjects
+func subjectIndexFunc(obj interface{}) ([]string, error) {
+	var subjects []rbacv1.Subject
+	switch b := obj.(type) {
+	case *rbacv1.ClusterRoleBinding:
+		subjects = b.Subjects
+	case *rbacv1.RoleBinding:
+		subjects = b.Subjects
+	default:
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+
+	var keys []string
+	for _, s := range subjects {
+		switch s.Kind {
+		case rbacv1.UserKind, rbacv1.ServiceAccountKind, rbacv1.GroupKind:
+			key := subjectKey(s.Kind, s.Name)
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// subjectKey returns the index key of a subject
+// Users and service accounts share the same keys, as they are both matched by name
+func subjectKey(kind, name string) string {
+	if kind == rbacv1.ServiceAccountKind {
+		kind = rbacv1.UserKind
+	}
+	return kind + "/" + name
+}
@@ -0,0 +1,247 @@
+package k8s_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/k8s"
+)
+
+func newSyncedCache(t testing.TB, clientset *fake.Clientset, opts k8s.ResolverOptions) *k8s.RoleCache {
+	c, err := k8s.NewRoleCache(clientset, opts, time.Minute)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	c.Start(ctx)
+	require.True(t, c.WaitForSync(ctx))
+	return c
+}
+
+func TestRoleCacheStop(t *testing.T) {
+	c := newSyncedCache(t, fake.NewClientset(), k8s.ResolverOptions{AdminNamespaces: []string{"mke"}})
+
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the informers did not stop")
+	}
+}
+
+func TestRoleCache(t *testing.T) {
+	clientset := fake.NewClientset(&rbacv1.ClusterRoleBindingList{
+		Items: []rbacv1.ClusterRoleBinding{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "binding1"},
+				Subjects: []rbacv1.Subject{
+					{Kind: rbacv1.UserKind, Name: "jane@example.com"},
+					{Kind: rbacv1.GroupKind, Name: "admins"},
+				},
+				RoleRef: rbacv1.RoleRef{Name: "cluster-admin"},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "binding2"},
+				Subjects: []rbacv1.Subject{
+					{Kind: rbacv1.ServiceAccountKind, Name: "test-sa"},
+				},
+				RoleRef: rbacv1.RoleRef{Name: "view"},
+			},
+		},
+	})
+	c := newSyncedCache(t, clientset, k8s.ResolverOptions{})
+
+	tests := []struct {
+		name          string
+		user          string
+		groups        []string
+		expectedRoles []string
+	}{
+		{name: "user subject", user: "jane@example.com", expectedRoles: []string{"cluster-admin"}},
+		{name: "service account subject", user: "test-sa", expectedRoles: []string{"view"}},
+		{name: "group subject", user: "john@example.com", groups: []string{"admins"}, expectedRoles: []string{"cluster-admin"}},
+		{name: "user and group of the same binding", user: "jane@example.com", groups: []string{"admins"}, expectedRoles: []string{"cluster-admin"}},
+		{name: "no bindings", user: "john@example.com", groups: []string{"developers"}, expectedRoles: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grants, err := c.ResolveRoles(context.TODO(), tt.user, tt.groups)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tt.expectedRoles, k8s.RoleNames(grants))
+		})
+	}
+}
+
+func TestRoleCacheWatchesChanges(t *testing.T) {
+	clientset := fake.NewClientset()
+	c := newSyncedCache(t, clientset, k8s.ResolverOptions{})
+
+	grants, err := c.ResolveRoles(context.TODO(), "jane@example.com", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, grants)
+
+	_, err = clientset.RbacV1().ClusterRoleBindings().Create(context.TODO(), &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "binding1"},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "jane@example.com"}},
+		RoleRef:    rbacv1.RoleRef{Name: "cluster-admin"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		grants, err := c.ResolveRoles(context.TODO(), "jane@example.com", nil)
+		return err == nil && len(grants) == 1 && grants[0].ClusterRole == "cluster-admin"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRoleCacheStaleWhileWatchFails(t *testing.T) {
+	clientset := fake.NewClientset()
+
+	// the watch of the ClusterRoleBindings fails from the start, with an error the informer retries
+	// without listing again, and the lists are counted to know where the roles are resolved from
+	var watchFails atomic.Bool
+	var lists atomic.Int32
+	watchFails.Store(true)
+	clientset.PrependWatchReactor("clusterrolebindings", func(k8stesting.Action) (bool, watch.Interface, error) {
+		if watchFails.Load() {
+			return true, nil, apierrors.NewTooManyRequests("watch failed", 1)
+		}
+		return false, nil, nil
+	})
+	clientset.PrependReactor("list", "clusterrolebindings", func(k8stesting.Action) (bool, runtime.Object, error) {
+		lists.Add(1)
+		return false, nil, nil
+	})
+
+	c, err := k8s.NewRoleCache(clientset, k8s.ResolverOptions{}, 100*time.Millisecond)
+	require.NoError(t, err)
+
+	// the resyncs replay the cached objects while the watch is failing
+	var resyncs atomic.Int32
+	for _, informer := range c.Informers() {
+		_, err := informer.AddEventHandlerWithResyncPeriod(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(interface{}, interface{}) { resyncs.Add(1) },
+		}, time.Second)
+		require.NoError(t, err)
+	}
+	_, err = clientset.RbacV1().ClusterRoleBindings().Create(context.TODO(), &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "binding1"},
+		RoleRef:    rbacv1.RoleRef{Name: "view"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c.Start(ctx)
+	require.True(t, c.WaitForSync(ctx))
+
+	resolvedFromAPI := func() bool {
+		before := lists.Load()
+		_, err := c.ResolveRoles(context.TODO(), "jane@example.com", nil)
+		require.NoError(t, err)
+		return lists.Load() > before
+	}
+
+	// the cache is stale once the watch has been failing for longer than the max staleness,
+	// and it stays stale after the resyncs
+	assert.Eventually(t, resolvedFromAPI, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return resyncs.Load() > 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, resolvedFromAPI())
+
+	// the cache is fresh again once the watch is started again, without any new event
+	watchFails.Store(false)
+	assert.Eventually(t, func() bool { return !resolvedFromAPI() }, 10*time.Second, 50*time.Millisecond)
+}
+
+func TestRoleCacheFallsBackToListBeforeSync(t *testing.T) {
+	clientset := fake.NewClientset(&rbacv1.ClusterRoleBindingList{
+		Items: []rbacv1.ClusterRoleBinding{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "binding1"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "jane@example.com"}},
+				RoleRef:    rbacv1.RoleRef{Name: "cluster-admin"},
+			},
+		},
+	})
+
+	// the cache is not started, so it never syncs
+	c, err := k8s.NewRoleCache(clientset, k8s.ResolverOptions{}, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, c.HasSynced())
+
+	grants, err := c.ResolveRoles(context.TODO(), "jane@example.com", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cluster-admin"}, k8s.RoleNames(grants))
+}
+
+func TestRoleCacheResolvesRoleBindingsAndAggregation(t *testing.T) {
+	c := newSyncedCache(t, newRBACClientset(), k8s.ResolverOptions{AdminNamespaces: []string{"mke"}})
+
+	for _, tt := range resolveRolesTests {
+		t.Run(tt.name, func(t *testing.T) {
+			grants, err := c.ResolveRoles(context.TODO(), tt.user, tt.groups)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tt.expectedGrants, grants)
+		})
+	}
+}
+
+// newBenchmarkClientset returns a clientset with many ClusterRoleBindings, like a large cluster
+func newBenchmarkClientset(n int) *fake.Clientset {
+	items := make([]rbacv1.ClusterRoleBinding, 0, n)
+	for i := 0; i < n; i++ {
+		items = append(items, rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("binding%d", i)},
+			Subjects: []rbacv1.Subject{
+				{Kind: rbacv1.UserKind, Name: fmt.Sprintf("user%d@example.com", i)},
+				{Kind: rbacv1.GroupKind, Name: fmt.Sprintf("group%d", i%50)},
+			},
+			RoleRef: rbacv1.RoleRef{Name: fmt.Sprintf("role%d", i%20)},
+		})
+	}
+	return fake.NewClientset(&rbacv1.ClusterRoleBindingList{Items: items})
+}
+
+func BenchmarkResolveRolesList(b *testing.B) {
+	clientset := newBenchmarkClientset(2000)
+	resolver := k8s.NewRoleLister(clientset, k8s.ResolverOptions{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := resolver.ResolveRoles(context.TODO(), "user42@example.com", []string{"group7"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResolveRolesCache(b *testing.B) {
+	clientset := newBenchmarkClientset(2000)
+	c := newSyncedCache(b, clientset, k8s.ResolverOptions{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.ResolveRoles(context.TODO(), "user42@example.com", []string{"group7"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
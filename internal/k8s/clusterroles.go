@@ -5,12 +5,18 @@ import (
 	"fmt"
 	"slices"
 
+	"go.opentelemetry.io/otel/attribute"
 	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
+// clusterRoleKind is the kind of the ClusterRoles referenced by the bindings
+const clusterRoleKind = "ClusterRole"
+
 // NewClientSet creates a new Kubernetes clientset
 func NewClientSet() (*kubernetes.Clientset, error) {
 	config, err := rest.InClusterConfig()
@@ -21,21 +27,245 @@ func NewClientSet() (*kubernetes.Clientset, error) {
 	return kubernetes.NewForConfig(config)
 }
 
-// GetClusterRoles returns the ClusterRoles assigned to a provided service account name
-func GetClusterRoles(ctx context.Context, client kubernetes.Interface, serviceAccountName string) ([]string, error) {
-	clusterRoleBindings, err := client.RbacV1().ClusterRoleBindings().List(ctx, metav1.ListOptions{})
+// RoleGrant describes how a ClusterRole is granted to a user, so that authorization decisions can be audited
+type RoleGrant struct {
+	// ClusterRole is the name of the granted ClusterRole
+	ClusterRole string
+
+	// AggregatedBy is the name of the bound ClusterRole that aggregates ClusterRole
+	// It is empty when ClusterRole is bound directly
+	AggregatedBy string
+
+	// BindingKind is the kind of the binding, ClusterRoleBinding or RoleBinding
+	BindingKind string
+
+	// BindingName is the name of the binding
+	BindingName string
+
+	// BindingNamespace is the namespace of the RoleBindings, it is empty for ClusterRoleBindings
+	BindingNamespace string
+
+	// Subject is the subject of the binding that matched the user or one of its groups
+	Subject rbacv1.Subject
+}
+
+// String returns a human-readable description of the grant, e.g.
+// "ClusterRole view (aggregated by admin) through RoleBinding mke/admins for Group admins"
+func (g RoleGrant) String() string {
+	role := "ClusterRole " + g.ClusterRole
+	if g.AggregatedBy != "" {
+		role += " (aggregated by " + g.AggregatedBy + ")"
+	}
+
+	binding := g.BindingName
+	if g.BindingNamespace != "" {
+		binding = g.BindingNamespace + "/" + g.BindingName
+	}
+
+	return fmt.Sprintf("%s through %s %s for %s %s", role, g.BindingKind, binding, g.Subject.Kind, g.Subject.Name)
+}
+
+// ResolverOptions contains the settings used to resolve the roles of the users
+type ResolverOptions struct {
+	// AdminNamespaces is the list of namespaces whose RoleBindings to ClusterRoles grant the ClusterRoles
+	// to their subjects, in addition to the ClusterRoleBindings
+	AdminNamespaces []string
+}
+
+// RoleNames returns the unique names of the ClusterRoles of the grants
+func RoleNames(grants []RoleGrant) []string {
+	var names []string
+	for _, g := range grants {
+		if !slices.Contains(names, g.ClusterRole) {
+			names = append(names, g.ClusterRole)
+		}
+	}
+	return names
+}
+
+// GetClusterRoles returns the ClusterRoles assigned to a provided user or service account name,
+// either directly or through any of the provided groups
+func GetClusterRoles(ctx context.Context, client kubernetes.Interface, serviceAccountName string, groups []string) ([]string, error) {
+	grants, err := ResolveRoles(ctx, client, serviceAccountName, groups, ResolverOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return RoleNames(grants), nil
+}
+
+// ResolveRoles returns the grants of the ClusterRoles assigned to a provided user or service account name,
+// either directly or through any of the provided groups. The grants come from the ClusterRoleBindings, the
+// RoleBindings to ClusterRoles in the admin namespaces, and the ClusterRoles aggregated by the bound ClusterRoles.
+// The RBAC objects are listed from the Kubernetes API.
+func ResolveRoles(ctx context.Context, client kubernetes.Interface, serviceAccountName string, groups []string, opts ResolverOptions) ([]RoleGrant, error) {
+	listCtx, done := startRequest(ctx, "list_clusterrolebindings")
+	clusterRoleBindings, err := client.RbacV1().ClusterRoleBindings().List(listCtx, metav1.ListOptions{})
+	done(err)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list cluster role bindings: %v", err)
 	}
 
-	var clusterRoles []string
-	for _, crb := range clusterRoleBindings.Items {
-		for _, subject := range crb.Subjects {
-			if slices.Contains([]string{rbacv1.UserKind, rbacv1.ServiceAccountKind}, subject.Kind) && subject.Name == serviceAccountName {
-				clusterRoles = append(clusterRoles, crb.RoleRef.Name)
+	var grants []RoleGrant
+	for i := range clusterRoleBindings.Items {
+		grants = appendClusterRoleBindingGrant(grants, &clusterRoleBindings.Items[i], serviceAccountName, groups)
+	}
+
+	for _, ns := range opts.AdminNamespaces {
+		listCtx, done := startRequest(ctx, "list_rolebindings", attribute.String("k8s.namespace.name", ns))
+		roleBindings, err := client.RbacV1().RoleBindings(ns).List(listCtx, metav1.ListOptions{})
+		done(err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list role bindings in namespace %s: %v", ns, err)
+		}
+
+		for i := range roleBindings.Items {
+			grants = appendRoleBindingGrant(grants, &roleBindings.Items[i], serviceAccountName, groups)
+		}
+	}
+
+	return expandAggregatedRoles(ctx, &apiClusterRoleSource{client: client}, grants)
+}
+
+// appendClusterRoleBindingGrant appends the grant of the binding when any of its subjects matches
+func appendClusterRoleBindingGrant(grants []RoleGrant, crb *rbacv1.ClusterRoleBinding, name string, groups []string) []RoleGrant {
+	for _, subject := range crb.Subjects {
+		if subjectMatches(subject, name, groups) {
+			return append(grants, RoleGrant{
+				ClusterRole: crb.RoleRef.Name,
+				BindingKind: "ClusterRoleBinding",
+				BindingName: crb.Name,
+				Subject:     subject,
+			})
+		}
+	}
+	return grants
+}
+
+// appendRoleBindingGrant appends the grant of the binding when it references a ClusterRole
+// and any of its subjects matches
+func appendRoleBindingGrant(grants []RoleGrant, rb *rbacv1.RoleBinding, name string, groups []string) []RoleGrant {
+	// namespaced Roles cannot be referenced by the authorization policy
+	if rb.RoleRef.Kind != clusterRoleKind {
+		return grants
+	}
+
+	for _, subject := range rb.Subjects {
+		if subjectMatches(subject, name, groups) {
+			return append(grants, RoleGrant{
+				ClusterRole:      rb.RoleRef.Name,
+				BindingKind:      "RoleBinding",
+				BindingName:      rb.Name,
+				BindingNamespace: rb.Namespace,
+				Subject:          subject,
+			})
+		}
+	}
+	return grants
+}
+
+// subjectMatches returns true if the binding subject is the user (or service account) or any of the groups
+func subjectMatches(subject rbacv1.Subject, name string, groups []string) bool {
+	switch subject.Kind {
+	case rbacv1.UserKind, rbacv1.ServiceAccountKind:
+		return subject.Name == name
+	case rbacv1.GroupKind:
+		return slices.Contains(groups, subject.Name)
+	default:
+		return false
+	}
+}
+
+// clusterRoleSource provides the ClusterRoles used to expand the aggregated ClusterRoles
+type clusterRoleSource interface {
+	// get returns the ClusterRole with the name, or nil if it does not exist
+	get(ctx context.Context, name string) (*rbacv1.ClusterRole, error)
+
+	// list returns the ClusterRoles matching the selector
+	list(ctx context.Context, selector labels.Selector) ([]*rbacv1.ClusterRole, error)
+}
+
+// expandAggregatedRoles adds to the grants the ClusterRoles aggregated by the granted ClusterRoles.
+// A user bound to an aggregated ClusterRole has the rules of all the ClusterRoles it aggregates,
+// so they are granted too, through the same binding.
+func expandAggregatedRoles(ctx context.Context, src clusterRoleSource, grants []RoleGrant) ([]RoleGrant, error) {
+	expanded := slices.Clone(grants)
+
+	for _, g := range grants {
+		// aggregated roles may aggregate other roles, e.g. admin aggregates edit which aggregates view
+		visited := map[string]bool{g.ClusterRole: true}
+		queue := []string{g.ClusterRole}
+
+		for len(queue) > 0 {
+			name := queue[0]
+			queue = queue[1:]
+
+			cr, err := src.get(ctx, name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get cluster role %s: %v", name, err)
+			}
+
+			if cr == nil || cr.AggregationRule == nil {
+				continue
+			}
+
+			for _, ls := range cr.AggregationRule.ClusterRoleSelectors {
+				selector, err := metav1.LabelSelectorAsSelector(&ls)
+				if err != nil {
+					return nil, fmt.Errorf("invalid aggregation rule of cluster role %s: %v", name, err)
+				}
+
+				aggregated, err := src.list(ctx, selector)
+				if err != nil {
+					return nil, fmt.Errorf("failed to list cluster roles aggregated by %s: %v", name, err)
+				}
+
+				for _, a := range aggregated {
+					if visited[a.Name] {
+						continue
+					}
+					visited[a.Name] = true
+					queue = append(queue, a.Name)
+
+					grant := g
+					grant.ClusterRole = a.Name
+					grant.AggregatedBy = g.ClusterRole
+					expanded = append(expanded, grant)
+				}
 			}
 		}
 	}
 
-	return clusterRoles, nil
+	return expanded, nil
+}
+
+// apiClusterRoleSource gets the ClusterRoles from the Kubernetes API
+type apiClusterRoleSource struct {
+	client kubernetes.Interface
+}
+
+func (s *apiClusterRoleSource) get(ctx context.Context, name string) (*rbacv1.ClusterRole, error) {
+	ctx, done := startRequest(ctx, "get_clusterrole", attribute.String("k8s.clusterrole.name", name))
+	cr, err := s.client.RbacV1().ClusterRoles().Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		done(nil)
+		return nil, nil
+	}
+	done(err)
+	return cr, err
+}
+
+func (s *apiClusterRoleSource) list(ctx context.Context, selector labels.Selector) ([]*rbacv1.ClusterRole, error) {
+	ctx, done := startRequest(ctx, "list_clusterroles", attribute.String("k8s.label_selector", selector.String()))
+	list, err := s.client.RbacV1().ClusterRoles().List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make([]*rbacv1.ClusterRole, 0, len(list.Items))
+	for i := range list.Items {
+		roles = append(roles, &list.Items[i])
+	}
+	return roles, nil
 }
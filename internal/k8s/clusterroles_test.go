@@ -5,17 +5,23 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
 
 	"github.com/mirantiscontainers/dex-http-server/internal/k8s"
+	"github.com/mirantiscontainers/dex-http-server/internal/tracing"
 )
 
 func TestGetClusterRoles(t *testing.T) {
 	tests := []struct {
 		name                string
 		serviceAccountName  string
+		groups              []string
 		clusterRoleBindings []rbacv1.ClusterRoleBinding
 		expectedRoles       []string
 		expectError         bool
@@ -94,6 +100,68 @@ func TestGetClusterRoles(t *testing.T) {
 			expectedRoles: []string{"role1", "role2"},
 			expectError:   false,
 		},
+		{
+			name:               "Cluster role through a group",
+			serviceAccountName: "jane@example.com",
+			groups:             []string{"oidc:admins", "oidc:developers"},
+			clusterRoleBindings: []rbacv1.ClusterRoleBinding{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "binding1"},
+					Subjects: []rbacv1.Subject{
+						{Kind: rbacv1.GroupKind, Name: "oidc:admins"},
+					},
+					RoleRef: rbacv1.RoleRef{Name: "cluster-admin"},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "binding2"},
+					Subjects: []rbacv1.Subject{
+						{Kind: rbacv1.GroupKind, Name: "admins"},
+					},
+					RoleRef: rbacv1.RoleRef{Name: "unprefixed-role"},
+				},
+			},
+			expectedRoles: []string{"cluster-admin"},
+			expectError:   false,
+		},
+		{
+			name:               "Cluster roles through user and groups",
+			serviceAccountName: "jane@example.com",
+			groups:             []string{"oidc:developers"},
+			clusterRoleBindings: []rbacv1.ClusterRoleBinding{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "binding1"},
+					Subjects: []rbacv1.Subject{
+						{Kind: rbacv1.UserKind, Name: "jane@example.com"},
+						{Kind: rbacv1.GroupKind, Name: "oidc:developers"},
+					},
+					RoleRef: rbacv1.RoleRef{Name: "edit"},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "binding2"},
+					Subjects: []rbacv1.Subject{
+						{Kind: rbacv1.GroupKind, Name: "oidc:developers"},
+					},
+					RoleRef: rbacv1.RoleRef{Name: "view"},
+				},
+			},
+			expectedRoles: []string{"edit", "view"},
+			expectError:   false,
+		},
+		{
+			name:               "Group subject does not match user name",
+			serviceAccountName: "admins",
+			clusterRoleBindings: []rbacv1.ClusterRoleBinding{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "binding1"},
+					Subjects: []rbacv1.Subject{
+						{Kind: rbacv1.GroupKind, Name: "admins"},
+					},
+					RoleRef: rbacv1.RoleRef{Name: "cluster-admin"},
+				},
+			},
+			expectedRoles: []string{},
+			expectError:   false,
+		},
 		{
 			name:                "NoClusterRoleBindings",
 			serviceAccountName:  "test-sa",
@@ -109,7 +177,7 @@ func TestGetClusterRoles(t *testing.T) {
 				Items: tt.clusterRoleBindings,
 			})
 
-			roles, err := k8s.GetClusterRoles(context.TODO(), clientset, tt.serviceAccountName)
+			roles, err := k8s.GetClusterRoles(context.TODO(), clientset, tt.serviceAccountName, tt.groups)
 			if tt.expectError {
 				assert.Error(t, err)
 			} else {
@@ -119,3 +187,149 @@ func TestGetClusterRoles(t *testing.T) {
 		})
 	}
 }
+
+// newRBACClientset returns a clientset with ClusterRoleBindings, RoleBindings and aggregated ClusterRoles
+func newRBACClientset() *fake.Clientset {
+	return fake.NewClientset(
+		&rbacv1.ClusterRoleBindingList{
+			Items: []rbacv1.ClusterRoleBinding{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "admins"},
+					Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "admins"}},
+					RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "dex-admin"},
+				},
+			},
+		},
+		&rbacv1.RoleBindingList{
+			Items: []rbacv1.RoleBinding{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "helpdesk", Namespace: "mke"},
+					Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "jane@example.com"}},
+					RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "dex-helpdesk"},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "namespaced-role", Namespace: "mke"},
+					Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "jane@example.com"}},
+					RoleRef:    rbacv1.RoleRef{Kind: "Role", Name: "dex-admin"},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "other-namespace", Namespace: "dev"},
+					Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "jane@example.com"}},
+					RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "dex-admin"},
+				},
+			},
+		},
+		&rbacv1.ClusterRoleList{
+			Items: []rbacv1.ClusterRole{
+				{
+					// dex-admin aggregates dex-helpdesk, which aggregates dex-viewer
+					ObjectMeta: metav1.ObjectMeta{Name: "dex-admin"},
+					AggregationRule: &rbacv1.AggregationRule{
+						ClusterRoleSelectors: []metav1.LabelSelector{
+							{MatchLabels: map[string]string{"dex.mirantis.com/aggregate-to-admin": "true"}},
+						},
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:   "dex-helpdesk",
+						Labels: map[string]string{"dex.mirantis.com/aggregate-to-admin": "true"},
+					},
+					AggregationRule: &rbacv1.AggregationRule{
+						ClusterRoleSelectors: []metav1.LabelSelector{
+							{MatchLabels: map[string]string{"dex.mirantis.com/aggregate-to-helpdesk": "true"}},
+						},
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: "dex-viewer",
+						// aggregating itself back into admin must not loop
+						Labels: map[string]string{
+							"dex.mirantis.com/aggregate-to-helpdesk": "true",
+							"dex.mirantis.com/aggregate-to-admin":    "true",
+						},
+					},
+				},
+			},
+		},
+	)
+}
+
+// resolveRolesTests are run against both the api lister and the cache
+var resolveRolesTests = []struct {
+	name           string
+	user           string
+	groups         []string
+	expectedGrants []k8s.RoleGrant
+}{
+	{
+		name:   "aggregated cluster roles through a cluster role binding",
+		user:   "john@example.com",
+		groups: []string{"admins"},
+		expectedGrants: []k8s.RoleGrant{
+			{ClusterRole: "dex-admin", BindingKind: "ClusterRoleBinding", BindingName: "admins", Subject: rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "admins"}},
+			{ClusterRole: "dex-helpdesk", AggregatedBy: "dex-admin", BindingKind: "ClusterRoleBinding", BindingName: "admins", Subject: rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "admins"}},
+			{ClusterRole: "dex-viewer", AggregatedBy: "dex-admin", BindingKind: "ClusterRoleBinding", BindingName: "admins", Subject: rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "admins"}},
+		},
+	},
+	{
+		name: "role binding in an admin namespace",
+		user: "jane@example.com",
+		expectedGrants: []k8s.RoleGrant{
+			{ClusterRole: "dex-helpdesk", BindingKind: "RoleBinding", BindingName: "helpdesk", BindingNamespace: "mke", Subject: rbacv1.Subject{Kind: rbacv1.UserKind, Name: "jane@example.com"}},
+			{ClusterRole: "dex-viewer", AggregatedBy: "dex-helpdesk", BindingKind: "RoleBinding", BindingName: "helpdesk", BindingNamespace: "mke", Subject: rbacv1.Subject{Kind: rbacv1.UserKind, Name: "jane@example.com"}},
+		},
+	},
+	{
+		name:           "no bindings",
+		user:           "john@example.com",
+		groups:         []string{"developers"},
+		expectedGrants: nil,
+	},
+}
+
+func TestResolveRoles(t *testing.T) {
+	clientset := newRBACClientset()
+	opts := k8s.ResolverOptions{AdminNamespaces: []string{"mke"}}
+
+	for _, tt := range resolveRolesTests {
+		t.Run(tt.name, func(t *testing.T) {
+			grants, err := k8s.ResolveRoles(context.TODO(), clientset, tt.user, tt.groups, opts)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tt.expectedGrants, grants)
+		})
+	}
+}
+
+func TestResolveRolesSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	ctx, parent := tracing.Start(context.Background(), "authorization")
+	_, err := k8s.ResolveRoles(ctx, newRBACClientset(), "jane@example.com", nil, k8s.ResolverOptions{AdminNamespaces: []string{"mke"}})
+	require.NoError(t, err)
+	parent.End()
+
+	// the spans of the api calls are children of the span of the context
+	var names []string
+	for _, span := range exporter.GetSpans() {
+		if span.Name != "authorization" {
+			names = append(names, span.Name)
+			assert.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+		}
+	}
+	assert.Equal(t, []string{"k8s.list_clusterrolebindings", "k8s.list_rolebindings", "k8s.get_clusterrole", "k8s.list_clusterroles", "k8s.get_clusterrole"}, names)
+}
+
+func TestRoleGrantString(t *testing.T) {
+	g := k8s.RoleGrant{
+		ClusterRole:      "dex-viewer",
+		AggregatedBy:     "dex-helpdesk",
+		BindingKind:      "RoleBinding",
+		BindingName:      "helpdesk",
+		BindingNamespace: "mke",
+		Subject:          rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "helpdesk"},
+	}
+	assert.Equal(t, "ClusterRole dex-viewer (aggregated by dex-helpdesk) through RoleBinding mke/helpdesk for Group helpdesk", g.String())
+}
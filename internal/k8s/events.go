@@ -0,0 +1,164 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/audit"
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
+)
+
+const (
+	// eventComponent is the source component of the Events
+	eventComponent = "dex-http-server"
+
+	// serviceAccountNamespaceFile is the file of the namespace of the pod, mounted with the service account token
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// Reasons of the Events of the user lifecycle changes
+const (
+	ReasonUserCreated       = "UserCreated"
+	ReasonUserUpdated       = "UserUpdated"
+	ReasonUserPasswordReset = "UserPasswordReset"
+	ReasonUserDeleted       = "UserDeleted"
+)
+
+// Annotations of the Events of the user lifecycle changes
+const (
+	AnnotationActor     = "dex.mirantis.com/actor"
+	AnnotationTarget    = "dex.mirantis.com/target"
+	AnnotationRequestID = "dex.mirantis.com/request-id"
+)
+
+// EventSink is an audit sink recording a Kubernetes Event against an object, like the Deployment
+// of the server, for each user successfully created, updated or deleted
+type EventSink struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	object      runtime.Object
+}
+
+// NewEventSink returns a sink recording the Events against the object, described as kind/name,
+// e.g. deployment/dex-http-server or configmap/dex-users, in the namespace.
+// Only Deployments and ConfigMaps are supported. The object is looked up once, for its UID
+func NewEventSink(ctx context.Context, client kubernetes.Interface, namespace, object string) (*EventSink, error) {
+	obj, err := getEventObject(ctx, client, namespace, object)
+	if err != nil {
+		return nil, err
+	}
+
+	broadcaster := record.NewBroadcaster(record.WithContext(ctx))
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events(namespace)})
+
+	return &EventSink{
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent}),
+		object:      obj,
+	}, nil
+}
+
+// getEventObject gets the object the Events are recorded against
+func getEventObject(ctx context.Context, client kubernetes.Interface, namespace, object string) (runtime.Object, error) {
+	kind, name, ok := strings.Cut(object, "/")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid events object %q, must be deployment/<name> or configmap/<name>", object)
+	}
+
+	var obj runtime.Object
+	var err error
+	switch strings.ToLower(kind) {
+	case "deployment", "deployments", "deploy":
+		obj, err = client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "configmap", "configmaps", "cm":
+		obj, err = client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	default:
+		return nil, fmt.Errorf("unsupported events object kind %q, must be deployment or configmap", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get events object %s in namespace %s: %w", object, namespace, err)
+	}
+
+	// the typed objects returned by the clientset have no kind, the reference gets it from the scheme
+	if _, err := reference.GetReference(scheme.Scheme, obj); err != nil {
+		return nil, fmt.Errorf("failed to get reference of events object %s: %w", object, err)
+	}
+	return obj, nil
+}
+
+// Emit records the Event of the audit event, when the user was successfully created, updated or deleted
+func (s *EventSink) Emit(_ context.Context, e *audit.Event) error {
+	if e.Outcome != audit.OutcomeSuccess {
+		return nil
+	}
+
+	reason, action := eventReason(e)
+	if reason == "" {
+		return nil
+	}
+
+	actor := e.Actor.Email
+	if len(e.Actor.Groups) > 0 {
+		actor = fmt.Sprintf("%s (groups %s)", e.Actor.Email, strings.Join(e.Actor.Groups, ", "))
+	}
+
+	annotations := map[string]string{
+		AnnotationActor:     e.Actor.Email,
+		AnnotationTarget:    e.Target,
+		AnnotationRequestID: e.RequestID,
+	}
+	s.recorder.AnnotatedEventf(s.object, annotations, corev1.EventTypeNormal, reason, "User %s %s by %s", e.Target, action, actor)
+	metrics.AuditEvents.WithLabelValues("kubernetes", metrics.Result(nil)).Inc()
+	return nil
+}
+
+// eventReason returns the reason of the Event of the operation, and the action in the message
+// An update of the password is a password reset, even when the name is updated too
+func eventReason(e *audit.Event) (string, string) {
+	switch e.Operation {
+	case "CreateUser":
+		return ReasonUserCreated, "created"
+	case "UpdateUser":
+		for _, c := range e.Changes {
+			if c == "password" {
+				return ReasonUserPasswordReset, "had their password reset"
+			}
+		}
+		return ReasonUserUpdated, "updated"
+	case "DeleteUser":
+		return ReasonUserDeleted, "deleted"
+	default:
+		return "", ""
+	}
+}
+
+// Close stops recording the Events
+func (s *EventSink) Close() error {
+	s.broadcaster.Shutdown()
+	return nil
+}
+
+// CurrentNamespace returns the namespace of the pod, from the POD_NAMESPACE environment variable
+// or the namespace file of the service account
+func CurrentNamespace() (string, error) {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns, nil
+	}
+
+	b, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the namespace of the pod: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
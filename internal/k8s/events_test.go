@@ -0,0 +1,111 @@
+package k8s_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/audit"
+	"github.com/mirantiscontainers/dex-http-server/internal/k8s"
+)
+
+func TestNewEventSink(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "dex-http-server", Namespace: "mke"}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "dex-users", Namespace: "mke"}},
+	)
+
+	tests := []struct {
+		name    string
+		object  string
+		wantErr bool
+	}{
+		{name: "deployment", object: "deployment/dex-http-server"},
+		{name: "configmap", object: "configmap/dex-users"},
+		{name: "missing object", object: "configmap/missing", wantErr: true},
+		{name: "unsupported kind", object: "secret/dex-users", wantErr: true},
+		{name: "invalid object", object: "dex-http-server", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := k8s.NewEventSink(context.Background(), clientset, "mke", tt.object)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.NoError(t, sink.Close())
+		})
+	}
+}
+
+func TestEventSink(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "dex-http-server", Namespace: "mke", UID: types.UID("7c1f0a4e")},
+	})
+
+	sink, err := k8s.NewEventSink(context.Background(), clientset, "mke", "deployment/dex-http-server")
+	require.NoError(t, err)
+	defer sink.Close()
+
+	actor := audit.Actor{Email: "admin@example.com", Groups: []string{"admins"}}
+	events := []*audit.Event{
+		{RequestID: "request-1", Actor: actor, Operation: "CreateUser", Target: "jane@example.com", Outcome: audit.OutcomeSuccess},
+		{RequestID: "request-2", Actor: actor, Operation: "UpdateUser", Target: "jane@example.com", Changes: []string{"name"}, Outcome: audit.OutcomeSuccess},
+		{RequestID: "request-3", Actor: actor, Operation: "UpdateUser", Target: "jane@example.com", Changes: []string{"name", "password"}, Outcome: audit.OutcomeSuccess},
+		{RequestID: "request-4", Actor: actor, Operation: "DeleteUser", Target: "jane@example.com", Outcome: audit.OutcomeSuccess},
+
+		// only the changes applied by Dex are recorded
+		{RequestID: "request-5", Actor: actor, Operation: "DeleteUser", Target: "jack@example.com", Outcome: audit.OutcomeNotFound},
+		{RequestID: "request-6", Actor: actor, Operation: "CreateUser", Target: "jack@example.com", Outcome: audit.OutcomeDenied},
+	}
+	for _, e := range events {
+		require.NoError(t, sink.Emit(context.Background(), e))
+	}
+
+	// the events are recorded in the background
+	var recorded []corev1.Event
+	assert.Eventually(t, func() bool {
+		list, err := clientset.CoreV1().Events("mke").List(context.Background(), metav1.ListOptions{})
+		require.NoError(t, err)
+		recorded = list.Items
+		return len(recorded) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	wantEvents := map[string]struct {
+		reason  string
+		message string
+	}{
+		"request-1": {reason: k8s.ReasonUserCreated, message: "User jane@example.com created by admin@example.com (groups admins)"},
+		"request-2": {reason: k8s.ReasonUserUpdated, message: "User jane@example.com updated by admin@example.com (groups admins)"},
+		"request-3": {reason: k8s.ReasonUserPasswordReset, message: "User jane@example.com had their password reset by admin@example.com (groups admins)"},
+		"request-4": {reason: k8s.ReasonUserDeleted, message: "User jane@example.com deleted by admin@example.com (groups admins)"},
+	}
+	for _, e := range recorded {
+		want, ok := wantEvents[e.Annotations[k8s.AnnotationRequestID]]
+		require.True(t, ok, "unexpected event %s", e.Message)
+
+		assert.Equal(t, corev1.EventTypeNormal, e.Type)
+		assert.Equal(t, want.reason, e.Reason)
+		assert.Equal(t, want.message, e.Message)
+		assert.Equal(t, "admin@example.com", e.Annotations[k8s.AnnotationActor])
+		assert.Equal(t, "jane@example.com", e.Annotations[k8s.AnnotationTarget])
+		assert.Equal(t, "dex-http-server", e.Source.Component)
+		assert.Equal(t, corev1.ObjectReference{
+			Kind:       "Deployment",
+			APIVersion: "apps/v1",
+			Namespace:  "mke",
+			Name:       "dex-http-server",
+			UID:        types.UID("7c1f0a4e"),
+		}, e.InvolvedObject)
+	}
+}
@@ -0,0 +1,8 @@
+package k8s
+
+import "k8s.io/client-go/tools/cache"
+
+// Informers returns the informers of the cache, for the tests to add event handlers
+func (c *RoleCache) Informers() []cache.SharedIndexInformer {
+	return c.informers
+}
@@ -0,0 +1,24 @@
+package k8s
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
+	"github.com/mirantiscontainers/dex-http-server/internal/tracing"
+)
+
+// startRequest starts the span of a Kubernetes API call, and returns the func ending it
+// and recording the latency of the call
+func startRequest(ctx context.Context, call string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "k8s."+call)
+	span.SetAttributes(attrs...)
+
+	return ctx, func(err error) {
+		metrics.ObserveKubeRequest(call, start, err)
+		tracing.End(span, err)
+	}
+}
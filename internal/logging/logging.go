@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// FormatJSON writes the logs as JSON objects, one per line
+	FormatJSON = "json"
+
+	// FormatConsole writes the logs as colored human-readable lines
+	FormatConsole = "console"
+)
+
+// Setup configures the global logger, with the level (trace, debug, info, warn or error) and the
+// format (json or console). The global logger is also the logger of the contexts without a
+// request-scoped logger
+func Setup(level, format string) error {
+	return setup(level, format, os.Stderr)
+}
+
+func setup(level, format string, out io.Writer) error {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil || lvl == zerolog.NoLevel {
+		return fmt.Errorf("invalid log level %q, must be one of trace, debug, info, warn or error", level)
+	}
+
+	switch format {
+	case FormatJSON:
+	case FormatConsole:
+		out = zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339}
+	default:
+		return fmt.Errorf("invalid log format %q, must be %s or %s", format, FormatJSON, FormatConsole)
+	}
+
+	zerolog.SetGlobalLevel(lvl)
+	log.Logger = zerolog.New(out).With().Timestamp().Logger()
+	zerolog.DefaultContextLogger = &log.Logger
+	return nil
+}
@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetup(t *testing.T) {
+	defer zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	defer func(l zerolog.Logger) { log.Logger = l }(log.Logger)
+
+	tests := []struct {
+		name       string
+		level      string
+		format     string
+		wantErr    bool
+		wantOutput string
+	}{
+		{name: "json", level: "info", format: "json", wantOutput: `"message":"shown"`},
+		{name: "console", level: "info", format: "console", wantOutput: "INF"},
+		{name: "invalid level", level: "verbose", format: "json", wantErr: true},
+		{name: "invalid format", level: "info", format: "logfmt", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := setup(tt.level, tt.format, &out)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			log.Debug().Msg("hidden")
+			// the contexts without a request-scoped logger use the global logger
+			log.Ctx(context.Background()).Info().Msg("shown")
+
+			assert.NotContains(t, out.String(), "hidden")
+			assert.Contains(t, out.String(), tt.wantOutput)
+		})
+	}
+}
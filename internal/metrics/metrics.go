@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// namespace is the prefix of the metrics names
+const namespace = "dex_http_server"
+
+// Path is the path of the metrics endpoint
+const Path = "/metrics"
+
+var (
+	// CertReloads counts the reloads of the certificates directories, by certs name and result
+	CertReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cert_reloads_total",
+		Help:      "Number of reloads of the certificates directories, by certs name and result (success or failure).",
+	}, []string{"name", "result"})
+
+	// CertExpiry is the expiry time of the certificates in use, by certs name
+	CertExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cert_expiry_timestamp_seconds",
+		Help:      "Expiry time of the certificates in use, by certs name, in seconds since the epoch.",
+	}, []string{"name"})
+
+	// HTTPRequests counts the API requests, by gateway pattern, method and status code
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of API requests, by gateway pattern, method and status code.",
+	}, []string{"pattern", "method", "code"})
+
+	// HTTPRequestDuration is the latency of the API requests, by gateway pattern and method
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the API requests, by gateway pattern and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"pattern", "method"})
+
+	// Authentications counts the authentications of the requests, by result and reason of the failures
+	Authentications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authentications_total",
+		Help:      "Number of authentications of the API requests, by result (success or failure) and reason of the failures.",
+	}, []string{"result", "reason"})
+
+	// Authorizations counts the authorizations of the requests, by operation, result and reason
+	Authorizations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authorizations_total",
+		Help:      "Number of authorizations of the API requests, by operation, result (allowed, denied or error) and reason.",
+	}, []string{"operation", "result", "reason"})
+
+	// ValidationRejections counts the requests rejected by the validation, by field
+	ValidationRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "validation_rejections_total",
+		Help:      "Number of API requests rejected by the validation, by invalid field.",
+	}, []string{"field"})
+
+	// BcryptDuration is the duration of the bcrypt hashing of the passwords
+	BcryptDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bcrypt_duration_seconds",
+		Help:      "Duration of the bcrypt hashing of the passwords.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+	})
+
+	// GRPCClientRequests counts the gRPC calls to Dex, by method and status code
+	GRPCClientRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "grpc_client_requests_total",
+		Help:      "Number of gRPC calls to Dex, by method and status code.",
+	}, []string{"method", "code"})
+
+	// GRPCClientRequestDuration is the latency of the gRPC calls to Dex, by method
+	GRPCClientRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "grpc_client_request_duration_seconds",
+		Help:      "Latency of the gRPC calls to Dex, by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	// KubeRequestDuration is the latency of the Kubernetes API calls of the authorizer, by call and result
+	KubeRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "kube_request_duration_seconds",
+		Help:      "Latency of the Kubernetes API calls of the authorizer, by call and result (success or failure).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"call", "result"})
+
+	// AuditEvents counts the audit events written by the sinks, by sink and result
+	AuditEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_events_total",
+		Help:      "Number of audit events written by the sinks, by sink and result (success, failure or dropped).",
+	}, []string{"sink", "result"})
+)
+
+// Handler returns the handler of the metrics endpoint
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Result returns the result label of an operation, success or failure
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// ObserveKubeRequest records the latency of a Kubernetes API call started at start
+func ObserveKubeRequest(call string, start time.Time, err error) {
+	KubeRequestDuration.WithLabelValues(call, Result(err)).Observe(time.Since(start).Seconds())
+}
+
+// UnaryClientInterceptor records the latency and the status codes of the gRPC calls
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+
+		GRPCClientRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		GRPCClientRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+		return err
+	}
+}
@@ -0,0 +1,34 @@
+package metrics_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
+)
+
+func TestUnaryClientInterceptor(t *testing.T) {
+	interceptor := metrics.UnaryClientInterceptor()
+	method := "/api.Dex/CreatePassword"
+
+	invoke := func(err error) error {
+		return interceptor(context.Background(), method, nil, nil, nil,
+			func(context.Context, string, any, any, *grpc.ClientConn, ...grpc.CallOption) error {
+				return err
+			})
+	}
+
+	assert.NoError(t, invoke(nil))
+	err := invoke(status.Error(codes.Unavailable, "connection refused"))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.GRPCClientRequests.WithLabelValues(method, "OK")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.GRPCClientRequests.WithLabelValues(method, "Unavailable")))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.GRPCClientRequestDuration))
+}
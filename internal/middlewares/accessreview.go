@@ -0,0 +1,60 @@
+package middlewares
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+	authorizationv1 "k8s.io/api/authorization/v1"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/k8s"
+)
+
+// accessReviewAttributes maps the operations to the verb and resource checked with a SubjectAccessReview
+// The resources are virtual resources of the k8s.ResourceGroup API group, so that the access can
+// be granted with plain RBAC rules, for example:
+//
+//	rules:
+//	  - apiGroups: ["dex.mirantis.com"]
+//	    resources: ["users"]
+//	    verbs: ["list", "update"]
+var accessReviewAttributes = map[requestName]authorizationv1.ResourceAttributes{
+	requestCreateUser:     {Verb: "create", Resource: "users"},
+	requestUpdateUser:     {Verb: "update", Resource: "users"},
+	requestDeleteUser:     {Verb: "delete", Resource: "users"},
+	requestGetUser:        {Verb: "get", Resource: "users"},
+	requestListUsers:      {Verb: "list", Resource: "users"},
+	requestImportUsers:    {Verb: "import", Resource: "users"},
+	requestExportUsers:    {Verb: "export", Resource: "users"},
+	requestBackupUsers:    {Verb: "backup", Resource: "users"},
+	requestVerifyPassword: {Verb: "verify", Resource: "users"},
+
+	requestCreateClient: {Verb: "create", Resource: "clients"},
+	requestUpdateClient: {Verb: "update", Resource: "clients"},
+	requestDeleteClient: {Verb: "delete", Resource: "clients"},
+
+	requestListSessions:  {Verb: "list", Resource: "users", Subresource: "sessions"},
+	requestRevokeSession: {Verb: "delete", Resource: "users", Subresource: "sessions"},
+}
+
+// authorizeWithAccessReview checks with a SubjectAccessReview if the user is allowed to perform the operation.
+// It also returns the reason of the decision, reported in the metrics
+func authorizeWithAccessReview(ctx context.Context, u *user, op requestName) (bool, string, error) {
+	attrs, ok := accessReviewAttributes[op]
+	if !ok {
+		log.Ctx(ctx).Debug().Msgf("No access review attributes for operation %q, denying request", op)
+		return false, "unknown_operation", nil
+	}
+	attrs.Group = k8s.ResourceGroup
+
+	log.Ctx(ctx).Debug().Msgf("Authorizing %s request for user %s with a SubjectAccessReview: verb=%s resource=%s subresource=%s", op, u.email, attrs.Verb, attrs.Resource, attrs.Subresource)
+	allowed, reason, err := k8s.CheckAccess(ctx, kubeClient, u.email, u.groups, &attrs)
+	if err != nil {
+		return false, "access_review_failed", err
+	}
+
+	log.Ctx(ctx).Debug().Msgf("SubjectAccessReview for %s by user %s: allowed=%v reason=%q", op, u.email, allowed, reason)
+	if !allowed {
+		return false, "access_review_denied", nil
+	}
+	return true, "access_review_allowed", nil
+}
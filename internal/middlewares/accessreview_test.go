@@ -0,0 +1,65 @@
+package middlewares
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_authorizeWithAccessReview(t *testing.T) {
+	var reviewed []authorizationv1.ResourceAttributes
+
+	clientset := fake.NewClientset()
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		sar := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviewed = append(reviewed, *sar.Spec.ResourceAttributes)
+
+		// the helpdesk group can only list users and reset passwords
+		attrs := sar.Spec.ResourceAttributes
+		sar.Status.Allowed = attrs.Resource == "users" && attrs.Subresource == "" && (attrs.Verb == "list" || attrs.Verb == "update")
+		return true, sar, nil
+	})
+	kubeClient = clientset
+	authzMode = AuthzModeSubjectAccessReview
+	defer func() { authzMode = AuthzModePolicy }()
+
+	tests := []struct {
+		op       requestName
+		allowed  bool
+		wantAttr authorizationv1.ResourceAttributes
+	}{
+		{op: requestListUsers, allowed: true, wantAttr: authorizationv1.ResourceAttributes{Group: "dex.mirantis.com", Resource: "users", Verb: "list"}},
+		{op: requestUpdateUser, allowed: true, wantAttr: authorizationv1.ResourceAttributes{Group: "dex.mirantis.com", Resource: "users", Verb: "update"}},
+		{op: requestDeleteUser, allowed: false, wantAttr: authorizationv1.ResourceAttributes{Group: "dex.mirantis.com", Resource: "users", Verb: "delete"}},
+		{op: requestRevokeSession, allowed: false, wantAttr: authorizationv1.ResourceAttributes{Group: "dex.mirantis.com", Resource: "users", Subresource: "sessions", Verb: "delete"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.op), func(t *testing.T) {
+			reviewed = nil
+
+			allowed, err := authorize(context.Background(), &user{email: "jane@example.com", groups: []string{"helpdesk"}}, tt.op)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.allowed, allowed)
+			assert.Equal(t, []authorizationv1.ResourceAttributes{tt.wantAttr}, reviewed)
+		})
+	}
+
+	// every operation must be mapped to a verb and resource, otherwise it is always denied
+	for _, op := range knownRequestNames {
+		_, ok := accessReviewAttributes[op]
+		assert.True(t, ok, "operation %s has no access review attributes", op)
+	}
+
+	// unknown operations are denied without asking the kubernetes api
+	reviewed = nil
+	allowed, err := authorize(context.Background(), &user{email: "jane@example.com"}, "")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Empty(t, reviewed)
+}
@@ -0,0 +1,179 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/audit"
+)
+
+// auditSink is the sink of the audit events, the events are not recorded when it is nil
+var auditSink audit.Sink
+
+// auditMaxBodyBytes is the maximum size of the bodies of the audited requests, read before the validation
+const auditMaxBodyBytes = importMaxBytes
+
+// auditEventKey is the key used to store the pending audit event in the request context
+type auditEventKey struct{}
+
+// auditedRequests are the user-management mutations, recorded in the audit events
+var auditedRequests = []requestName{
+	requestCreateUser,
+	requestUpdateUser,
+	requestDeleteUser,
+}
+
+// auditMiddleware records an audit event for each user-management mutation, once the response is written.
+// It is applied after the authentication, for the actor, and before the authorization, so that the
+// denied requests are recorded too. The outcome reported by Dex is set by auditResponse
+func auditMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		name := getRequestName(r)
+		if auditSink == nil || !slices.Contains(auditedRequests, name) {
+			next(w, r, pathParams)
+			return
+		}
+
+		e, err := newAuditEvent(w, r, name, pathParams)
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		if err != nil {
+			// the bodies too large to be audited are rejected, and recorded as invalid
+			rejectInvalidRequest(rec, r, err)
+		} else {
+			next(rec, r.WithContext(context.WithValue(r.Context(), auditEventKey{}, e)), pathParams)
+		}
+
+		e.Status = rec.status
+		if e.Outcome == "" {
+			e.Outcome = outcomeFromStatus(rec.status)
+		}
+
+		if err := auditSink.Emit(r.Context(), e); err != nil {
+			log.Ctx(r.Context()).Err(err).Msgf("failed to record audit event of request %s", e.RequestID)
+		}
+	}
+}
+
+// auditResponse sets the outcome reported by Dex in the pending audit event of the request
+// It is a forward response option of the gateway, called with the Dex response before it is written
+func auditResponse(ctx context.Context, _ http.ResponseWriter, m proto.Message) error {
+	e, ok := ctx.Value(auditEventKey{}).(*audit.Event)
+	if !ok {
+		return nil
+	}
+
+	e.Outcome = audit.OutcomeSuccess
+	switch resp := m.(type) {
+	case *api.CreatePasswordResp:
+		if resp.AlreadyExists {
+			e.Outcome = audit.OutcomeAlreadyExists
+		}
+	case *api.UpdatePasswordResp:
+		if resp.NotFound {
+			e.Outcome = audit.OutcomeNotFound
+		}
+	case *api.DeletePasswordResp:
+		if resp.NotFound {
+			e.Outcome = audit.OutcomeNotFound
+		}
+	}
+	return nil
+}
+
+// newAuditEvent returns the audit event of the request, without the outcome
+// The body of the request is read to get the target and the changes, and put back for the next handlers.
+// It returns an error when the body is larger than auditMaxBodyBytes, along with the event
+func newAuditEvent(w http.ResponseWriter, r *http.Request, name requestName, pathParams map[string]string) (*audit.Event, error) {
+	e := newRequestAuditEvent(r, name)
+	e.Target = strings.TrimSpace(pathParams["email"])
+
+	// the invalid bodies are rejected by the validation, so the other errors are ignored here
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, auditMaxBodyBytes))
+	_ = r.Body.Close()
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return e, &fieldError{field: "body", rule: ruleMaxLength, err: fmt.Errorf("request body too large, must be at most %d bytes", mbe.Limit)}
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to read request body while auditing request")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	switch name {
+	case requestCreateUser:
+		var p api.Password
+		if err := marshaler.Unmarshal(body, &p); err == nil {
+			e.Target = strings.TrimSpace(p.Email)
+			e.Changes = []string{"username", "password"}
+			if strings.TrimSpace(p.Username) != "" {
+				e.Changes = append(e.Changes, "name")
+			}
+		}
+	case requestUpdateUser:
+		var req api.UpdatePasswordReq
+		if err := marshaler.Unmarshal(body, &req); err == nil {
+			if strings.TrimSpace(req.NewUsername) != "" {
+				e.Changes = append(e.Changes, "name")
+			}
+			if len(req.NewHash) > 0 {
+				e.Changes = append(e.Changes, "password")
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// newRequestAuditEvent returns the audit event of the operation of the request, without the target,
+// the changes and the outcome
+func newRequestAuditEvent(r *http.Request, name requestName) *audit.Event {
+	e := &audit.Event{
+		Time:         time.Now().UTC(),
+		RequestID:    requestID(r.Context()),
+		Operation:    string(name),
+		SourceIP:     sourceIP(r),
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		UserAgent:    r.UserAgent(),
+	}
+
+	if u, ok := r.Context().Value(userInfoKey{}).(*user); ok {
+		e.Actor = audit.Actor{Email: u.email, Groups: u.groups}
+	}
+	return e
+}
+
+// outcomeFromStatus returns the outcome of the requests that did not get a response from Dex
+func outcomeFromStatus(status int) audit.Outcome {
+	switch {
+	case status == http.StatusForbidden:
+		return audit.OutcomeDenied
+	case status == http.StatusBadRequest:
+		return audit.OutcomeInvalid
+	case status >= http.StatusBadRequest:
+		return audit.OutcomeError
+	default:
+		return audit.OutcomeSuccess
+	}
+}
+
+// sourceIP returns the IP address of the client of the connection
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
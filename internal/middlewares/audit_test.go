@@ -0,0 +1,323 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/audit"
+)
+
+// recordingSink records the emitted audit events
+type recordingSink struct {
+	events []*audit.Event
+}
+
+func (s *recordingSink) Emit(_ context.Context, e *audit.Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func Test_auditMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		pattern       string
+		target        string
+		body          string
+		pathParams    map[string]string
+		status        int
+		resp          proto.Message
+		wantAudited   bool
+		wantOperation string
+		wantTarget    string
+		wantChanges   []string
+		wantOutcome   audit.Outcome
+	}{
+		{
+			name:          "create user",
+			method:        http.MethodPost,
+			pattern:       "/v1/users",
+			target:        "/v1/users",
+			body:          `{"email": "jane@example.com", "hash": "cGFzc3dvcmQxMjM=", "username": "Jane"}`,
+			status:        http.StatusOK,
+			resp:          &api.CreatePasswordResp{},
+			wantAudited:   true,
+			wantOperation: "CreateUser",
+			wantTarget:    "jane@example.com",
+			wantChanges:   []string{"username", "password", "name"},
+			wantOutcome:   audit.OutcomeSuccess,
+		},
+		{
+			name:          "create existing user",
+			method:        http.MethodPost,
+			pattern:       "/v1/users",
+			target:        "/v1/users",
+			body:          `{"email": "jane@example.com", "hash": "cGFzc3dvcmQxMjM="}`,
+			status:        http.StatusOK,
+			resp:          &api.CreatePasswordResp{AlreadyExists: true},
+			wantAudited:   true,
+			wantOperation: "CreateUser",
+			wantTarget:    "jane@example.com",
+			wantChanges:   []string{"username", "password"},
+			wantOutcome:   audit.OutcomeAlreadyExists,
+		},
+		{
+			name:          "reset password",
+			method:        http.MethodPut,
+			pattern:       "/v1/users/{email=*}",
+			target:        "/v1/users/jane@example.com",
+			body:          `{"new_hash": "cGFzc3dvcmQxMjM="}`,
+			pathParams:    map[string]string{"email": "jane@example.com"},
+			status:        http.StatusOK,
+			resp:          &api.UpdatePasswordResp{},
+			wantAudited:   true,
+			wantOperation: "UpdateUser",
+			wantTarget:    "jane@example.com",
+			wantChanges:   []string{"password"},
+			wantOutcome:   audit.OutcomeSuccess,
+		},
+		{
+			name:          "delete unknown user",
+			method:        http.MethodDelete,
+			pattern:       "/v1/users/{email=*}",
+			target:        "/v1/users/jack@example.com",
+			pathParams:    map[string]string{"email": "jack@example.com"},
+			status:        http.StatusOK,
+			resp:          &api.DeletePasswordResp{NotFound: true},
+			wantAudited:   true,
+			wantOperation: "DeleteUser",
+			wantTarget:    "jack@example.com",
+			wantOutcome:   audit.OutcomeNotFound,
+		},
+		{
+			name:          "denied deletion",
+			method:        http.MethodDelete,
+			pattern:       "/v1/users/{email=*}",
+			target:        "/v1/users/jane@example.com",
+			pathParams:    map[string]string{"email": "jane@example.com"},
+			status:        http.StatusForbidden,
+			wantAudited:   true,
+			wantOperation: "DeleteUser",
+			wantTarget:    "jane@example.com",
+			wantOutcome:   audit.OutcomeDenied,
+		},
+		{
+			name:          "invalid creation",
+			method:        http.MethodPost,
+			pattern:       "/v1/users",
+			target:        "/v1/users",
+			body:          `{"email": "jane@example.com", "hash": "c2hvcnQ="}`,
+			status:        http.StatusBadRequest,
+			wantAudited:   true,
+			wantOperation: "CreateUser",
+			wantTarget:    "jane@example.com",
+			wantChanges:   []string{"username", "password"},
+			wantOutcome:   audit.OutcomeInvalid,
+		},
+		{
+			name:        "list users is not audited",
+			method:      http.MethodGet,
+			pattern:     "/v1/users",
+			target:      "/v1/users",
+			status:      http.StatusOK,
+			resp:        &api.ListPasswordResp{},
+			wantAudited: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			auditSink = sink
+			defer func() { auditSink = nil }()
+			requestPatternGetter = mockedRequestPatternGetter(tt.pattern)
+
+			// the next handler checks that the body is put back, and stands in for the gateway
+			handler := requestIDMiddleware(auditMiddleware(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				assert.Equal(t, tt.body, string(body))
+
+				if tt.resp != nil {
+					require.NoError(t, auditResponse(r.Context(), w, tt.resp))
+				}
+				w.WriteHeader(tt.status)
+			}))
+
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			r.Header.Set("X-Request-Id", "request-1")
+			r.Header.Set("X-Forwarded-For", "203.0.113.7")
+			r = r.WithContext(context.WithValue(r.Context(), userInfoKey{}, &user{email: "admin@example.com", groups: []string{"admins"}}))
+			handler(httptest.NewRecorder(), r, tt.pathParams)
+
+			if !tt.wantAudited {
+				assert.Empty(t, sink.events)
+				return
+			}
+			require.Len(t, sink.events, 1)
+			e := sink.events[0]
+			assert.Equal(t, "request-1", e.RequestID)
+			assert.Equal(t, audit.Actor{Email: "admin@example.com", Groups: []string{"admins"}}, e.Actor)
+			assert.Equal(t, tt.wantOperation, e.Operation)
+			assert.Equal(t, tt.wantTarget, e.Target)
+			assert.Equal(t, tt.wantChanges, e.Changes)
+			assert.Equal(t, tt.wantOutcome, e.Outcome)
+			assert.Equal(t, tt.status, e.Status)
+			assert.Equal(t, "192.0.2.1", e.SourceIP)
+			assert.Equal(t, "203.0.113.7", e.ForwardedFor)
+
+			// the passwords never appear in the events
+			b, err := json.Marshal(e)
+			require.NoError(t, err)
+			assert.NotContains(t, string(b), "cGFzc3dvcmQxMjM=")
+			assert.NotContains(t, string(b), "password123")
+		})
+	}
+}
+
+func Test_auditMiddlewareBodyTooLarge(t *testing.T) {
+	sink := &recordingSink{}
+	auditSink = sink
+	defer func() { auditSink = nil }()
+	requestPatternGetter = mockedRequestPatternGetter("/v1/users/{email=*}")
+
+	handler := auditMiddleware(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		t.Fatal("the request with a body too large must not be forwarded")
+	})
+
+	body := `{"new_username": "` + strings.Repeat("a", auditMaxBodyBytes) + `"}`
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPut, "/v1/users/jane@example.com", strings.NewReader(body)), map[string]string{"email": "jane@example.com"})
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	violation := decodeErrorBody(t, w).Details[0].FieldViolations[0]
+	assert.Equal(t, "body", violation.Field)
+
+	require.Len(t, sink.events, 1)
+	assert.Equal(t, "jane@example.com", sink.events[0].Target)
+	assert.Equal(t, audit.OutcomeInvalid, sink.events[0].Outcome)
+}
+
+func Test_requestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		wantSame bool
+	}{
+		{name: "request id of the client", header: "request-1", wantSame: true},
+		{name: "generated request id", header: ""},
+		{name: "invalid request id", header: "request 1\n"},
+		{name: "too long request id", header: strings.Repeat("a", 129)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var id string
+			handler := requestIDMiddleware(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+				id = requestID(r.Context())
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Request-Id", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r, nil)
+
+			assert.NotEmpty(t, id)
+			assert.Equal(t, id, w.Header().Get("X-Request-Id"))
+			if tt.wantSame {
+				assert.Equal(t, tt.header, id)
+			} else {
+				assert.NotEqual(t, tt.header, id)
+			}
+		})
+	}
+}
+
+func Test_requestLogger(t *testing.T) {
+	requestPatternGetter = mockedRequestPatternGetter("/v1/users/{email=*}")
+
+	var out bytes.Buffer
+	defer func(l zerolog.Logger) { log.Logger = l }(log.Logger)
+	log.Logger = zerolog.New(&out)
+
+	// the authentication sets the actor of the logger, after the access log middleware
+	authenticated := func(next runtime.HandlerFunc) runtime.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+			setLogActor(r.Context(), "admin@example.com")
+			next(w, r, pathParams)
+		}
+	}
+	handler := requestIDMiddleware(loggingMiddleware(authenticated(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		log.Ctx(r.Context()).Error().Msg("failed to update user")
+		http.Error(w, "not found", http.StatusNotFound)
+	})))
+
+	r := httptest.NewRequest(http.MethodPut, "/v1/users/jane@example.com", nil)
+	r.Header.Set("X-Request-Id", "request-1")
+	handler(httptest.NewRecorder(), r, nil)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var handlerLog, accessLog map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &handlerLog))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &accessLog))
+
+	for _, l := range []map[string]any{handlerLog, accessLog} {
+		assert.Equal(t, "request-1", l["request_id"])
+		assert.Equal(t, "PUT", l["method"])
+		assert.Equal(t, "/v1/users/{email=*}", l["route"])
+		assert.Equal(t, "admin@example.com", l["actor"])
+	}
+	assert.Equal(t, "failed to update user", handlerLog["message"])
+
+	assert.Equal(t, "info", accessLog["level"])
+	assert.Equal(t, "/v1/users/jane@example.com", accessLog["path"])
+	assert.Equal(t, float64(http.StatusNotFound), accessLog["status"])
+	assert.Equal(t, float64(len("not found\n")), accessLog["size"])
+	assert.Contains(t, accessLog, "latency")
+
+	// the global logger is not updated by the requests
+	out.Reset()
+	log.Info().Msg("global")
+	assert.NotContains(t, out.String(), "actor")
+}
+
+func TestRequestIDClientInterceptor(t *testing.T) {
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "request-1")
+
+	var md metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	require.NoError(t, RequestIDClientInterceptor()(ctx, "/api.Dex/CreatePassword", nil, nil, nil, invoker))
+	assert.Equal(t, []string{"request-1"}, md.Get("x-request-id"))
+
+	// the calls made outside of a request have no request id
+	md = nil
+	require.NoError(t, RequestIDClientInterceptor()(context.Background(), "/api.Dex/GetVersion", nil, nil, nil, invoker))
+	assert.Empty(t, md.Get("x-request-id"))
+}
@@ -2,21 +2,47 @@ package middlewares
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/coreos/go-oidc"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
 )
 
-const (
-	dexIssuerURL = "http://authentication-dex:5556/dex"
-	dexKeysURL   = "http://authentication-dex:5556/dex/keys"
+// discoveryPath is the path of the OIDC discovery document, relative to the issuer URL
+const discoveryPath = "/.well-known/openid-configuration"
 
-	dexClientName = "mke-dashboard"
-)
+// OIDCConfig contains the settings used to verify the ID tokens of the requests
+type OIDCConfig struct {
+	// IssuerURL is the URL of the OIDC issuer, e.g. http://authentication-dex:5556/dex
+	IssuerURL string
+
+	// JWKSURL is the URL of the JSON Web Key Set used to verify the token signatures
+	// It is discovered from the issuer's discovery document when empty
+	JWKSURL string
+
+	// ClientIDs is the list of audiences (OIDC client ids) that are allowed to call the API
+	ClientIDs []string
+
+	// SkipIssuerCheck disables the check of the "iss" claim against the IssuerURL
+	// This is only useful when the issuer is reached through an internal address that differs
+	// from the issuer in the tokens
+	SkipIssuerCheck bool
+
+	// GroupsPrefix is prepended to the groups of the "groups" claim, to prevent clashes with
+	// existing Kubernetes groups (e.g. system:masters), like the --oidc-groups-prefix flag of
+	// the kube-apiserver. The prefixed groups are matched against the ClusterRoleBinding
+	// subjects and the groups of the authorization policy
+	GroupsPrefix string
+}
 
 // userInfoCtxKey is the key used to store the user information in the request context.
 
@@ -28,48 +54,57 @@ type user struct {
 	groups []string
 }
 
-var idTokenVerifier *oidc.IDTokenVerifier
+var idTokenVerifier *tokenVerifier
 
 // authenticationMiddleware is a middleware that authenticates requests using a bearer token.
 // It extracts the token from the Authorization header and verifies it using the ID token verifier.
 // If the token is valid, it extracts the user information from the claims and adds it to the request context.
-func authenticationMiddleware() runtime.Middleware {
-
+func authenticationMiddleware(cfg OIDCConfig) (runtime.Middleware, error) {
 	log.Info().Msg("Initializing ID token verifier")
-	idTokenVerifier = oidc.NewVerifier(dexIssuerURL, oidc.NewRemoteKeySet(context.Background(), dexKeysURL), &oidc.Config{ClientID: dexClientName, SkipIssuerCheck: true})
+	log.Debug().Msgf("OIDC issuer: %s, allowed client ids: %s, groups prefix: %q", cfg.IssuerURL, strings.Join(cfg.ClientIDs, ", "), cfg.GroupsPrefix)
+
+	var err error
+	idTokenVerifier, err = newTokenVerifier(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	return func(next runtime.HandlerFunc) runtime.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-			log.Debug().Msg("Authenticating request using bearer token")
+			log.Ctx(r.Context()).Debug().Msg("Authenticating request using bearer token")
 			token, err := getBearerToken(r)
 			if err != nil {
-				log.Error().Err(err).Msg("failed to get authentication token")
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				log.Ctx(r.Context()).Error().Err(err).Msg("failed to get authentication token")
+				metrics.Authentications.WithLabelValues("failure", authnFailureReason(err)).Inc()
+				writeError(w, r, &apiError{code: codes.Unauthenticated, message: "unauthorized"})
 				return
 			}
 
 			u, err := authenticate(r.Context(), token)
 			if err != nil {
-				log.Error().Err(err).Msg("failed to authenticate user")
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				log.Ctx(r.Context()).Error().Err(err).Msg("failed to authenticate user")
+				metrics.Authentications.WithLabelValues("failure", authnFailureReason(err)).Inc()
+				writeError(w, r, &apiError{code: codes.Unauthenticated, message: "unauthorized"})
 				return
 			}
 
-			log.Debug().Msg("Authenticated user: " + u.email)
+			setLogActor(r.Context(), u.email)
+			log.Ctx(r.Context()).Debug().Msg("Authenticated user: " + u.email)
+			metrics.Authentications.WithLabelValues("success", "").Inc()
 
 			// Attach user information to the request context for next middlewares to use
 			ctx := context.WithValue(r.Context(), userInfoKey{}, u)
 
 			next(w, r.WithContext(ctx), pathParams)
 		}
-	}
+	}, nil
 }
 
 // authenticate verifies a bearer token and pulls user information form the claims.
 func authenticate(ctx context.Context, bearerToken string) (*user, error) {
-	idToken, err := idTokenVerifier.Verify(ctx, bearerToken)
+	idToken, err := idTokenVerifier.verify(ctx, bearerToken)
 	if err != nil {
-		return nil, fmt.Errorf("could not verify bearer token: %v", err)
+		return nil, &authnError{reason: "invalid_token", err: fmt.Errorf("could not verify bearer token: %v", err)}
 	}
 
 	// Extract custom claims.
@@ -79,24 +114,239 @@ func authenticate(ctx context.Context, bearerToken string) (*user, error) {
 		Groups   []string `json:"groups"`
 	}
 	if err := idToken.Claims(&claims); err != nil {
-		return nil, fmt.Errorf("failed to parse claims: %v", err)
+		return nil, &authnError{reason: "invalid_claims", err: fmt.Errorf("failed to parse claims: %v", err)}
 	}
 	if !claims.Verified {
-		return nil, fmt.Errorf("email (%q) in returned claims was not verified", claims.Email)
+		return nil, &authnError{reason: "email_not_verified", err: fmt.Errorf("email (%q) in returned claims was not verified", claims.Email)}
 	}
-	return &user{claims.Email, claims.Groups}, nil
+	return &user{claims.Email, prefixGroups(idTokenVerifier.cfg.GroupsPrefix, claims.Groups)}, nil
+}
+
+// prefixGroups returns the groups with the prefix prepended to each of them
+func prefixGroups(prefix string, groups []string) []string {
+	if prefix == "" {
+		return groups
+	}
+
+	prefixed := make([]string, 0, len(groups))
+	for _, g := range groups {
+		prefixed = append(prefixed, prefix+g)
+	}
+	return prefixed
+}
+
+// authnError is an authentication failure, with the reason reported in the metrics
+type authnError struct {
+	reason string
+	err    error
+}
+
+func (e *authnError) Error() string {
+	return e.err.Error()
+}
+
+func (e *authnError) Unwrap() error {
+	return e.err
+}
+
+// authnFailureReason returns the reason of an authentication failure
+func authnFailureReason(err error) string {
+	var ae *authnError
+	if errors.As(err, &ae) {
+		return ae.reason
+	}
+	return "unknown"
 }
 
 func getBearerToken(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		return "", fmt.Errorf("authorization header not found")
+		return "", &authnError{reason: "missing_token", err: fmt.Errorf("authorization header not found")}
 	}
 
 	parts := strings.Split(authHeader, " ")
 	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-		return "", fmt.Errorf("invalid authorization header format")
+		return "", &authnError{reason: "malformed_header", err: fmt.Errorf("invalid authorization header format")}
 	}
 
 	return parts[1], nil
 }
+
+// tokenVerifier verifies the ID tokens against the configured issuer and audiences
+// The key set is resolved on first use, so that the server can start before the issuer is reachable
+type tokenVerifier struct {
+	cfg OIDCConfig
+
+	mu       sync.Mutex
+	verifier *oidc.IDTokenVerifier
+
+	// discoveredJWKSURL is the JWKS URL discovered from the issuer, it is discovered once
+	discoveryMu       sync.Mutex
+	discoveredJWKSURL string
+}
+
+func newTokenVerifier(cfg OIDCConfig) (*tokenVerifier, error) {
+	if cfg.IssuerURL == "" {
+		return nil, fmt.Errorf("oidc issuer url is required")
+	}
+
+	if len(cfg.ClientIDs) == 0 {
+		return nil, fmt.Errorf("at least one oidc client id is required")
+	}
+
+	if cfg.SkipIssuerCheck {
+		log.Warn().Msg("OIDC issuer check is disabled")
+	}
+
+	return &tokenVerifier{cfg: cfg}, nil
+}
+
+// verify verifies the signature and the claims of the raw ID token
+func (v *tokenVerifier) verify(ctx context.Context, rawIDToken string) (*oidc.IDToken, error) {
+	verifier, err := v.getVerifier(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// the client id check of the oidc verifier supports a single client id,
+	// so the audience is checked here against the list of allowed client ids
+	if !containsAny(v.cfg.ClientIDs, idToken.Audience) {
+		return nil, fmt.Errorf("expected audience to be one of %q, got %q", v.cfg.ClientIDs, idToken.Audience)
+	}
+
+	return idToken, nil
+}
+
+// getVerifier returns the oidc verifier, resolving the key set URL on first use
+func (v *tokenVerifier) getVerifier(ctx context.Context) (*oidc.IDTokenVerifier, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.verifier != nil {
+		return v.verifier, nil
+	}
+
+	jwksURL, err := v.jwksURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Msgf("Using JSON Web Key Set from %s", jwksURL)
+
+	// the key set outlives the request, so it must not use the request context
+	keySet := oidc.NewRemoteKeySet(context.Background(), jwksURL)
+	v.verifier = oidc.NewVerifier(v.cfg.IssuerURL, keySet, &oidc.Config{
+		SkipClientIDCheck: true,
+		SkipIssuerCheck:   v.cfg.SkipIssuerCheck,
+	})
+
+	return v.verifier, nil
+}
+
+// jwksURL returns the configured JWKS URL or discovers it from the issuer. The discovered URL is
+// cached after the first successful discovery, so that the readiness checks do not discover it again
+func (v *tokenVerifier) jwksURL(ctx context.Context) (string, error) {
+	if v.cfg.JWKSURL != "" {
+		return v.cfg.JWKSURL, nil
+	}
+
+	v.discoveryMu.Lock()
+	defer v.discoveryMu.Unlock()
+
+	if v.discoveredJWKSURL != "" {
+		return v.discoveredJWKSURL, nil
+	}
+
+	jwksURL, err := discoverJWKSURL(ctx, v.cfg.IssuerURL, v.cfg.SkipIssuerCheck)
+	if err != nil {
+		return "", err
+	}
+	v.discoveredJWKSURL = jwksURL
+	return jwksURL, nil
+}
+
+// discoverJWKSURL fetches the discovery document of the issuer and returns the JWKS URL from it
+func discoverJWKSURL(ctx context.Context, issuerURL string, skipIssuerCheck bool) (string, error) {
+	wellKnown := strings.TrimSuffix(issuerURL, "/") + discoveryPath
+	log.Debug().Msgf("Discovering OIDC configuration from %s", wellKnown)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create discovery request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch discovery document: unexpected status %s", resp.Status)
+	}
+
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", fmt.Errorf("failed to decode discovery document: %w", err)
+	}
+
+	if !skipIssuerCheck && doc.Issuer != issuerURL {
+		return "", fmt.Errorf("issuer did not match the issuer returned by provider, expected %q got %q", issuerURL, doc.Issuer)
+	}
+
+	if doc.JWKSURL == "" {
+		return "", fmt.Errorf("discovery document does not contain a jwks_uri")
+	}
+
+	return doc.JWKSURL, nil
+}
+
+// CheckJWKS checks that the JSON Web Key Set used to verify the ID tokens is reachable and contains keys
+// The JWKS URL is discovered from the issuer when it is not configured, so the issuer is checked until
+// the first successful discovery
+func CheckJWKS(ctx context.Context) error {
+	if idTokenVerifier == nil {
+		return fmt.Errorf("ID token verifier is not initialized")
+	}
+
+	jwksURL, err := idTokenVerifier.jwksURL(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create jwks request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch jwks: unexpected status %s", resp.Status)
+	}
+
+	var keySet struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return fmt.Errorf("failed to decode jwks: %w", err)
+	}
+
+	if len(keySet.Keys) == 0 {
+		return fmt.Errorf("jwks %s contains no keys", jwksURL)
+	}
+
+	return nil
+}
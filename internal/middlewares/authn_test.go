@@ -0,0 +1,214 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// testIssuer is an OIDC issuer serving a discovery document and a key set
+type testIssuer struct {
+	*httptest.Server
+
+	key *rsa.PrivateKey
+
+	// issuer is the issuer advertised in the discovery document
+	issuer string
+
+	// discoveries is the number of requests of the discovery document
+	discoveries atomic.Int32
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ti := &testIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		ti.discoveries.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   ti.issuer,
+			"jwks_uri": ti.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: key.Public(), KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+
+	ti.Server = httptest.NewServer(mux)
+	ti.issuer = ti.URL
+	t.Cleanup(ti.Close)
+	return ti
+}
+
+// token returns a signed ID token with the provided issuer and audience
+func (ti *testIssuer) token(t *testing.T, issuer string, audience ...string) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: ti.key, KeyID: "test"}}, nil)
+	require.NoError(t, err)
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":            issuer,
+		"sub":            "user",
+		"aud":            audience,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"email":          "admin@example.com",
+		"email_verified": true,
+		"groups":         []string{"admins"},
+	})
+	require.NoError(t, err)
+
+	jws, err := signer.Sign(claims)
+	require.NoError(t, err)
+
+	raw, err := jws.CompactSerialize()
+	require.NoError(t, err)
+	return raw
+}
+
+func Test_tokenVerifier(t *testing.T) {
+	ti := newTestIssuer(t)
+
+	tests := []struct {
+		name        string
+		cfg         OIDCConfig
+		issuer      string
+		audience    []string
+		expectError bool
+	}{
+		{
+			name:     "discovered key set and allowed audience",
+			cfg:      OIDCConfig{IssuerURL: ti.URL, ClientIDs: []string{"mke-dashboard"}},
+			issuer:   ti.URL,
+			audience: []string{"mke-dashboard"},
+		},
+		{
+			name:     "configured key set and second allowed audience",
+			cfg:      OIDCConfig{IssuerURL: ti.URL, JWKSURL: ti.URL + "/keys", ClientIDs: []string{"mke-dashboard", "other-ui"}},
+			issuer:   ti.URL,
+			audience: []string{"other-ui"},
+		},
+		{
+			name:        "audience not allowed",
+			cfg:         OIDCConfig{IssuerURL: ti.URL, ClientIDs: []string{"mke-dashboard"}},
+			issuer:      ti.URL,
+			audience:    []string{"other-ui"},
+			expectError: true,
+		},
+		{
+			name:        "issuer does not match",
+			cfg:         OIDCConfig{IssuerURL: ti.URL, JWKSURL: ti.URL + "/keys", ClientIDs: []string{"mke-dashboard"}},
+			issuer:      "https://dex.example.com",
+			audience:    []string{"mke-dashboard"},
+			expectError: true,
+		},
+		{
+			name:     "issuer check skipped",
+			cfg:      OIDCConfig{IssuerURL: ti.URL, JWKSURL: ti.URL + "/keys", ClientIDs: []string{"mke-dashboard"}, SkipIssuerCheck: true},
+			issuer:   "https://dex.example.com",
+			audience: []string{"mke-dashboard"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newTokenVerifier(tt.cfg)
+			require.NoError(t, err)
+
+			_, err = v.verify(context.Background(), ti.token(t, tt.issuer, tt.audience...))
+			if tt.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_newTokenVerifierRequiresSettings(t *testing.T) {
+	_, err := newTokenVerifier(OIDCConfig{ClientIDs: []string{"mke-dashboard"}})
+	assert.Error(t, err, "issuer url is required")
+
+	_, err = newTokenVerifier(OIDCConfig{IssuerURL: "http://dex:5556/dex"})
+	assert.Error(t, err, "client id is required")
+}
+
+func Test_discoverJWKSURL(t *testing.T) {
+	ti := newTestIssuer(t)
+
+	jwksURL, err := discoverJWKSURL(context.Background(), ti.URL, false)
+	assert.NoError(t, err)
+	assert.Equal(t, ti.URL+"/keys", jwksURL)
+
+	// the issuer in the discovery document must match the configured issuer
+	ti.issuer = "https://dex.example.com"
+	_, err = discoverJWKSURL(context.Background(), ti.URL, false)
+	assert.Error(t, err)
+
+	jwksURL, err = discoverJWKSURL(context.Background(), ti.URL, true)
+	assert.NoError(t, err)
+	assert.Equal(t, ti.URL+"/keys", jwksURL)
+}
+
+func Test_authenticateGroupsPrefix(t *testing.T) {
+	ti := newTestIssuer(t)
+
+	tests := []struct {
+		name       string
+		prefix     string
+		wantGroups []string
+	}{
+		{name: "no prefix", prefix: "", wantGroups: []string{"admins"}},
+		{name: "prefix", prefix: "oidc:", wantGroups: []string{"oidc:admins"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			idTokenVerifier, err = newTokenVerifier(OIDCConfig{IssuerURL: ti.URL, ClientIDs: []string{"mke-dashboard"}, GroupsPrefix: tt.prefix})
+			require.NoError(t, err)
+
+			u, err := authenticate(context.Background(), ti.token(t, ti.URL, "mke-dashboard"))
+			require.NoError(t, err)
+			assert.Equal(t, "admin@example.com", u.email)
+			assert.Equal(t, tt.wantGroups, u.groups)
+		})
+	}
+}
+
+func TestCheckJWKS(t *testing.T) {
+	ti := newTestIssuer(t)
+
+	var err error
+	idTokenVerifier, err = newTokenVerifier(OIDCConfig{IssuerURL: ti.URL, ClientIDs: []string{"mke-dashboard"}})
+	require.NoError(t, err)
+	assert.NoError(t, CheckJWKS(context.Background()))
+
+	// the JWKS URL is discovered once
+	assert.NoError(t, CheckJWKS(context.Background()))
+	assert.Equal(t, int32(1), ti.discoveries.Load())
+
+	// the configured key set is not reachable
+	idTokenVerifier, err = newTokenVerifier(OIDCConfig{IssuerURL: ti.URL, JWKSURL: ti.URL + "/missing", ClientIDs: []string{"mke-dashboard"}})
+	require.NoError(t, err)
+	assert.Error(t, CheckJWKS(context.Background()))
+
+	// the issuer is not reachable
+	ti.Close()
+	idTokenVerifier, err = newTokenVerifier(OIDCConfig{IssuerURL: ti.URL, ClientIDs: []string{"mke-dashboard"}})
+	require.NoError(t, err)
+	assert.Error(t, CheckJWKS(context.Background()))
+}
@@ -9,89 +9,214 @@ import (
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/mirantiscontainers/dex-http-server/internal/k8s"
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
+	"github.com/mirantiscontainers/dex-http-server/internal/policy"
 )
 
+// AuthzMode selects how the requests are authorized
+type AuthzMode string
+
+const (
+	// AuthzModePolicy authorizes the requests with the authorization policy
+	AuthzModePolicy AuthzMode = "policy"
+
+	// AuthzModeSubjectAccessReview delegates the authorization to the Kubernetes API,
+	// by sending a SubjectAccessReview for the operation of the request
+	AuthzModeSubjectAccessReview AuthzMode = "subjectaccessreview"
+)
+
+// AuthzConfig contains the settings used to authorize the requests
+type AuthzConfig struct {
+	// Mode selects how the requests are authorized, defaults to AuthzModePolicy
+	Mode AuthzMode
+
+	// Policy is the authorization policy used in AuthzModePolicy
+	// Only cluster-admin users are allowed when nil
+	Policy *policy.Policy
+
+	// KubeClient is the Kubernetes client used to authorize the requests
+	KubeClient kubernetes.Interface
+
+	// AdminNamespaces is the list of namespaces whose RoleBindings to ClusterRoles are taken
+	// into account, in addition to the ClusterRoleBindings
+	AdminNamespaces []string
+
+	// Roles resolves the ClusterRoles of the users in AuthzModePolicy
+	// The RBAC objects are listed from the Kubernetes API on every request when nil
+	Roles k8s.RoleResolver
+}
+
 var (
 	kubeClient kubernetes.Interface
 
-	// List of cluster roles that are allowed to access the dashboard
-	// @todo (ranyodh): This should be configurable from command line args
-	clusterRoles = []string{
-		"cluster-admin",
-	}
+	// roleResolver resolves the ClusterRoles granted to the users
+	roleResolver k8s.RoleResolver
+
+	// authzMode is the mode used to authorize the requests
+	authzMode AuthzMode
+
+	// authzPolicy maps ClusterRoles, OIDC groups and users to the allowed operations
+	authzPolicy *policy.Policy
 )
 
 // authorizationMiddleware is a middleware that authorizes requests based on the user information in the context.
-func authorizationMiddleware() runtime.Middleware {
-	log.Info().Msg("Initialize kubernetes client")
-	log.Debug().Msg("Allowed cluster roles: " + strings.Join(clusterRoles, ", "))
+func authorizationMiddleware(cfg AuthzConfig) (runtime.Middleware, error) {
+	if cfg.KubeClient == nil {
+		return nil, fmt.Errorf("kubernetes client is required")
+	}
+	kubeClient = cfg.KubeClient
 
-	var err error
-	kubeClient, err = k8s.NewClientSet()
-	if err != nil {
-		log.Error().Err(err).Msg("failed to initialize kubernetes client")
-		panic("failed to initialize kubernetes client")
+	roleResolver = cfg.Roles
+	if roleResolver == nil {
+		roleResolver = k8s.NewRoleLister(kubeClient, k8s.ResolverOptions{AdminNamespaces: cfg.AdminNamespaces})
+	}
+
+	switch cfg.Mode {
+	case "", AuthzModePolicy:
+		authzMode = AuthzModePolicy
+		if err := initPolicy(cfg.Policy); err != nil {
+			return nil, err
+		}
+	case AuthzModeSubjectAccessReview:
+		authzMode = AuthzModeSubjectAccessReview
+		log.Info().Msgf("Authorizing requests with SubjectAccessReviews on the %s resources", k8s.ResourceGroup)
+		if cfg.Policy != nil {
+			log.Warn().Msg("The authorization policy is ignored when authorizing with SubjectAccessReviews")
+		}
+	default:
+		return nil, fmt.Errorf("unknown authorization mode %q", cfg.Mode)
 	}
 
 	return func(next runtime.HandlerFunc) runtime.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-			log.Debug().Msg("Authorizing request")
+			log.Ctx(r.Context()).Debug().Msg("Authorizing request")
 
 			// get user info from the context
 			u := r.Context().Value(userInfoKey{})
 			if u == nil {
-				log.Error().Err(fmt.Errorf("failed to get user info from context"))
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				log.Ctx(r.Context()).Error().Msg("failed to get user info from context")
+				writeError(w, r, &apiError{code: codes.Internal, message: "failed to authorize request"})
 				return
 			}
 
 			userInfo, ok := u.(*user)
 			if !ok {
-				log.Error().Err(fmt.Errorf("failed to parse user info from context"))
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				log.Ctx(r.Context()).Error().Msg("failed to parse user info from context")
+				writeError(w, r, &apiError{code: codes.Internal, message: "failed to authorize request"})
 				return
 			}
 
-			// only allow if the user has the required cluster roles
-			allowed, err := authorize(userInfo)
+			// only allow if the policy allows the operation to the user
+			allowed, err := authorize(r.Context(), userInfo, getRequestName(r))
 			if err != nil {
-				log.Error().Err(err).Msg("failed to authorize user")
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				log.Ctx(r.Context()).Error().Err(err).Msg("failed to authorize user")
+				writeError(w, r, &apiError{code: codes.Internal, message: "failed to authorize request"})
 				return
 			}
 
 			if !allowed {
-				http.Error(w, "Forbidden", http.StatusForbidden)
+				writeError(w, r, &apiError{code: codes.PermissionDenied, message: "forbidden"})
 				return
 			}
 
 			next(w, r, pathParams)
 		}
+	}, nil
+}
+
+// initPolicy validates and sets the authorization policy
+func initPolicy(p *policy.Policy) error {
+	if p == nil {
+		log.Info().Msg("No authorization policy provided, only cluster-admin users are allowed")
+		p = policy.Default()
+	}
+
+	// catch typos in the operations of the policy, as they would silently never match
+	for _, op := range p.Operations() {
+		if !slices.Contains(knownRequestNames, requestName(op)) {
+			return fmt.Errorf("unknown operation %q in authorization policy", op)
+		}
 	}
+
+	authzPolicy = p
+	return nil
 }
 
-// authorize checks if the user has the required cluster roles to access the dashboard.
-func authorize(u *user) (bool, error) {
+// authorize checks if the user is allowed to perform the operation.
+// The Kubernetes calls use the context, so that their spans are children of the span of the request
+func authorize(ctx context.Context, u *user, op requestName) (bool, error) {
 	if u == nil {
 		return false, fmt.Errorf("user info is nil")
 	}
 
-	log.Debug().Msg("Authorizing request for user: " + u.email)
-	cr, err := k8s.GetClusterRoles(context.Background(), kubeClient, u.email)
-	if err != nil {
-		return false, fmt.Errorf("failed to get cluster roles for the user: %v", err)
+	var allowed bool
+	var reason string
+	var err error
+	if authzMode == AuthzModeSubjectAccessReview {
+		allowed, reason, err = authorizeWithAccessReview(ctx, u, op)
+	} else {
+		allowed, reason, err = authorizeWithPolicy(ctx, u, op)
+	}
+
+	switch {
+	case err != nil:
+		metrics.Authorizations.WithLabelValues(string(op), "error", reason).Inc()
+	case allowed:
+		metrics.Authorizations.WithLabelValues(string(op), "allowed", reason).Inc()
+	default:
+		metrics.Authorizations.WithLabelValues(string(op), "denied", reason).Inc()
 	}
 
-	log.Debug().Msg("Cluster roles: " + strings.Join(cr, ", "))
+	return allowed, err
+}
+
+// authorizeWithPolicy checks if the authorization policy allows the operation to the user.
+// It also returns the reason of the decision, reported in the metrics
+func authorizeWithPolicy(ctx context.Context, u *user, op requestName) (bool, string, error) {
+	log.Ctx(ctx).Debug().Msgf("Authorizing %s request for user: %s", op, u.email)
+
+	// the grants are kept to log which bindings allowed the operation
+	var grants []k8s.RoleGrant
+	rule, err := authzPolicy.Allowed(string(op), policy.Subject{
+		User:   u.email,
+		Groups: u.groups,
+		ClusterRoles: func() ([]string, error) {
+			var err error
+			grants, err = roleResolver.ResolveRoles(ctx, u.email, u.groups)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get cluster roles for the user: %v", err)
+			}
+
+			cr := k8s.RoleNames(grants)
+			log.Ctx(ctx).Debug().Msg("Cluster roles: " + strings.Join(cr, ", "))
+			return cr, nil
+		},
+	})
+	if err != nil {
+		return false, "role_resolution_failed", err
+	}
 
-	if containsAny(clusterRoles, cr) {
-		return true, nil
+	if rule == nil {
+		log.Ctx(ctx).Debug().Msgf("No rule allows %s to user %s", op, u.email)
+		return false, "no_matching_rule", nil
 	}
 
-	return false, nil
+	log.Ctx(ctx).Debug().Msgf("Rule %q allows %s to user %s", rule.Name, op, u.email)
+
+	// the users and groups rules are checked before the ClusterRoles are resolved,
+	// so any grant means that the rule matched one of the ClusterRoles
+	reason := "policy_rule"
+	for _, g := range grants {
+		if slices.Contains(rule.ClusterRoles, g.ClusterRole) {
+			reason = "policy_rule_cluster_role"
+			log.Ctx(ctx).Info().Msgf("Rule %q allows %s to user %s: %s", rule.Name, op, u.email, g)
+		}
+	}
+	return true, reason, nil
 }
 
 // containsAny returns true if any of the elements in arr2 are in arr1
@@ -0,0 +1,236 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/k8s"
+	"github.com/mirantiscontainers/dex-http-server/internal/policy"
+)
+
+func Test_authorize(t *testing.T) {
+	kubeClient = fake.NewClientset(&rbacv1.ClusterRoleBindingList{
+		Items: []rbacv1.ClusterRoleBinding{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "admin-binding"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "admin@example.com"}},
+				RoleRef:    rbacv1.RoleRef{Name: "cluster-admin"},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "admins-group-binding"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "oidc:admins"}},
+				RoleRef:    rbacv1.RoleRef{Name: "cluster-admin"},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "view-binding"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "jane@example.com"}},
+				RoleRef:    rbacv1.RoleRef{Name: "view"},
+			},
+		},
+	}, &rbacv1.RoleBindingList{
+		Items: []rbacv1.RoleBinding{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "ops-admin", Namespace: "mke"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "ops@example.com"}},
+				RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "cluster-admin"},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "dev-admin", Namespace: "dev"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "dev@example.com"}},
+				RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "cluster-admin"},
+			},
+		},
+	})
+
+	roleResolver = k8s.NewRoleLister(kubeClient, k8s.ResolverOptions{AdminNamespaces: []string{"mke"}})
+
+	p, err := policy.Parse([]byte(`
+rules:
+  - name: admins
+    clusterRoles: ["cluster-admin"]
+    operations: ["*"]
+  - name: helpdesk
+    groups: ["helpdesk"]
+    operations: ["ListUsers", "UpdateUser"]
+`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		policy  *policy.Policy
+		user    *user
+		op      requestName
+		allowed bool
+	}{
+		{
+			name:    "default policy allows cluster-admin",
+			policy:  policy.Default(),
+			user:    &user{email: "admin@example.com"},
+			op:      requestDeleteUser,
+			allowed: true,
+		},
+		{
+			name:    "default policy denies other cluster roles",
+			policy:  policy.Default(),
+			user:    &user{email: "jane@example.com", groups: []string{"helpdesk"}},
+			op:      requestListUsers,
+			allowed: false,
+		},
+		{
+			name:    "default policy allows cluster-admin through a group binding",
+			policy:  policy.Default(),
+			user:    &user{email: "john@example.com", groups: []string{"oidc:admins"}},
+			op:      requestDeleteUser,
+			allowed: true,
+		},
+		{
+			name:    "group binding requires the prefixed group",
+			policy:  policy.Default(),
+			user:    &user{email: "john@example.com", groups: []string{"admins"}},
+			op:      requestDeleteUser,
+			allowed: false,
+		},
+		{
+			name:    "helpdesk group can reset passwords",
+			policy:  p,
+			user:    &user{email: "jane@example.com", groups: []string{"helpdesk"}},
+			op:      requestUpdateUser,
+			allowed: true,
+		},
+		{
+			name:    "helpdesk group cannot delete users",
+			policy:  p,
+			user:    &user{email: "jane@example.com", groups: []string{"helpdesk"}},
+			op:      requestDeleteUser,
+			allowed: false,
+		},
+		{
+			name:    "cluster-admin can delete users",
+			policy:  p,
+			user:    &user{email: "admin@example.com"},
+			op:      requestDeleteUser,
+			allowed: true,
+		},
+		{
+			name:    "cluster-admin through a role binding in an admin namespace",
+			policy:  policy.Default(),
+			user:    &user{email: "ops@example.com"},
+			op:      requestDeleteUser,
+			allowed: true,
+		},
+		{
+			name:    "role bindings in other namespaces are ignored",
+			policy:  policy.Default(),
+			user:    &user{email: "dev@example.com"},
+			op:      requestDeleteUser,
+			allowed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authzPolicy = tt.policy
+
+			allowed, err := authorize(context.Background(), tt.user, tt.op)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.allowed, allowed)
+		})
+	}
+}
+
+func Test_authorizeNilUser(t *testing.T) {
+	authzPolicy = policy.Default()
+
+	_, err := authorize(context.Background(), nil, requestListUsers)
+	assert.Error(t, err)
+}
+
+func Test_authorizationMiddlewareTracing(t *testing.T) {
+	requestPatternGetter = mockedRequestPatternGetter("/v1/users")
+
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	authz, err := authorizationMiddleware(AuthzConfig{KubeClient: fake.NewClientset(&rbacv1.ClusterRoleBindingList{
+		Items: []rbacv1.ClusterRoleBinding{{
+			ObjectMeta: metav1.ObjectMeta{Name: "admin-binding"},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "admin@example.com"}},
+			RoleRef:    rbacv1.RoleRef{Name: "cluster-admin"},
+		}},
+	})})
+	require.NoError(t, err)
+
+	handler := tracingMiddleware(traceMiddleware("authorization", authz)(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {}))
+	r := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+	r = r.WithContext(context.WithValue(r.Context(), userInfoKey{}, &user{email: "admin@example.com"}))
+	w := httptest.NewRecorder()
+	handler(w, r, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range exporter.GetSpans().Snapshots() {
+		spans[s.Name()] = s
+	}
+	authzSpan, ok := spans["middleware authorization"]
+	require.True(t, ok)
+
+	// the spans of the Kubernetes calls are children of the span of the authorization middleware
+	list, ok := spans["k8s.list_clusterrolebindings"]
+	require.True(t, ok)
+	assert.Equal(t, authzSpan.SpanContext().TraceID(), list.SpanContext().TraceID())
+	assert.Equal(t, authzSpan.SpanContext().SpanID(), list.Parent().SpanID())
+}
+
+func Test_authorizationMiddlewareLogs(t *testing.T) {
+	requestPatternGetter = mockedRequestPatternGetter("/v1/users")
+
+	var out bytes.Buffer
+	defer func(l zerolog.Logger) { log.Logger = l }(log.Logger)
+	log.Logger = zerolog.New(&out)
+
+	authz, err := authorizationMiddleware(AuthzConfig{KubeClient: fake.NewClientset()})
+	require.NoError(t, err)
+
+	authenticated := func(next runtime.HandlerFunc) runtime.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+			next(w, r.WithContext(context.WithValue(r.Context(), userInfoKey{}, &user{email: "jane@example.com"})), pathParams)
+		}
+	}
+	handler := requestIDMiddleware(loggingMiddleware(authenticated(authz(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		t.Fatal("the denied request must not be forwarded")
+	}))))
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+	r.Header.Set("X-Request-Id", "request-1")
+	w := httptest.NewRecorder()
+	handler(w, r, nil)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	// the decision is logged with the request-scoped logger
+	var decision map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.Contains(line, "No rule allows") {
+			require.NoError(t, json.Unmarshal([]byte(line), &decision))
+		}
+	}
+	require.NotNil(t, decision, out.String())
+	assert.Equal(t, "request-1", decision["request_id"])
+	assert.Equal(t, "/v1/users", decision["route"])
+}
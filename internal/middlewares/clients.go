@@ -0,0 +1,84 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+// clientSecretLen is the number of random bytes used to generate a client secret
+const clientSecretLen = 32
+
+// createClientMiddleware is a middleware that intercepts and modifies the request body to:
+// - generate a secure client secret when none is provided (confidential clients only)
+// - trim spaces from the client id and name
+// This middleware is applied to create client requests only.
+//
+// The secret is stored by Dex and echoed back in the create client response. There is no
+// endpoint that returns the secret afterward, so the create response is the only time the
+// caller sees a generated secret.
+func createClientMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		if getRequestName(r) == requestCreateClient {
+			log.Ctx(r.Context()).Debug().Msg("create client request, will modify request body to generate a client secret")
+
+			// decode request body
+			// note: we are decoding req.Client (instead of req) because the request body is
+			//       mapped to the Client object, and not the entire CreateClientReq object
+			var req api.CreateClientReq
+			if err := marshaler.NewDecoder(r.Body).Decode(&req.Client); err != nil {
+				log.Ctx(r.Context()).Err(err).Msg("failed to decode request body while creating client")
+				writeError(w, r, &apiError{code: codes.InvalidArgument, message: err.Error(), violations: []*fieldError{{field: "body", rule: ruleMalformed, err: err}}})
+				return
+			}
+			_ = r.Body.Close()
+
+			if req.Client == nil {
+				req.Client = &api.Client{}
+			}
+
+			req.Client.Id = strings.TrimSpace(req.Client.Id)
+			req.Client.Name = strings.TrimSpace(req.Client.Name)
+
+			// public clients (e.g. SPAs, CLIs) cannot keep a secret, so only generate one for
+			// confidential clients that did not bring their own
+			if !req.Client.Public && req.Client.Secret == "" {
+				secret, err := generateClientSecret()
+				if err != nil {
+					log.Ctx(r.Context()).Err(err).Msg("failed to generate client secret")
+					writeError(w, r, &apiError{code: codes.Internal, message: "failed to generate client secret"})
+					return
+				}
+				req.Client.Secret = secret
+			}
+
+			// update request body
+			newCreateClientReq, err := marshaler.Marshal(&req.Client)
+			if err != nil {
+				log.Ctx(r.Context()).Err(err).Msg("failed to marshal request after generating client secret")
+				writeError(w, r, &apiError{code: codes.Internal, message: "failed to encode request"})
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(newCreateClientReq))
+		}
+		next(w, r, pathParams)
+	}
+}
+
+// generateClientSecret returns a random, URL safe client secret
+func generateClientSecret() (string, error) {
+	b := make([]byte, clientSecretLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
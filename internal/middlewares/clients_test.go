@@ -0,0 +1,102 @@
+package middlewares
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+func Test_createClientMiddleware(t *testing.T) {
+	requestPatternGetter = mockedRequestPatternGetter("/v1/clients")
+
+	tests := []struct {
+		name           string
+		body           string
+		wantSecret     string
+		wantGenerated  bool
+		expectedStatus int
+	}{
+		{
+			name:           "secret is generated when not provided",
+			body:           `{"id": " dashboard ", "redirectUris": ["https://example.com/callback"]}`,
+			wantGenerated:  true,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "provided secret is kept",
+			body:           `{"id": "dashboard", "secret": "mysecret"}`,
+			wantSecret:     "mysecret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "no secret is generated for public clients",
+			body:           `{"id": "dashboard", "public": true}`,
+			wantSecret:     "",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "invalid body",
+			body:           `{"id": `,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockNext := func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+				var req api.CreateClientReq
+				err := marshaler.NewDecoder(r.Body).Decode(&req.Client)
+				assert.NoError(t, err)
+
+				assert.Equal(t, "dashboard", req.Client.Id)
+				if tt.wantGenerated {
+					assert.Len(t, req.Client.Secret, 43, "generated secret should be 32 random bytes, base64 encoded")
+				} else {
+					assert.Equal(t, tt.wantSecret, req.Client.Secret)
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/clients", bytes.NewReader([]byte(tt.body)))
+			rr := httptest.NewRecorder()
+
+			handler := createClientMiddleware(mockNext)
+			handler(rr, req, nil)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func Test_isCreateClientRequest(t *testing.T) {
+	tests := []struct {
+		method  string
+		pattern string
+		want    bool
+	}{
+		{method: http.MethodPost, pattern: "/clients", want: true},
+		{method: http.MethodPost, pattern: "/v1/clients", want: true},
+
+		{method: http.MethodPut, pattern: "/v1/clients", want: false},
+		{method: http.MethodPost, pattern: "/v1/users", want: false},
+		{method: http.MethodPut, pattern: "/v1/clients/{id=*}", want: false},
+	}
+	for _, test := range tests {
+		if got := isCreateClientRequest(test.method, test.pattern); got != test.want {
+			t.Errorf("isCreateClientRequest() with %s %s = %v, want %v", test.method, test.pattern, got, test.want)
+		}
+	}
+}
+
+func Test_generateClientSecret(t *testing.T) {
+	s1, err := generateClientSecret()
+	assert.NoError(t, err)
+	s2, err := generateClientSecret()
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, s1, s2)
+}
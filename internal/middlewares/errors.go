@@ -0,0 +1,155 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// errorDomain is the domain of the ErrorInfo details of the error responses
+const errorDomain = "dex-http-server"
+
+// errorMarshaler is the marshaler of the error responses of the middlewares,
+// it is the default marshaler of the gateway so that all the error responses have the same format
+var errorMarshaler = &runtime.HTTPBodyMarshaler{
+	Marshaler: &runtime.JSONPb{
+		MarshalOptions: protojson.MarshalOptions{
+			EmitUnpopulated: true,
+		},
+		UnmarshalOptions: protojson.UnmarshalOptions{
+			DiscardUnknown: true,
+		},
+	},
+}
+
+// apiError is an error answered by a middleware, written as a google.rpc.Status like the errors of the gateway
+type apiError struct {
+	code       codes.Code
+	message    string
+	violations []*fieldError
+}
+
+// writeError writes the error response of a middleware, a google.rpc.Status with the code and the message,
+// and the ErrorInfo details with the stable reason of the error, see errorHandler.
+// The violations of the validation errors are added in BadRequest details
+func writeError(w http.ResponseWriter, r *http.Request, e *apiError) {
+	s := status.New(e.code, e.message)
+	if len(e.violations) > 0 {
+		s = withViolations(r.Context(), s, e.violations)
+	}
+	s = withErrorInfo(r.Context(), s, nil)
+
+	w.Header().Set("Content-Type", errorMarshaler.ContentType(nil))
+	if e.code == codes.Unauthenticated {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+
+	buf, err := errorMarshaler.Marshal(s.Proto())
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to marshal error response")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(w, `{"code": 13, "message": "failed to marshal error message"}`)
+		return
+	}
+
+	w.WriteHeader(runtime.HTTPStatusFromCode(e.code))
+	if _, err := w.Write(buf); err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to write error response")
+	}
+}
+
+// errorHandler is the error handler of the gateway. It writes the errors of Dex and of the gateway
+// with the ErrorInfo details of the middleware errors
+func errorHandler(ctx context.Context, mux *runtime.ServeMux, m runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	httpStatus := 0
+	var hse *runtime.HTTPStatusError
+	if errors.As(err, &hse) {
+		httpStatus = hse.HTTPStatus
+		err = hse.Err
+	}
+
+	// the errors of the forward response options are wrapped by the gateway, the status is
+	// unwrapped so that its message is not prefixed with the message of the gateway
+	var se interface{ GRPCStatus() *status.Status }
+	s := status.Convert(err)
+	if errors.As(err, &se) {
+		s = se.GRPCStatus()
+	}
+
+	if httpStatus == 0 {
+		httpStatus = runtime.HTTPStatusFromCode(s.Code())
+	}
+
+	runtime.DefaultHTTPErrorHandler(ctx, mux, m, w, r, &runtime.HTTPStatusError{
+		HTTPStatus: httpStatus,
+		Err:        withErrorInfo(ctx, s, nil).Err(),
+	})
+}
+
+// withErrorInfo returns the status with the ErrorInfo details, when it has none yet.
+// The reason is the name of the code, e.g. NOT_FOUND or INVALID_ARGUMENT
+func withErrorInfo(ctx context.Context, s *status.Status, metadata map[string]string) *status.Status {
+	for _, d := range s.Details() {
+		if _, ok := d.(*errdetails.ErrorInfo); ok {
+			return s
+		}
+	}
+
+	ws, err := s.WithDetails(&errdetails.ErrorInfo{
+		Reason:   errorReason(s.Code()),
+		Domain:   errorDomain,
+		Metadata: metadata,
+	})
+	if err != nil {
+		log.Ctx(ctx).Err(err).Msg("failed to add error info to error response")
+		return s
+	}
+	return ws
+}
+
+// withViolations returns the status with the BadRequest details of the violations, and the ErrorInfo
+// details with the rules broken by each field in the metadata, e.g. password: min_length, comma
+// separated when a field breaks several rules, e.g. password: min_length,character_classes
+func withViolations(ctx context.Context, s *status.Status, violations []*fieldError) *status.Status {
+	br := &errdetails.BadRequest{}
+	rules := make(map[string]string, len(violations))
+	for _, v := range violations {
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       v.field,
+			Description: v.Error(),
+		})
+		if rules[v.field] != "" {
+			rules[v.field] += ","
+		}
+		rules[v.field] += v.rule
+	}
+
+	ws, err := s.WithDetails(br)
+	if err != nil {
+		log.Ctx(ctx).Err(err).Msg("failed to add violations to error response")
+		return s
+	}
+	return withErrorInfo(ctx, ws, rules)
+}
+
+// errorReason returns the name of the code in upper snake case, e.g. NOT_FOUND for codes.NotFound
+func errorReason(c codes.Code) string {
+	var b strings.Builder
+	for i, r := range c.String() {
+		if i > 0 && unicode.IsUpper(r) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,164 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorBody is the JSON of a google.rpc.Status error response, with the ErrorInfo and BadRequest details
+type errorBody struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Details []struct {
+		Type            string            `json:"@type"`
+		Reason          string            `json:"reason"`
+		Domain          string            `json:"domain"`
+		Metadata        map[string]string `json:"metadata"`
+		FieldViolations []struct {
+			Field       string `json:"field"`
+			Description string `json:"description"`
+		} `json:"fieldViolations"`
+	} `json:"details"`
+}
+
+func decodeErrorBody(t *testing.T, w *httptest.ResponseRecorder) errorBody {
+	t.Helper()
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var body errorBody
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return body
+}
+
+func Test_writeError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     *apiError
+		status  int
+		reason  string
+		headers map[string]string
+	}{
+		{
+			name:    "unauthenticated",
+			err:     &apiError{code: codes.Unauthenticated, message: "unauthorized"},
+			status:  http.StatusUnauthorized,
+			reason:  "UNAUTHENTICATED",
+			headers: map[string]string{"WWW-Authenticate": "Bearer"},
+		},
+		{
+			name:   "permission denied",
+			err:    &apiError{code: codes.PermissionDenied, message: "forbidden"},
+			status: http.StatusForbidden,
+			reason: "PERMISSION_DENIED",
+		},
+		{
+			name:   "internal",
+			err:    &apiError{code: codes.Internal, message: "failed to encrypt password"},
+			status: http.StatusInternalServerError,
+			reason: "INTERNAL",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeError(w, httptest.NewRequest(http.MethodGet, "/v1/users", nil), tt.err)
+
+			assert.Equal(t, tt.status, w.Code)
+			for k, v := range tt.headers {
+				assert.Equal(t, v, w.Header().Get(k))
+			}
+
+			body := decodeErrorBody(t, w)
+			assert.Equal(t, int(tt.err.code), body.Code)
+			assert.Equal(t, tt.err.message, body.Message)
+			require.Len(t, body.Details, 1)
+			assert.Equal(t, "type.googleapis.com/google.rpc.ErrorInfo", body.Details[0].Type)
+			assert.Equal(t, tt.reason, body.Details[0].Reason)
+			assert.Equal(t, errorDomain, body.Details[0].Domain)
+		})
+	}
+}
+
+func Test_validationErrorResponse(t *testing.T) {
+	requestPatternGetter = mockedRequestPatternGetter("/v1/users")
+
+	tests := []struct {
+		name  string
+		body  string
+		field string
+		rule  string
+	}{
+		{name: "short password", body: `{"email": "jane@example.com", "hash": "c2hvcnQ="}`, field: "password", rule: ruleMinLength},
+		{name: "username with white spaces", body: `{"email": "jane doe", "hash": "cGFzc3dvcmQxMjM="}`, field: "username", rule: ruleWhiteSpaces},
+		{name: "malformed body", body: `{"email": `, field: "body", rule: ruleMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			validationMiddleware(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+				t.Fatal("the invalid request must not be forwarded")
+			})(w, httptest.NewRequest(http.MethodPost, "/v1/users", bytes.NewBufferString(tt.body)), nil)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			body := decodeErrorBody(t, w)
+			assert.Equal(t, int(codes.InvalidArgument), body.Code)
+			require.Len(t, body.Details, 2)
+
+			assert.Equal(t, "type.googleapis.com/google.rpc.BadRequest", body.Details[0].Type)
+			require.Len(t, body.Details[0].FieldViolations, 1)
+			assert.Equal(t, tt.field, body.Details[0].FieldViolations[0].Field)
+			assert.Equal(t, body.Message, body.Details[0].FieldViolations[0].Description)
+
+			assert.Equal(t, "INVALID_ARGUMENT", body.Details[1].Reason)
+			assert.Equal(t, map[string]string{tt.field: tt.rule}, body.Details[1].Metadata)
+		})
+	}
+}
+
+func Test_errorHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		reason string
+	}{
+		{name: "not found", err: status.Error(codes.NotFound, "user not found"), status: http.StatusNotFound, reason: "NOT_FOUND"},
+		{name: "already exists", err: status.Error(codes.AlreadyExists, "user already exists"), status: http.StatusConflict, reason: "ALREADY_EXISTS"},
+		{name: "unavailable", err: status.Error(codes.Unavailable, "connection refused"), status: http.StatusServiceUnavailable, reason: "UNAVAILABLE"},
+		{
+			name:   "custom http status",
+			err:    &runtime.HTTPStatusError{HTTPStatus: http.StatusMethodNotAllowed, Err: status.Error(codes.Unimplemented, "Method Not Allowed")},
+			status: http.StatusMethodNotAllowed,
+			reason: "UNIMPLEMENTED",
+		},
+	}
+
+	mux := runtime.NewServeMux()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+			ctx := runtime.NewServerMetadataContext(r.Context(), runtime.ServerMetadata{})
+			w := httptest.NewRecorder()
+			errorHandler(ctx, mux, errorMarshaler, w, r.WithContext(ctx), tt.err)
+
+			assert.Equal(t, tt.status, w.Code)
+
+			body := decodeErrorBody(t, w)
+			require.Len(t, body.Details, 1)
+			assert.Equal(t, tt.reason, body.Details[0].Reason)
+			assert.Equal(t, errorDomain, body.Details[0].Domain)
+		})
+	}
+}
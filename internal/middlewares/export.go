@@ -0,0 +1,143 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/backup"
+)
+
+const (
+	// exportUsersPath is the route of the export users handler
+	exportUsersPath = "/v1/users:export"
+
+	// backupUsersPath is the route of the backup users handler
+	backupUsersPath = "/v1/users:backup"
+
+	// backupMaxBytes is the maximum size of the body of a backup request
+	backupMaxBytes = 4 << 10
+)
+
+// backupRequest is the body of the backup users requests
+type backupRequest struct {
+	// Passphrase is the passphrase the key of the backup is derived from
+	Passphrase string `json:"passphrase"`
+
+	// Format is the format of the users, ndjson or csv, before the encryption
+	Format string `json:"format"`
+}
+
+// exportUsersHandler writes all the users as NDJSON or CSV, with the format query parameter,
+// with the exposed fields only, so without the hashes of the passwords
+func exportUsersHandler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	extendWriteDeadline(w, r)
+
+	format, err := backup.ParseFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		rejectInvalidRequest(w, r, &fieldError{field: "format", rule: ruleInvalid, err: err})
+		return
+	}
+
+	passwords, err := listPasswords(r.Context())
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to list users to export")
+		writeError(w, r, &apiError{code: status.Code(err), message: "failed to list users"})
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := writeUsers(&buf, format, exposedUserFields, passwords); err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to export users")
+		writeError(w, r, &apiError{code: codes.Internal, message: "failed to export users"})
+		return
+	}
+	log.Ctx(r.Context()).Info().Msgf("exported %d users", len(passwords))
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to write export users response")
+	}
+}
+
+// backupUsersHandler writes a full backup of the users, with the bcrypt hashes of the passwords
+// and the user ids, encrypted with a key derived from the passphrase of the body.
+// The backups are restored with the restore command, see backup.Restore. The request fails when
+// Dex does not send the hashes, rather than returning a backup that cannot be restored
+func backupUsersHandler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	extendWriteDeadline(w, r)
+
+	var req backupRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, backupMaxBytes)).Decode(&req); err != nil {
+		rejectInvalidRequest(w, r, &fieldError{field: "body", rule: ruleMalformed, err: err})
+		return
+	}
+
+	if len(req.Passphrase) < backup.MinPassphraseLength {
+		err := fmt.Errorf("invalid passphrase, must be at least %d characters", backup.MinPassphraseLength)
+		rejectInvalidRequest(w, r, &fieldError{field: "passphrase", rule: ruleMinLength, err: err})
+		return
+	}
+
+	format, err := backup.ParseFormat(req.Format)
+	if err != nil {
+		rejectInvalidRequest(w, r, &fieldError{field: "format", rule: ruleInvalid, err: err})
+		return
+	}
+
+	passwords, err := listPasswords(r.Context())
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to list users to back up")
+		writeError(w, r, &apiError{code: status.Code(err), message: "failed to list users"})
+		return
+	}
+
+	// a backup without the hashes could never be restored, see backup.Check
+	if err := backup.Check(passwords); err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to back up users")
+		writeError(w, r, &apiError{code: codes.FailedPrecondition, message: "the users cannot be backed up, Dex did not send the hashes of the passwords"})
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := writeUsers(&buf, format, backup.FullBackupFields, passwords); err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to back up users")
+		writeError(w, r, &apiError{code: codes.Internal, message: "failed to back up users"})
+		return
+	}
+
+	encrypted, err := backup.Encrypt(buf.Bytes(), []byte(req.Passphrase))
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to encrypt backup")
+		writeError(w, r, &apiError{code: codes.Internal, message: "failed to encrypt backup"})
+		return
+	}
+	log.Ctx(r.Context()).Info().Msgf("backed up %d users", len(passwords))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s.enc"`, format))
+	if _, err := w.Write(encrypted); err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to write backup users response")
+	}
+}
+
+// writeUsers writes the fields, by proto name, of the password records in the format
+func writeUsers(buf *bytes.Buffer, format backup.Format, fields []string, passwords []*api.Password) error {
+	bw, err := backup.NewWriter(buf, format, fields)
+	if err != nil {
+		return err
+	}
+	for _, p := range passwords {
+		if err := bw.Write(p); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
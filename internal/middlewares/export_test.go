@@ -0,0 +1,141 @@
+package middlewares
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/backup"
+)
+
+const exportedHash = "$2a$10$33EMT0cVYVlPy6WAMCLsceLYjWhuHpbz5yuZxu/GAFj03J9Lytjuy"
+
+var exportedPasswords = []*api.Password{
+	{Email: "jane@example.com", Username: "Jane", UserId: "1", Hash: []byte(exportedHash)},
+	{Email: "john@example.com", Username: "John", UserId: "2", Hash: []byte(exportedHash)},
+}
+
+// serveExport sends the request to a mux with the handlers of the gateway
+func serveExport(t *testing.T, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+
+	mux := runtime.NewServeMux(append(ServeMuxOptions(), runtime.WithMiddlewares(passwordsCacheMiddleware))...)
+	require.NoError(t, RegisterHandlers(mux))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func Test_exportUsersHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		fields      []string
+		contentType string
+		expected    string
+	}{
+		{
+			name:        "ndjson by default",
+			contentType: "application/x-ndjson",
+			expected: `{"email":"jane@example.com","userId":"1","username":"Jane"}
+{"email":"john@example.com","userId":"2","username":"John"}
+`,
+		},
+		{
+			name:        "csv with the exposed fields",
+			query:       "?format=csv",
+			fields:      []string{"email", "username"},
+			contentType: "text/csv",
+			expected:    "email,username\njane@example.com,Jane\njohn@example.com,John\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, setUserFields(tt.fields))
+			defer func() { _ = setUserFields(nil) }()
+			dexClient = &fakeDexClient{passwords: exportedPasswords}
+
+			w := serveExport(t, httptest.NewRequest(http.MethodGet, exportUsersPath+tt.query, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.contentType, w.Header().Get("Content-Type"))
+			assert.Equal(t, tt.expected, w.Body.String())
+			assert.NotContains(t, w.Body.String(), exportedHash)
+		})
+	}
+}
+
+func Test_exportUsersHandlerInvalidFormat(t *testing.T) {
+	dexClient = &fakeDexClient{passwords: exportedPasswords}
+
+	w := serveExport(t, httptest.NewRequest(http.MethodGet, exportUsersPath+"?format=xml", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "format", decodeErrorBody(t, w).Details[0].FieldViolations[0].Field)
+}
+
+func Test_backupUsersHandler(t *testing.T) {
+	dexClient = &fakeDexClient{passwords: exportedPasswords}
+	const passphrase = "correct horse battery staple"
+
+	w := serveExport(t, httptest.NewRequest(http.MethodPost, backupUsersPath, strings.NewReader(`{"passphrase": "`+passphrase+`"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	assert.NotContains(t, w.Body.String(), exportedHash)
+
+	// the backup keeps the hashes and the user ids, to be restored
+	plaintext, err := backup.Decrypt(w.Body.Bytes(), []byte(passphrase))
+	require.NoError(t, err)
+	passwords, err := backup.Read(bytes.NewReader(plaintext))
+	require.NoError(t, err)
+	require.Len(t, passwords, len(exportedPasswords))
+	for i, p := range passwords {
+		assert.True(t, proto.Equal(exportedPasswords[i], p), "record %d", i)
+	}
+}
+
+func Test_backupUsersHandlerWithoutHashes(t *testing.T) {
+	// the upstream Dex does not send the hashes with ListPasswords
+	dexClient = &fakeDexClient{passwords: []*api.Password{
+		{Email: "jane@example.com", Username: "Jane", UserId: "1"},
+		{Email: "john@example.com", Username: "John", UserId: "2"},
+	}}
+
+	w := serveExport(t, httptest.NewRequest(http.MethodPost, backupUsersPath, strings.NewReader(`{"passphrase": "correct horse battery staple"}`)))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	body := decodeErrorBody(t, w)
+	assert.Equal(t, int(codes.FailedPrecondition), body.Code)
+	assert.Equal(t, "FAILED_PRECONDITION", body.Details[0].Reason)
+	assert.False(t, backup.IsEncrypted(w.Body.Bytes()))
+}
+
+func Test_backupUsersHandlerInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{name: "malformed body", body: `passphrase`, field: "body"},
+		{name: "short passphrase", body: `{"passphrase": "secret"}`, field: "passphrase"},
+		{name: "unknown format", body: `{"passphrase": "correct horse battery staple", "format": "xml"}`, field: "format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dexClient = &fakeDexClient{passwords: exportedPasswords}
+
+			w := serveExport(t, httptest.NewRequest(http.MethodPost, backupUsersPath, strings.NewReader(tt.body)))
+			require.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Equal(t, tt.field, decodeErrorBody(t, w).Details[0].FieldViolations[0].Field)
+		})
+	}
+}
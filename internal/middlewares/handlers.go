@@ -0,0 +1,62 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// getUserPath is the route of the get user handler, there is no Dex method to get a single user
+const getUserPath = "/v1/users/{email}"
+
+// RegisterHandlers registers the handlers of the routes served by the gateway itself, without a Dex method,
+// on the mux. The middlewares of the mux are applied to them, like to the routes of the Dex methods
+func RegisterHandlers(mux *runtime.ServeMux) error {
+	if err := mux.HandlePath(http.MethodGet, getUserPath, getUserHandler); err != nil {
+		return fmt.Errorf("failed to register get user handler: %w", err)
+	}
+	if err := mux.HandlePath(http.MethodPost, importUsersPath, importUsersHandler); err != nil {
+		return fmt.Errorf("failed to register import users handler: %w", err)
+	}
+	if err := mux.HandlePath(http.MethodGet, exportUsersPath, exportUsersHandler); err != nil {
+		return fmt.Errorf("failed to register export users handler: %w", err)
+	}
+	if err := mux.HandlePath(http.MethodPost, backupUsersPath, backupUsersHandler); err != nil {
+		return fmt.Errorf("failed to register backup users handler: %w", err)
+	}
+	return nil
+}
+
+// getUserHandler returns the user with the email of the path, from the password records listed from Dex
+func getUserHandler(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	email := strings.TrimSpace(pathParams["email"])
+	if len(email) == 0 {
+		err := &fieldError{field: "username", rule: ruleRequired, err: fmt.Errorf("username is required")}
+		log.Ctx(r.Context()).Err(err).Msg("invalid username")
+		writeError(w, r, &apiError{code: codes.InvalidArgument, message: err.Error(), violations: []*fieldError{err}})
+		return
+	}
+
+	p, err := findPassword(r.Context(), email)
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to get user")
+		writeError(w, r, &apiError{code: status.Code(err), message: "failed to get user"})
+		return
+	}
+
+	if p == nil {
+		writeError(w, r, &apiError{code: codes.NotFound, message: fmt.Sprintf("user %s not found", email)})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(newUserResponse(p)); err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to write get user response")
+	}
+}
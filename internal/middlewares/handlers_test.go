@@ -0,0 +1,120 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+func Test_getUserHandler(t *testing.T) {
+	passwords := []*api.Password{
+		{Email: "jane@example.com", Username: "Jane", UserId: "1", Hash: []byte("$2a$10$hash")},
+		{Email: "john@example.com", Username: "John", UserId: "2", Hash: []byte("$2a$10$hash")},
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		dexErr   error
+		status   int
+		expected map[string]any
+	}{
+		{
+			name:     "user found",
+			path:     "/v1/users/jane@example.com",
+			status:   http.StatusOK,
+			expected: map[string]any{"email": "jane@example.com", "username": "Jane", "userId": "1"},
+		},
+		{
+			name:     "email compared case-insensitively",
+			path:     "/v1/users/John@Example.com",
+			status:   http.StatusOK,
+			expected: map[string]any{"email": "john@example.com", "username": "John", "userId": "2"},
+		},
+		{name: "user not found", path: "/v1/users/joe@example.com", status: http.StatusNotFound},
+		{name: "dex unavailable", path: "/v1/users/jane@example.com", dexErr: status.Error(codes.Unavailable, "connection refused"), status: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDexClient{passwords: passwords, err: tt.dexErr}
+			dexClient = fake
+
+			// the route is named after the pattern of the handler, for the authorization
+			var name requestName
+			named := func(next runtime.HandlerFunc) runtime.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+					if pattern, ok := runtime.HTTPPattern(r.Context()); ok && isGetUserRequest(r.Method, pattern.String()) {
+						name = requestGetUser
+					}
+					next(w, r, pathParams)
+				}
+			}
+
+			mux := runtime.NewServeMux(append(ServeMuxOptions(), runtime.WithMiddlewares(named, passwordsCacheMiddleware))...)
+			require.NoError(t, RegisterHandlers(mux))
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, requestGetUser, name)
+			assert.Equal(t, 1, fake.listCalls)
+			if tt.expected == nil {
+				assert.NotEmpty(t, decodeErrorBody(t, w).Details)
+				return
+			}
+
+			var body map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tt.expected, body)
+		})
+	}
+}
+
+func Test_listPasswordsCache(t *testing.T) {
+	fake := &fakeDexClient{passwords: []*api.Password{{Email: "jane@example.com", UserId: "1"}}}
+	dexClient = fake
+
+	var ctx context.Context
+	passwordsCacheMiddleware(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		ctx = r.Context()
+	})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/users/jane@example.com", nil), nil)
+
+	// the records are listed once per request
+	for range 3 {
+		p, err := findPassword(ctx, "jane@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "1", p.GetUserId())
+	}
+	assert.Equal(t, 1, fake.listCalls)
+
+	// the records are listed on each call without the cache of a request
+	_, err := findPassword(context.Background(), "jane@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 2, fake.listCalls)
+
+	// the errors are cached too
+	fake = &fakeDexClient{err: fmt.Errorf("connection refused")}
+	dexClient = fake
+	passwordsCacheMiddleware(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		ctx = r.Context()
+	})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/users/jane@example.com", nil), nil)
+
+	for range 2 {
+		_, err := listPasswords(ctx)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 1, fake.listCalls)
+}
@@ -0,0 +1,401 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/status"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/audit"
+)
+
+const (
+	// importUsersPath is the route of the import users handler
+	importUsersPath = "/v1/users:import"
+
+	// DefaultImportConcurrency is the default number of users created at the same time by an import
+	DefaultImportConcurrency = 4
+
+	// importMaxRows is the maximum number of users of an import
+	importMaxRows = 1000
+
+	// importMaxBytes is the maximum size of the body of an import
+	importMaxBytes = 4 << 20
+)
+
+// Statuses of the rows of the imports
+const (
+	importCreated       = "created"
+	importValid         = "valid"
+	importAlreadyExists = "already_exists"
+	importInvalid       = "invalid"
+	importError         = "error"
+	importSkipped       = "skipped"
+)
+
+// importConcurrency is the number of users created at the same time by an import
+var importConcurrency = DefaultImportConcurrency
+
+// importRow is a user of an import, and its result in the report of the import
+type importRow struct {
+	// Row is the number of the row, from 1, without the header of the CSV files
+	Row int `json:"row"`
+
+	// Email is the email of the user, the username in the UI
+	Email string `json:"email"`
+
+	// Status is the result of the row
+	Status string `json:"status"`
+
+	// Field, Rule and Reason describe why the row is invalid, or the error of the creation
+	Field  string `json:"field,omitempty"`
+	Rule   string `json:"rule,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	password *api.Password
+}
+
+// importReport is the response of the imports
+type importReport struct {
+	DryRun  bool           `json:"dryRun"`
+	Summary map[string]int `json:"summary"`
+	Rows    []*importRow   `json:"rows"`
+}
+
+// importUsersHandler creates the users of a CSV file, with the email, password and name columns,
+// or of a JSON array of the bodies of the create user requests. The rows are validated like the
+// create user requests, created with bounded concurrency, and reported one by one.
+// With dryRun, the rows are validated and checked against the existing users, but none is created.
+// With stopOnError, nothing is created when a row is invalid, and no more rows are created once a
+// creation failed, the remaining rows are skipped
+func importUsersHandler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	extendWriteDeadline(w, r)
+
+	q := r.URL.Query()
+	dryRun, err := boolQueryParam(q.Get("dryRun"), "dryRun")
+	if err != nil {
+		rejectInvalidRequest(w, r, err)
+		return
+	}
+	stopOnError, err := boolQueryParam(q.Get("stopOnError"), "stopOnError")
+	if err != nil {
+		rejectInvalidRequest(w, r, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, importMaxBytes)
+	rows, err := readImportRows(r)
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to read users to import")
+		rejectInvalidRequest(w, r, err)
+		return
+	}
+
+	validateImportRows(rows)
+
+	switch {
+	case stopOnError && hasImportStatus(rows, importInvalid):
+		skipImportRows(rows)
+	case dryRun:
+		if err := checkImportRows(r.Context(), rows); err != nil {
+			log.Ctx(r.Context()).Err(err).Msg("failed to check users to import")
+			writeError(w, r, &apiError{code: status.Code(err), message: "failed to list users"})
+			return
+		}
+	default:
+		createImportRows(r, rows, stopOnError)
+	}
+
+	report := &importReport{DryRun: dryRun, Summary: map[string]int{}, Rows: rows}
+	for _, row := range rows {
+		report.Summary[row.Status]++
+	}
+	log.Ctx(r.Context()).Info().Bool("dry_run", dryRun).Interface("summary", report.Summary).Msgf("imported %d users", len(rows))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("failed to write import users response")
+	}
+}
+
+// boolQueryParam parses a boolean query parameter, false when it is empty
+func boolQueryParam(v, name string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, &fieldError{field: name, rule: ruleInvalid, err: fmt.Errorf("invalid %s %q, must be true or false", name, v)}
+	}
+	return b, nil
+}
+
+// readImportRows reads the users of the body, a CSV file when the content type is text/csv, a JSON array otherwise
+func readImportRows(r *http.Request) ([]*importRow, error) {
+	mediaType := "application/json"
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			return nil, &fieldError{field: "body", rule: ruleInvalid, err: fmt.Errorf("invalid content type %q", ct)}
+		}
+	}
+
+	var rows []*importRow
+	var err error
+	switch mediaType {
+	case "text/csv":
+		rows, err = readCSVImportRows(r.Body)
+	case "application/json":
+		rows, err = readJSONImportRows(r.Body)
+	default:
+		return nil, &fieldError{field: "body", rule: ruleInvalid, err: fmt.Errorf("unsupported content type %q, must be text/csv or application/json", mediaType)}
+	}
+	if err != nil {
+		var fe *fieldError
+		if errors.As(err, &fe) {
+			return nil, err
+		}
+		return nil, &fieldError{field: "body", rule: ruleMalformed, err: err}
+	}
+
+	if len(rows) == 0 {
+		return nil, &fieldError{field: "body", rule: ruleRequired, err: fmt.Errorf("no users to import")}
+	}
+	if len(rows) > importMaxRows {
+		return nil, &fieldError{field: "body", rule: ruleMaxLength, err: fmt.Errorf("too many users to import, must be at most %d", importMaxRows)}
+	}
+	return rows, nil
+}
+
+// readCSVImportRows reads the users of a CSV file, the first line is the header with the email,
+// password and optional name columns
+func readCSVImportRows(body io.Reader) ([]*importRow, error) {
+	cr := csv.NewReader(body)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"email", "password"} {
+		if _, ok := columns[required]; !ok {
+			return nil, &fieldError{field: "body", rule: ruleRequired, err: fmt.Errorf("the CSV header has no %s column", required)}
+		}
+	}
+	nameColumn, hasName := columns["name"]
+
+	var rows []*importRow
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV: %w", err)
+		}
+
+		p := &api.Password{
+			Email: record[columns["email"]],
+			Hash:  []byte(record[columns["password"]]),
+		}
+		if hasName {
+			p.Username = record[nameColumn]
+		}
+		rows = append(rows, &importRow{Row: len(rows) + 1, password: p})
+	}
+}
+
+// readJSONImportRows reads the users of a JSON array of the bodies of the create user requests,
+// the elements that cannot be decoded are invalid rows
+func readJSONImportRows(body io.Reader) ([]*importRow, error) {
+	var elements []json.RawMessage
+	if err := json.NewDecoder(body).Decode(&elements); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON array: %w", err)
+	}
+
+	rows := make([]*importRow, 0, len(elements))
+	for i, e := range elements {
+		row := &importRow{Row: i + 1, password: &api.Password{}}
+		if err := marshaler.Unmarshal(e, row.password); err != nil {
+			row.Status, row.Field, row.Rule, row.Reason = importInvalid, "body", ruleMalformed, err.Error()
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// validateImportRows validates the rows like the create user requests, and the rows with the
+// email of a previous row are invalid
+func validateImportRows(rows []*importRow) {
+	seen := map[string]int{}
+	for _, row := range rows {
+		row.Email = strings.TrimSpace(row.password.GetEmail())
+		if row.Status != "" {
+			continue
+		}
+
+		if err := validateUserRequest(row.password); err != nil {
+			row.Status, row.Reason = importInvalid, err.Error()
+			var fe *fieldError
+			if errors.As(err, &fe) {
+				row.Field, row.Rule = fe.field, fe.rule
+			}
+			continue
+		}
+
+		// dex stores emails in lower case, so compare case-insensitively
+		email := strings.ToLower(row.Email)
+		if first, ok := seen[email]; ok {
+			row.Status, row.Field, row.Rule = importInvalid, "username", ruleDuplicate
+			row.Reason = fmt.Sprintf("username is the username of row %d", first)
+			continue
+		}
+		seen[email] = row.Row
+	}
+}
+
+func hasImportStatus(rows []*importRow, status string) bool {
+	for _, row := range rows {
+		if row.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// skipImportRows skips the valid rows, that are not created
+func skipImportRows(rows []*importRow) {
+	for _, row := range rows {
+		if row.Status == "" {
+			row.Status = importSkipped
+		}
+	}
+}
+
+// checkImportRows checks the valid rows against the existing users, without creating them
+func checkImportRows(ctx context.Context, rows []*importRow) error {
+	for _, row := range rows {
+		if row.Status != "" {
+			continue
+		}
+
+		p, err := findPassword(ctx, row.Email)
+		if err != nil {
+			return err
+		}
+		row.Status = importValid
+		if p != nil {
+			row.Status = importAlreadyExists
+		}
+	}
+	return nil
+}
+
+// createImportRows creates the users of the valid rows, importConcurrency at a time
+func createImportRows(r *http.Request, rows []*importRow, stopOnError bool) {
+	sem := make(chan struct{}, importConcurrency)
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+
+	for _, row := range rows {
+		if row.Status != "" {
+			continue
+		}
+
+		sem <- struct{}{}
+		if (stopOnError && failed.Load()) || r.Context().Err() != nil {
+			<-sem
+			row.Status = importSkipped
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			createImportRow(r.Context(), row)
+			if row.Status == importError {
+				failed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the audit events are recorded in the order of the rows
+	for _, row := range rows {
+		switch row.Status {
+		case importCreated, importAlreadyExists, importError:
+			auditImportRow(r, row)
+		}
+	}
+}
+
+// createImportRow creates the user of the row, with the create user request logic
+func createImportRow(ctx context.Context, row *importRow) {
+	if dexClient == nil {
+		row.Status, row.Reason = importError, "dex client is not initialized"
+		return
+	}
+
+	if err := prepareNewPassword(ctx, row.password); err != nil {
+		log.Ctx(ctx).Err(err).Msgf("failed to encrypt password of row %d", row.Row)
+		row.Status, row.Reason = importError, "failed to encrypt password"
+		return
+	}
+
+	resp, err := dexClient.CreatePassword(ctx, &api.CreatePasswordReq{Password: row.password})
+	switch {
+	case err != nil:
+		log.Ctx(ctx).Err(err).Msgf("failed to create user of row %d", row.Row)
+		row.Status, row.Reason = importError, status.Convert(err).Message()
+	case resp.GetAlreadyExists():
+		row.Status = importAlreadyExists
+	default:
+		row.Status = importCreated
+	}
+}
+
+// auditImportRow records the audit event of the user creation of the row, like the create user requests
+func auditImportRow(r *http.Request, row *importRow) {
+	if auditSink == nil {
+		return
+	}
+
+	e := newRequestAuditEvent(r, requestCreateUser)
+	e.Target = row.Email
+	e.Changes = []string{"username", "password"}
+	if strings.TrimSpace(row.password.GetUsername()) != "" {
+		e.Changes = append(e.Changes, "name")
+	}
+
+	switch row.Status {
+	case importCreated:
+		e.Outcome, e.Status = audit.OutcomeSuccess, http.StatusOK
+	case importAlreadyExists:
+		e.Outcome, e.Status = audit.OutcomeAlreadyExists, http.StatusConflict
+	default:
+		e.Outcome, e.Status = audit.OutcomeError, http.StatusInternalServerError
+	}
+
+	if err := auditSink.Emit(r.Context(), e); err != nil {
+		log.Ctx(r.Context()).Err(err).Msgf("failed to record audit event of row %d", row.Row)
+	}
+}
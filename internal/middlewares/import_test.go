@@ -0,0 +1,260 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/audit"
+)
+
+// importDexClient is a Dex client that creates the password records in memory
+type importDexClient struct {
+	fakeDexClient
+
+	mu      sync.Mutex
+	created []*api.Password
+
+	// failing are the emails of the users that Dex fails to create
+	failing map[string]bool
+}
+
+func (f *importDexClient) CreatePassword(_ context.Context, req *api.CreatePasswordReq, _ ...grpc.CallOption) (*api.CreatePasswordResp, error) {
+	if f.failing[req.Password.Email] {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range append(f.passwords, f.created...) {
+		if strings.EqualFold(p.Email, req.Password.Email) {
+			return &api.CreatePasswordResp{AlreadyExists: true}, nil
+		}
+	}
+	f.created = append(f.created, req.Password)
+	return &api.CreatePasswordResp{}, nil
+}
+
+// importUsers sends an import users request with the body and the query parameters, and returns its report
+func importUsers(t *testing.T, contentType, body string, q url.Values) (importReport, *httptest.ResponseRecorder) {
+	t.Helper()
+
+	mux := runtime.NewServeMux(append(ServeMuxOptions(), runtime.WithMiddlewares(passwordsCacheMiddleware))...)
+	require.NoError(t, RegisterHandlers(mux))
+
+	r := httptest.NewRequest(http.MethodPost, importUsersPath+"?"+q.Encode(), strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	var report importReport
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	}
+	return report, w
+}
+
+func rowStatuses(report importReport) []string {
+	var statuses []string
+	for _, row := range report.Rows {
+		statuses = append(statuses, row.Status)
+	}
+	return statuses
+}
+
+func Test_importUsersHandler(t *testing.T) {
+	const csvBody = `email,password,name
+jane@example.com,password123,Jane
+existing@example.com,password123,Existing
+ john@example.com ,short,John
+JANE@example.com,password123,Jane Again
+down@example.com,password123,Down
+`
+	const jsonBody = `[
+	{"email": "jane@example.com", "hash": "cGFzc3dvcmQxMjM=", "username": "Jane"},
+	{"email": "existing@example.com", "hash": "cGFzc3dvcmQxMjM=", "username": "Existing"},
+	{"email": "john@example.com", "hash": "c2hvcnQ=", "username": "John"},
+	{"email": "JANE@example.com", "hash": "cGFzc3dvcmQxMjM=", "username": "Jane Again"},
+	{"email": "down@example.com", "hash": "cGFzc3dvcmQxMjM=", "username": "Down"},
+	{"email": 42}
+]`
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		query       url.Values
+		expected    []string
+		created     []string
+	}{
+		{
+			name:        "csv",
+			contentType: "text/csv; charset=utf-8",
+			body:        csvBody,
+			expected:    []string{importCreated, importAlreadyExists, importInvalid, importInvalid, importError},
+			created:     []string{"jane@example.com"},
+		},
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        jsonBody,
+			expected:    []string{importCreated, importAlreadyExists, importInvalid, importInvalid, importError, importInvalid},
+			created:     []string{"jane@example.com"},
+		},
+		{
+			name:        "dry run",
+			contentType: "text/csv",
+			body:        csvBody,
+			query:       url.Values{"dryRun": {"true"}},
+			expected:    []string{importValid, importAlreadyExists, importInvalid, importInvalid, importValid},
+		},
+		{
+			name:        "stop on invalid rows",
+			contentType: "text/csv",
+			body:        csvBody,
+			query:       url.Values{"stopOnError": {"true"}},
+			expected:    []string{importSkipped, importSkipped, importInvalid, importInvalid, importSkipped},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			auditSink = sink
+			defer func() { auditSink = nil }()
+
+			fake := &importDexClient{
+				fakeDexClient: fakeDexClient{passwords: []*api.Password{{Email: "existing@example.com"}}},
+				failing:       map[string]bool{"down@example.com": true},
+			}
+			dexClient = fake
+
+			report, w := importUsers(t, tt.contentType, tt.body, tt.query)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, tt.expected, rowStatuses(report))
+			assert.Equal(t, tt.query.Get("dryRun") == "true", report.DryRun)
+			assert.NotContains(t, w.Body.String(), "password123")
+
+			var created []string
+			for _, p := range fake.created {
+				created = append(created, p.Email)
+				assert.Equal(t, "Jane", p.Username)
+				assert.NotEmpty(t, p.UserId)
+				assert.True(t, strings.HasPrefix(string(p.Hash), "$2a$"), "the password is hashed with bcrypt")
+			}
+			assert.Equal(t, tt.created, created)
+
+			// the rows that reached Dex are audited like the create user requests
+			var audited []audit.Outcome
+			for _, e := range sink.events {
+				assert.Equal(t, string(requestCreateUser), e.Operation)
+				audited = append(audited, e.Outcome)
+			}
+			if tt.created != nil {
+				assert.Equal(t, []audit.Outcome{audit.OutcomeSuccess, audit.OutcomeAlreadyExists, audit.OutcomeError}, audited)
+			} else {
+				assert.Empty(t, audited)
+			}
+		})
+	}
+}
+
+func Test_importUsersHandlerRowDetails(t *testing.T) {
+	dexClient = &importDexClient{}
+
+	body := "email,password\njane@example.com,password123\njohn@example.com,short\nJane@Example.com,password123\n"
+	report, w := importUsers(t, "text/csv", body, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, report.Rows, 3)
+
+	assert.Equal(t, &importRow{Row: 1, Email: "jane@example.com", Status: importCreated}, report.Rows[0])
+
+	assert.Equal(t, 2, report.Rows[1].Row)
+	assert.Equal(t, "password", report.Rows[1].Field)
+	assert.Equal(t, ruleMinLength, report.Rows[1].Rule)
+	assert.NotEmpty(t, report.Rows[1].Reason)
+
+	assert.Equal(t, "username", report.Rows[2].Field)
+	assert.Equal(t, ruleDuplicate, report.Rows[2].Rule)
+	assert.Equal(t, "username is the username of row 1", report.Rows[2].Reason)
+
+	assert.Equal(t, map[string]int{importCreated: 1, importInvalid: 2}, report.Summary)
+}
+
+func Test_importUsersHandlerStopOnCreationError(t *testing.T) {
+	importConcurrency = 1
+	defer func() { importConcurrency = DefaultImportConcurrency }()
+
+	fake := &importDexClient{failing: map[string]bool{"down@example.com": true}}
+	dexClient = fake
+
+	body := "email,password\njane@example.com,password123\ndown@example.com,password123\njohn@example.com,password123\n"
+	report, w := importUsers(t, "text/csv", body, url.Values{"stopOnError": {"true"}})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, []string{importCreated, importError, importSkipped}, rowStatuses(report))
+	assert.Equal(t, "connection refused", report.Rows[1].Reason)
+	require.Len(t, fake.created, 1)
+}
+
+func Test_importUsersHandlerInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		query       url.Values
+		field       string
+	}{
+		{name: "malformed json", contentType: "application/json", body: `{"email": "jane@example.com"}`, field: "body"},
+		{name: "empty array", contentType: "application/json", body: `[]`, field: "body"},
+		{name: "csv without password column", contentType: "text/csv", body: "email,name\njane@example.com,Jane\n", field: "body"},
+		{name: "ragged csv", contentType: "text/csv", body: "email,password\njane@example.com\n", field: "body"},
+		{name: "unsupported content type", contentType: "text/plain", body: "jane@example.com", field: "body"},
+		{name: "too many rows", contentType: "application/json", body: "[" + strings.Repeat("{},", importMaxRows) + "{}]", field: "body"},
+		{name: "invalid dry run", contentType: "application/json", body: `[{}]`, query: url.Values{"dryRun": {"maybe"}}, field: "dryRun"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &importDexClient{}
+			dexClient = fake
+
+			_, w := importUsers(t, tt.contentType, tt.body, tt.query)
+			require.Equal(t, http.StatusBadRequest, w.Code)
+
+			body := decodeErrorBody(t, w)
+			require.Len(t, body.Details, 2)
+			require.Len(t, body.Details[0].FieldViolations, 1)
+			assert.Equal(t, tt.field, body.Details[0].FieldViolations[0].Field)
+			assert.Empty(t, fake.created)
+		})
+	}
+}
+
+func Test_getRequestNameImportUsers(t *testing.T) {
+	mux := runtime.NewServeMux()
+	var name requestName
+	require.NoError(t, mux.HandlePath(http.MethodPost, importUsersPath, func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		pattern, ok := runtime.HTTPPattern(r.Context())
+		require.True(t, ok)
+		if isImportUsersRequest(r.Method, pattern.String()) {
+			name = requestImportUsers
+		}
+	}))
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, importUsersPath, nil))
+	assert.Equal(t, requestImportUsers, name)
+}
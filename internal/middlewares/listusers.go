@@ -0,0 +1,303 @@
+package middlewares
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/rs/zerolog/log"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+const (
+	// defaultPageSize is the number of users of a page when the page size is not set
+	defaultPageSize = 100
+
+	// maxPageSize is the maximum number of users of a page, the larger page sizes are lowered to it
+	maxPageSize = 1000
+)
+
+// Query parameters of the list users requests
+const (
+	paramPageSize  = "pageSize"
+	paramPageToken = "pageToken"
+	paramFilter    = "filter"
+	paramOrderBy   = "orderBy"
+)
+
+// listUsersOptionsKey is the key used to store the list users options in the request context
+type listUsersOptionsKey struct{}
+
+// listUsersOptions are the pagination, filtering and sorting of a list users request
+type listUsersOptions struct {
+	pageSize int
+	filter   userFilter
+	orderBy  userOrder
+	after    *pageToken
+
+	// filterParam and orderByParam are the query parameters of the filter and the order, set in the page tokens
+	filterParam  string
+	orderByParam string
+}
+
+// userFilter matches the users with a substring, or a prefix, of their email or name
+type userFilter struct {
+	// field is email or name, both of them are matched when empty
+	field string
+
+	// value is the lower case substring or prefix
+	value string
+
+	// prefix is whether the value is a prefix rather than a substring
+	prefix bool
+}
+
+// userOrder is the order of the users, by email or name, ascending or descending
+type userOrder struct {
+	field string
+	desc  bool
+}
+
+// pageToken is the cursor of the next page, the position of the last user of the previous page.
+// The filter and the order of the request are in the token, so that the next pages are listed the same way
+type pageToken struct {
+	Key     string `json:"k"`
+	Email   string `json:"e"`
+	Filter  string `json:"f,omitempty"`
+	OrderBy string `json:"o,omitempty"`
+}
+
+// usersPage is the response of the paginated list users requests
+type usersPage struct {
+	Users         []map[string]string `json:"users"`
+	NextPageToken string              `json:"nextPageToken"`
+	TotalSize     int                 `json:"totalSize"`
+}
+
+// listUsersMiddleware parses the pagination, filtering and sorting query parameters of the list users requests.
+// They are applied by userFieldsRewriter to the password records listed by Dex, the whole list is returned
+// like before when none of them is set.
+// This middleware is applied to list users requests only
+func listUsersMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		if getRequestName(r) != requestListUsers {
+			next(w, r, pathParams)
+			return
+		}
+
+		q := r.URL.Query()
+		if !q.Has(paramPageSize) && !q.Has(paramPageToken) && !q.Has(paramFilter) && !q.Has(paramOrderBy) {
+			next(w, r, pathParams)
+			return
+		}
+
+		opts, err := parseListUsersOptions(q)
+		if err != nil {
+			log.Ctx(r.Context()).Err(err).Msg("invalid list users parameters")
+			rejectInvalidRequest(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), listUsersOptionsKey{}, opts)
+		next(w, r.WithContext(ctx), pathParams)
+	}
+}
+
+// parseListUsersOptions parses the query parameters of a list users request
+func parseListUsersOptions(q url.Values) (*listUsersOptions, error) {
+	opts := &listUsersOptions{
+		pageSize:     defaultPageSize,
+		filterParam:  strings.TrimSpace(q.Get(paramFilter)),
+		orderByParam: strings.TrimSpace(q.Get(paramOrderBy)),
+	}
+
+	if v := q.Get(paramPageSize); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 0 {
+			return nil, &fieldError{field: paramPageSize, rule: ruleInvalid, err: fmt.Errorf("invalid %s %q, must be a positive number", paramPageSize, v)}
+		}
+		if size > 0 {
+			opts.pageSize = min(size, maxPageSize)
+		}
+	}
+
+	if opts.filterParam != "" {
+		f, err := parseUserFilter(opts.filterParam)
+		if err != nil {
+			return nil, &fieldError{field: paramFilter, rule: ruleInvalid, err: err}
+		}
+		opts.filter = f
+	}
+
+	o, err := parseUserOrder(opts.orderByParam)
+	if err != nil {
+		return nil, &fieldError{field: paramOrderBy, rule: ruleInvalid, err: err}
+	}
+	opts.orderBy = o
+
+	if v := q.Get(paramPageToken); v != "" {
+		token, err := decodePageToken(v)
+		if err != nil {
+			return nil, &fieldError{field: paramPageToken, rule: ruleInvalid, err: err}
+		}
+		if token.Filter != opts.filterParam || token.OrderBy != opts.orderByParam {
+			return nil, &fieldError{field: paramPageToken, rule: ruleInvalid, err: fmt.Errorf("invalid %s, the %s and %s must be the ones of the previous page", paramPageToken, paramFilter, paramOrderBy)}
+		}
+		opts.after = token
+	}
+
+	return opts, nil
+}
+
+// parseUserFilter parses a filter of the users, a substring of their email or name, e.g. jane,
+// a prefix when it ends with *, e.g. jane*, and only on the email or name when it starts with
+// email: or name:, e.g. email:jane*
+func parseUserFilter(s string) (userFilter, error) {
+	var f userFilter
+	if field, value, ok := strings.Cut(s, ":"); ok && (field == "email" || field == "name") {
+		f.field = field
+		s = value
+	}
+
+	f.value, f.prefix = strings.CutSuffix(strings.ToLower(strings.TrimSpace(s)), "*")
+	if f.value == "" {
+		return f, fmt.Errorf("invalid %s %q, the value to match is empty", paramFilter, s)
+	}
+	return f, nil
+}
+
+// parseUserOrder parses the order of the users, email or name, followed by desc for the descending order
+// The users are sorted by email when it is empty
+func parseUserOrder(s string) (userOrder, error) {
+	fields := strings.Fields(s)
+	o := userOrder{field: "email"}
+	if len(fields) == 0 {
+		return o, nil
+	}
+
+	if len(fields) > 2 || (fields[0] != "email" && fields[0] != "name") {
+		return o, fmt.Errorf("invalid %s %q, must be email or name, optionally followed by asc or desc", paramOrderBy, s)
+	}
+	o.field = fields[0]
+
+	if len(fields) == 2 {
+		switch fields[1] {
+		case "asc":
+		case "desc":
+			o.desc = true
+		default:
+			return o, fmt.Errorf("invalid %s %q, must be email or name, optionally followed by asc or desc", paramOrderBy, s)
+		}
+	}
+	return o, nil
+}
+
+func encodePageToken(t *pageToken) string {
+	b, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePageToken(s string) (*pageToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s", paramPageToken)
+	}
+
+	var t pageToken
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("invalid %s", paramPageToken)
+	}
+	return &t, nil
+}
+
+// match returns whether the user matches the filter
+func (f userFilter) match(p *api.Password) bool {
+	if f.value == "" {
+		return true
+	}
+
+	matches := func(v string) bool {
+		v = strings.ToLower(v)
+		if f.prefix {
+			return strings.HasPrefix(v, f.value)
+		}
+		return strings.Contains(v, f.value)
+	}
+
+	switch f.field {
+	case "email":
+		return matches(p.GetEmail())
+	case "name":
+		return matches(p.GetUsername())
+	default:
+		return matches(p.GetEmail()) || matches(p.GetUsername())
+	}
+}
+
+// key returns the sort key of the user, the email is the tie breaker of the names
+func (o userOrder) key(p *api.Password) pageToken {
+	key := p.GetEmail()
+	if o.field == "name" {
+		key = p.GetUsername()
+	}
+	return pageToken{Key: strings.ToLower(key), Email: strings.ToLower(p.GetEmail())}
+}
+
+// compare compares the sort keys of two users in the order
+func (o userOrder) compare(a, b pageToken) int {
+	c := cmp.Or(cmp.Compare(a.Key, b.Key), cmp.Compare(a.Email, b.Email))
+	if o.desc {
+		return -c
+	}
+	return c
+}
+
+// apply filters, sorts and pages the password records, and returns the page of the options,
+// the token of the next page, empty on the last page, and the number of users matching the filter
+func (opts *listUsersOptions) apply(passwords []*api.Password) ([]*api.Password, string, int) {
+	matched := make([]*api.Password, 0, len(passwords))
+	for _, p := range passwords {
+		if opts.filter.match(p) {
+			matched = append(matched, p)
+		}
+	}
+
+	slices.SortFunc(matched, func(a, b *api.Password) int {
+		return opts.orderBy.compare(opts.orderBy.key(a), opts.orderBy.key(b))
+	})
+
+	// the page starts after the last user of the previous page, even when it was deleted since then
+	start := 0
+	if opts.after != nil {
+		after := pageToken{Key: opts.after.Key, Email: opts.after.Email}
+		start, _ = slices.BinarySearchFunc(matched, after, func(p *api.Password, t pageToken) int {
+			c := opts.orderBy.compare(opts.orderBy.key(p), t)
+			if c == 0 {
+				// the last user of the previous page is before the page
+				return -1
+			}
+			return c
+		})
+	}
+
+	end := min(start+opts.pageSize, len(matched))
+	page := matched[start:end]
+
+	next := ""
+	if end < len(matched) {
+		last := opts.orderBy.key(page[len(page)-1])
+		last.Filter = opts.filterParam
+		last.OrderBy = opts.orderByParam
+		next = encodePageToken(&last)
+	}
+	return page, next, len(matched)
+}
@@ -0,0 +1,203 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+var listedPasswords = []*api.Password{
+	{Email: "carol@example.com", Username: "Carol", UserId: "3"},
+	{Email: "alice@example.com", Username: "Zoe Alice", UserId: "1"},
+	{Email: "eve@example.org", Username: "Eve", UserId: "5"},
+	{Email: "bob@example.com", Username: "Bob", UserId: "2"},
+	{Email: "dave@example.org", Username: "Dave Jones", UserId: "4"},
+}
+
+// newListUsersMux returns a gateway mux listing the password records, with the list users middleware
+func newListUsersMux(t *testing.T, passwords []*api.Password) *runtime.ServeMux {
+	t.Helper()
+	requestPatternGetter = mockedRequestPatternGetter("/v1/users")
+
+	mux := runtime.NewServeMux(append(ServeMuxOptions(), runtime.WithMiddlewares(listUsersMiddleware))...)
+	require.NoError(t, api.RegisterDexHandlerServer(context.Background(), mux, &passwordsDexServer{passwords: passwords}))
+	return mux
+}
+
+// listUsersPage lists a page of users with the query parameters
+func listUsersPage(t *testing.T, mux *runtime.ServeMux, q url.Values) (usersPage, *httptest.ResponseRecorder) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/users?"+q.Encode(), nil))
+
+	var page usersPage
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	}
+	return page, w
+}
+
+func pageEmails(page usersPage) []string {
+	var emails []string
+	for _, u := range page.Users {
+		emails = append(emails, u["email"])
+	}
+	return emails
+}
+
+func Test_listUsersMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    url.Values
+		expected []string
+	}{
+		{
+			name:     "sorted by email",
+			query:    url.Values{"pageSize": {"10"}},
+			expected: []string{"alice@example.com", "bob@example.com", "carol@example.com", "dave@example.org", "eve@example.org"},
+		},
+		{
+			name:     "sorted by name descending",
+			query:    url.Values{"orderBy": {"name desc"}},
+			expected: []string{"alice@example.com", "eve@example.org", "dave@example.org", "carol@example.com", "bob@example.com"},
+		},
+		{
+			name:     "substring of the email or the name",
+			query:    url.Values{"filter": {"ALICE"}},
+			expected: []string{"alice@example.com"},
+		},
+		{
+			name:     "substring of the email",
+			query:    url.Values{"filter": {"email:example.org"}},
+			expected: []string{"dave@example.org", "eve@example.org"},
+		},
+		{
+			name:     "prefix of the name",
+			query:    url.Values{"filter": {"name:Da*"}},
+			expected: []string{"dave@example.org"},
+		},
+		{
+			name:     "no match",
+			query:    url.Values{"filter": {"mallory"}},
+			expected: nil,
+		},
+	}
+
+	mux := newListUsersMux(t, listedPasswords)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, w := listUsersPage(t, mux, tt.query)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			assert.Equal(t, tt.expected, pageEmails(page))
+			assert.Equal(t, len(tt.expected), page.TotalSize)
+			assert.Empty(t, page.NextPageToken)
+			assert.NotContains(t, w.Body.String(), "hash")
+		})
+	}
+}
+
+func Test_listUsersMiddlewarePages(t *testing.T) {
+	mux := newListUsersMux(t, listedPasswords)
+
+	q := url.Values{"pageSize": {"2"}, "filter": {"example"}, "orderBy": {"name"}}
+	var pages [][]string
+	for {
+		page, w := listUsersPage(t, mux, q)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, len(listedPasswords), page.TotalSize)
+
+		pages = append(pages, pageEmails(page))
+		if page.NextPageToken == "" {
+			break
+		}
+		q.Set("pageToken", page.NextPageToken)
+	}
+
+	assert.Equal(t, [][]string{
+		{"bob@example.com", "carol@example.com"},
+		{"dave@example.org", "eve@example.org"},
+		{"alice@example.com"},
+	}, pages)
+}
+
+func Test_listUsersOptionsApplyAfterDeletion(t *testing.T) {
+	opts, err := parseListUsersOptions(url.Values{"pageSize": {"2"}})
+	require.NoError(t, err)
+
+	page, next, _ := opts.apply(listedPasswords)
+	require.Len(t, page, 2)
+	require.NotEmpty(t, next)
+
+	// the last user of the page is deleted before the next page is listed
+	var remaining []*api.Password
+	for _, p := range listedPasswords {
+		if p.Email != "bob@example.com" {
+			remaining = append(remaining, p)
+		}
+	}
+
+	opts, err = parseListUsersOptions(url.Values{"pageSize": {"2"}, "pageToken": {next}})
+	require.NoError(t, err)
+
+	page, _, total := opts.apply(remaining)
+	assert.Equal(t, 4, total)
+	require.Len(t, page, 2)
+	assert.Equal(t, "carol@example.com", page[0].Email)
+	assert.Equal(t, "dave@example.org", page[1].Email)
+}
+
+func Test_listUsersMiddlewareWithoutParameters(t *testing.T) {
+	mux := newListUsersMux(t, listedPasswords)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/users", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the whole list is returned in the order of Dex, like before
+	var users []map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &users))
+	require.Len(t, users, len(listedPasswords))
+	assert.Equal(t, "carol@example.com", users[0]["email"])
+}
+
+func Test_listUsersMiddlewareInvalidParameters(t *testing.T) {
+	token := encodePageToken(&pageToken{Key: "bob@example.com", Email: "bob@example.com", Filter: "example"})
+
+	tests := []struct {
+		name  string
+		query url.Values
+		field string
+	}{
+		{name: "negative page size", query: url.Values{"pageSize": {"-1"}}, field: "pageSize"},
+		{name: "page size not a number", query: url.Values{"pageSize": {"ten"}}, field: "pageSize"},
+		{name: "unknown order", query: url.Values{"orderBy": {"age"}}, field: "orderBy"},
+		{name: "unknown direction", query: url.Values{"orderBy": {"name up"}}, field: "orderBy"},
+		{name: "empty filter", query: url.Values{"filter": {"name:*"}}, field: "filter"},
+		{name: "malformed page token", query: url.Values{"pageToken": {"not a token"}}, field: "pageToken"},
+		{name: "page token of another filter", query: url.Values{"pageToken": {token}, "filter": {"other"}}, field: "pageToken"},
+	}
+
+	mux := newListUsersMux(t, listedPasswords)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, w := listUsersPage(t, mux, tt.query)
+			require.Equal(t, http.StatusBadRequest, w.Code)
+
+			body := decodeErrorBody(t, w)
+			require.Len(t, body.Details, 2)
+			require.Len(t, body.Details[0].FieldViolations, 1)
+			assert.Equal(t, tt.field, body.Details[0].FieldViolations[0].Field)
+		})
+	}
+}
@@ -1,39 +1,293 @@
 package middlewares
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/audit"
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
+	"github.com/mirantiscontainers/dex-http-server/internal/passwordpolicy"
+	"github.com/mirantiscontainers/dex-http-server/internal/tracing"
 )
 
+// dexClient is the gRPC client of the Dex API, used by the middlewares that need
+// to look up data in Dex before the request is forwarded
+var dexClient api.DexClient
+
+// Config contains the settings of the middlewares
+type Config struct {
+	// DexClient is the gRPC client of the Dex API
+	DexClient api.DexClient
+
+	// OIDC contains the settings used to authenticate the requests
+	OIDC OIDCConfig
+
+	// Authz contains the settings used to authorize the requests
+	Authz AuthzConfig
+
+	// Audit is the sink of the audit events of the user-management mutations, they are not recorded when nil
+	Audit audit.Sink
+
+	// LegacyResultFlags answers the already_exists and not_found results of Dex with 200 and the flag
+	// in the body, for the callers of the previous versions, instead of 409 and 404
+	LegacyResultFlags bool
+
+	// UserFields are the fields of the password records exposed by the list and get users responses,
+	// among email, username and user_id, DefaultUserFields when empty. The hash is never exposed
+	UserFields []string
+
+	// ImportConcurrency is the number of users created at the same time by each import of users,
+	// DefaultImportConcurrency when not positive
+	ImportConcurrency int
+
+	// PasswordPolicy is the policy the new passwords must comply with, the default policy when nil
+	PasswordPolicy *passwordpolicy.Policy
+
+	// BulkWriteTimeout is the write timeout of the responses of the imports, exports and backups of
+	// users, that can take longer than the write timeout of the server, DefaultBulkWriteTimeout when not positive
+	BulkWriteTimeout time.Duration
+}
+
+// DefaultBulkWriteTimeout is the default write timeout of the responses of the imports, exports and backups
+const DefaultBulkWriteTimeout = 10 * time.Minute
+
+// bulkWriteTimeout is the write timeout of the responses of the imports, exports and backups
+var bulkWriteTimeout = DefaultBulkWriteTimeout
+
 // GetMiddlewares returns the list of middlewares to be applied to the request
-func GetMiddlewares() []runtime.Middleware {
+func GetMiddlewares(cfg Config) ([]runtime.Middleware, error) {
+	dexClient = cfg.DexClient
+	auditSink = cfg.Audit
+	resultFlagsAsStatus = !cfg.LegacyResultFlags
+
+	passwordPolicy = cfg.PasswordPolicy
+	if passwordPolicy == nil {
+		passwordPolicy = passwordpolicy.Default()
+	}
+
+	importConcurrency = DefaultImportConcurrency
+	if cfg.ImportConcurrency > 0 {
+		importConcurrency = cfg.ImportConcurrency
+	}
+
+	bulkWriteTimeout = DefaultBulkWriteTimeout
+	if cfg.BulkWriteTimeout > 0 {
+		bulkWriteTimeout = cfg.BulkWriteTimeout
+	}
+
+	if err := setUserFields(cfg.UserFields); err != nil {
+		return nil, fmt.Errorf("invalid user fields: %w", err)
+	}
+
+	authn, err := authenticationMiddleware(cfg.OIDC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize authentication middleware: %w", err)
+	}
+
+	authz, err := authorizationMiddleware(cfg.Authz)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize authorization middleware: %w", err)
+	}
+
 	// List of middlewares
 	// Order of middlewares is important
 	// Middlewares are applied in the order they are added in the list
-	mws := []runtime.Middleware{
-		loggingMiddleware,
+	named := []namedMiddleware{
+		{"request_id", requestIDMiddleware},
+		{"metrics", metricsMiddleware},
+		{"logging", loggingMiddleware},
+		{"passwords_cache", passwordsCacheMiddleware},
 
-		// auth middlewares
-		authenticationMiddleware(),
-		authorizationMiddleware(),
+		// auth middlewares, the audit middleware is between them to record the denied requests
+		{"authentication", authn},
+		{"audit", auditMiddleware},
+		{"authorization", authz},
 
 		// validation middlewares
-		validationMiddleware,
+		{"validation", validationMiddleware},
+		{"list_users", listUsersMiddleware},
 
 		// user create/update interceptor middlewares
-		createUserMiddleware,
-		updateUserMiddleware,
+		{"create_user", createUserMiddleware},
+		{"update_user", updateUserMiddleware},
+
+		// client create interceptor middlewares
+		{"create_client", createClientMiddleware},
+
+		// sessions interceptor middlewares
+		{"sessions", sessionsMiddleware},
+	}
+
+	// the server span is started first, and each middleware has its own span
+	mws := []runtime.Middleware{tracingMiddleware}
+	for _, mw := range named {
+		mws = append(mws, traceMiddleware(mw.name, mw.middleware))
 	}
-	return mws
+	return mws, nil
+}
+
+// ServeMuxOptions returns the options of the gateway mux used by the middlewares
+func ServeMuxOptions() []runtime.ServeMuxOption {
+	return []runtime.ServeMuxOption{
+		// the outcome of the audit event is set before the result flags are turned into errors
+		runtime.WithForwardResponseOption(auditResponse),
+		runtime.WithForwardResponseOption(resultFlagsResponse),
+		runtime.WithForwardResponseRewriter(userFieldsRewriter),
+		runtime.WithErrorHandler(errorHandler),
+	}
+}
 
+// namedMiddleware is a middleware with the name of its span
+type namedMiddleware struct {
+	name       string
+	middleware runtime.Middleware
 }
 
-// loggingMiddleware logs the request method and path
+// loggingMiddleware writes the access log of the request, once the response is written
 func loggingMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		log.Info().Msgf("%s %s", r.Method, r.URL.Path)
-		next(w, r, pathParams)
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r, pathParams)
+
+		// the request-scoped logger has the actor once the request is authenticated
+		l := log.Ctx(r.Context())
+		e := l.Info()
+		if rec.status >= http.StatusInternalServerError {
+			e = l.Error()
+		}
+		e.Str("path", r.URL.Path).
+			Int("status", rec.status).
+			Dur("latency", time.Since(start)).
+			Int("size", rec.size).
+			Str("remote_addr", r.RemoteAddr).
+			Str("user_agent", r.UserAgent()).
+			Msgf("%s %s %d", r.Method, r.URL.Path, rec.status)
+	}
+}
+
+// metricsMiddleware records the count and the latency of the requests, by gateway pattern
+func metricsMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		pattern, err := requestPatternGetter(r)
+		if err != nil {
+			pattern = "unknown"
+		}
+
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r, pathParams)
+
+		metrics.HTTPRequestDuration.WithLabelValues(pattern, r.Method).Observe(time.Since(start).Seconds())
+		metrics.HTTPRequests.WithLabelValues(pattern, r.Method, strconv.Itoa(rec.status)).Inc()
+	}
+}
+
+// tracingMiddleware starts the server span of the request, child of the trace context of the request headers
+// The span context is passed to the next handlers in the request context, and propagated to Dex by the gRPC client
+func tracingMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		pattern, err := requestPatternGetter(r)
+		if err != nil {
+			pattern = "unknown"
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Start(ctx, fmt.Sprintf("%s %s", r.Method, pattern),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(pattern),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r.WithContext(ctx), pathParams)
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	}
+}
+
+// traceMiddleware wraps the middleware in a span named after it. The span ends when the middleware
+// calls the next handler, or returns without calling it, so that it only measures the middleware
+func traceMiddleware(name string, mw runtime.Middleware) runtime.Middleware {
+	return func(next runtime.HandlerFunc) runtime.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+			parent := trace.SpanFromContext(r.Context())
+			ctx, span := tracing.Start(r.Context(), "middleware "+name)
+
+			forwarded := false
+			defer func() {
+				if !forwarded {
+					span.SetAttributes(attribute.Bool("middleware.forwarded", false))
+					span.End()
+				}
+			}()
+
+			// the middlewares are built for each request, to end the span of this request in the next handler
+			mw(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+				forwarded = true
+				span.End()
+
+				// the next handlers are children of the parent span, not of the ended one
+				next(w, r.WithContext(trace.ContextWithSpan(r.Context(), parent)), pathParams)
+			})(w, r.WithContext(ctx), pathParams)
+		}
+	}
+}
+
+// responseRecorder records the status code and the size of the response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// Flush implements http.Flusher, the gateway flushes the streamed responses
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// extendWriteDeadline sets the write deadline of the response of the bulk requests to the bulk write
+// timeout, so that the imports, exports and backups of many users are not cut off by the write
+// timeout of the server
+func extendWriteDeadline(w http.ResponseWriter, r *http.Request) {
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(bulkWriteTimeout)); err != nil {
+		log.Ctx(r.Context()).Debug().Err(err).Msg("failed to extend the write deadline of the response")
 	}
 }
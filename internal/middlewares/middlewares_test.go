@@ -0,0 +1,184 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
+)
+
+func Test_metricsMiddleware(t *testing.T) {
+	requestPatternGetter = mockedRequestPatternGetter("/v1/users/{email=*}")
+
+	requests := metrics.HTTPRequests.WithLabelValues("/v1/users/{email=*}", http.MethodDelete, "404")
+	before := testutil.ToFloat64(requests)
+
+	handler := metricsMiddleware(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodDelete, "/v1/users/jane@example.com", nil), nil)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, before+1, testutil.ToFloat64(requests))
+}
+
+func Test_authenticationFailureMetrics(t *testing.T) {
+	authn, err := authenticationMiddleware(OIDCConfig{IssuerURL: "http://127.0.0.1:1/dex", ClientIDs: []string{"mke-dashboard"}})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		header string
+		reason string
+	}{
+		{name: "no authorization header", header: "", reason: "missing_token"},
+		{name: "not a bearer token", header: "Basic amFuZTpzZWNyZXQ=", reason: "malformed_header"},
+		{name: "invalid token", header: "Bearer not-a-jwt", reason: "invalid_token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failures := metrics.Authentications.WithLabelValues("failure", tt.reason)
+			before := testutil.ToFloat64(failures)
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			authn(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+				t.Fatal("next handler must not be called")
+			})(w, r, nil)
+
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Equal(t, before+1, testutil.ToFloat64(failures))
+		})
+	}
+}
+
+func Test_validationRejectionMetrics(t *testing.T) {
+	requestPatternGetter = mockedRequestPatternGetter("/v1/users")
+
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{name: "invalid username", body: `{"email": "a", "hash": "password123"}`, field: "username"},
+		{name: "invalid password", body: `{"email": "jane@example.com", "hash": "c2hvcnQ="}`, field: "password"},
+		{name: "invalid body", body: `{"email": `, field: "body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rejections := metrics.ValidationRejections.WithLabelValues(tt.field)
+			before := testutil.ToFloat64(rejections)
+
+			w := httptest.NewRecorder()
+			validationMiddleware(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+				t.Fatal("next handler must not be called")
+			})(w, httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(tt.body)), nil)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Equal(t, before+1, testutil.ToFloat64(rejections))
+		})
+	}
+}
+
+func Test_tracingMiddlewares(t *testing.T) {
+	requestPatternGetter = mockedRequestPatternGetter("/v1/users")
+
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	forward := func(next runtime.HandlerFunc) runtime.HandlerFunc { return next }
+	reject := func(next runtime.HandlerFunc) runtime.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+	}
+
+	var handler runtime.HandlerFunc = func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		t.Fatal("next handler must not be called")
+	}
+	for _, mw := range []runtime.Middleware{traceMiddleware("reject", reject), traceMiddleware("forward", forward), tracingMiddleware} {
+		handler = mw(handler)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/users", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	handler(w, r, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	forwarded, rejected, server := spans[0], spans[1], spans[2]
+
+	// the server span continues the trace of the request
+	assert.Equal(t, "POST /v1/users", server.Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent.SpanID().String())
+	assert.Contains(t, server.Attributes, attribute.Int("http.response.status_code", http.StatusForbidden))
+
+	// the spans of the middlewares are siblings, children of the server span
+	assert.Equal(t, "middleware forward", forwarded.Name)
+	assert.Equal(t, server.SpanContext.SpanID(), forwarded.Parent.SpanID())
+	assert.Equal(t, "middleware reject", rejected.Name)
+	assert.Equal(t, server.SpanContext.SpanID(), rejected.Parent.SpanID())
+	assert.Contains(t, rejected.Attributes, attribute.Bool("middleware.forwarded", false))
+}
+
+func Test_extendWriteDeadline(t *testing.T) {
+	bulkWriteTimeout = time.Minute
+	defer func() { bulkWriteTimeout = DefaultBulkWriteTimeout }()
+
+	tests := []struct {
+		name   string
+		extend bool
+		cutOff bool
+	}{
+		{name: "cut off by the write timeout of the server", cutOff: true},
+		{name: "extended deadline", extend: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.extend {
+					extendWriteDeadline(&responseRecorder{ResponseWriter: w}, r)
+				}
+				time.Sleep(200 * time.Millisecond)
+				_, _ = w.Write([]byte("ok"))
+			}))
+			srv.Config.WriteTimeout = 50 * time.Millisecond
+			srv.Start()
+			defer srv.Close()
+
+			resp, err := srv.Client().Get(srv.URL)
+			if tt.cutOff {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+// passwordsCacheKey is the key used to store the cache of the password records in the request context
+type passwordsCacheKey struct{}
+
+// passwordsCache is the cache of the password records of a request, so that Dex is called once per request
+type passwordsCache struct {
+	once      sync.Once
+	passwords []*api.Password
+	err       error
+}
+
+// passwordsCacheMiddleware puts an empty cache of the password records in the request context
+// The records are listed from Dex on first use, and never shared between requests
+func passwordsCacheMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		ctx := context.WithValue(r.Context(), passwordsCacheKey{}, &passwordsCache{})
+		next(w, r.WithContext(ctx), pathParams)
+	}
+}
+
+// listPasswords returns the password records of Dex, from the cache of the request when there is one
+func listPasswords(ctx context.Context) ([]*api.Password, error) {
+	c, ok := ctx.Value(passwordsCacheKey{}).(*passwordsCache)
+	if !ok {
+		return listDexPasswords(ctx)
+	}
+
+	c.once.Do(func() {
+		c.passwords, c.err = listDexPasswords(ctx)
+	})
+	return c.passwords, c.err
+}
+
+func listDexPasswords(ctx context.Context) ([]*api.Password, error) {
+	if dexClient == nil {
+		return nil, fmt.Errorf("dex client is not initialized")
+	}
+
+	resp, err := dexClient.ListPasswords(ctx, &api.ListPasswordReq{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list passwords: %w", err)
+	}
+	return resp.GetPasswords(), nil
+}
+
+// findPassword returns the password record with the provided email, or nil when there is none
+func findPassword(ctx context.Context, email string) (*api.Password, error) {
+	passwords, err := listPasswords(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range passwords {
+		// dex stores emails in lower case, so compare case-insensitively
+		if strings.EqualFold(p.GetEmail(), email) {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
@@ -12,10 +12,42 @@ import (
 type requestName string
 
 var (
-	requestCreateUser requestName = "CreateUser"
-	requestUpdateUser requestName = "UpdateUser"
+	requestCreateUser     requestName = "CreateUser"
+	requestUpdateUser     requestName = "UpdateUser"
+	requestDeleteUser     requestName = "DeleteUser"
+	requestGetUser        requestName = "GetUser"
+	requestListUsers      requestName = "ListUsers"
+	requestImportUsers    requestName = "ImportUsers"
+	requestExportUsers    requestName = "ExportUsers"
+	requestBackupUsers    requestName = "BackupUsers"
+	requestVerifyPassword requestName = "VerifyPassword"
+
+	requestCreateClient requestName = "CreateClient"
+	requestUpdateClient requestName = "UpdateClient"
+	requestDeleteClient requestName = "DeleteClient"
+
+	requestListSessions  requestName = "ListSessions"
+	requestRevokeSession requestName = "RevokeSession"
 )
 
+// knownRequestNames is the list of all the request names, i.e. the operations of the API
+var knownRequestNames = []requestName{
+	requestCreateUser,
+	requestUpdateUser,
+	requestDeleteUser,
+	requestGetUser,
+	requestListUsers,
+	requestImportUsers,
+	requestExportUsers,
+	requestBackupUsers,
+	requestVerifyPassword,
+	requestCreateClient,
+	requestUpdateClient,
+	requestDeleteClient,
+	requestListSessions,
+	requestRevokeSession,
+}
+
 // requestPatternGetter is a function that extracts the path pattern from the request
 // The function is defined as a variable so that it can be mocked in tests
 var requestPatternGetter = func(r *http.Request) (string, error) {
@@ -32,10 +64,11 @@ var requestPatternGetter = func(r *http.Request) (string, error) {
 //
 //	if the request is a POST to /users, the name will be CreateUser
 //	if the request is a PUT to /users/{email=*}, the name will be UpdateUser
+//	if the request is a POST to /clients, the name will be CreateClient
 func getRequestName(r *http.Request) requestName {
 	pattern, err := requestPatternGetter(r)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to get request name")
+		log.Ctx(r.Context()).Error().Err(err).Msg("failed to get request name")
 		return ""
 	}
 
@@ -47,6 +80,54 @@ func getRequestName(r *http.Request) requestName {
 		return requestUpdateUser
 	}
 
+	if isDeleteUserRequest(r.Method, pattern) {
+		return requestDeleteUser
+	}
+
+	if isGetUserRequest(r.Method, pattern) {
+		return requestGetUser
+	}
+
+	if isListUsersRequest(r.Method, pattern) {
+		return requestListUsers
+	}
+
+	if isImportUsersRequest(r.Method, pattern) {
+		return requestImportUsers
+	}
+
+	if isExportUsersRequest(r.Method, pattern) {
+		return requestExportUsers
+	}
+
+	if isBackupUsersRequest(r.Method, pattern) {
+		return requestBackupUsers
+	}
+
+	if isVerifyPasswordRequest(r.Method, pattern) {
+		return requestVerifyPassword
+	}
+
+	if isCreateClientRequest(r.Method, pattern) {
+		return requestCreateClient
+	}
+
+	if isUpdateClientRequest(r.Method, pattern) {
+		return requestUpdateClient
+	}
+
+	if isDeleteClientRequest(r.Method, pattern) {
+		return requestDeleteClient
+	}
+
+	if isListSessionsRequest(r.Method, pattern) {
+		return requestListSessions
+	}
+
+	if isRevokeSessionRequest(r.Method, pattern) {
+		return requestRevokeSession
+	}
+
 	return ""
 }
 
@@ -61,3 +142,75 @@ func isUpdateUserRequest(method, pattern string) bool {
 	log.Debug().Msgf("checking if request is update user request with method=%s, pattern=%s, result=%v", method, pattern, result)
 	return result
 }
+
+func isDeleteUserRequest(method, pattern string) bool {
+	result := method == http.MethodDelete && strings.HasSuffix(pattern, "/users/{email=*}")
+	log.Debug().Msgf("checking if request is delete user request with method=%s, pattern=%s, result=%v", method, pattern, result)
+	return result
+}
+
+func isGetUserRequest(method, pattern string) bool {
+	result := method == http.MethodGet && strings.HasSuffix(pattern, "/users/{email=*}")
+	log.Debug().Msgf("checking if request is get user request with method=%s, pattern=%s, result=%v", method, pattern, result)
+	return result
+}
+
+func isListUsersRequest(method, pattern string) bool {
+	result := method == http.MethodGet && strings.HasSuffix(pattern, "/users")
+	log.Debug().Msgf("checking if request is list users request with method=%s, pattern=%s, result=%v", method, pattern, result)
+	return result
+}
+
+func isImportUsersRequest(method, pattern string) bool {
+	result := method == http.MethodPost && strings.HasSuffix(pattern, "/users:import")
+	log.Debug().Msgf("checking if request is import users request with method=%s, pattern=%s, result=%v", method, pattern, result)
+	return result
+}
+
+func isExportUsersRequest(method, pattern string) bool {
+	result := method == http.MethodGet && strings.HasSuffix(pattern, "/users:export")
+	log.Debug().Msgf("checking if request is export users request with method=%s, pattern=%s, result=%v", method, pattern, result)
+	return result
+}
+
+func isBackupUsersRequest(method, pattern string) bool {
+	result := method == http.MethodPost && strings.HasSuffix(pattern, "/users:backup")
+	log.Debug().Msgf("checking if request is backup users request with method=%s, pattern=%s, result=%v", method, pattern, result)
+	return result
+}
+
+func isVerifyPasswordRequest(method, pattern string) bool {
+	result := method == http.MethodPost && strings.HasSuffix(pattern, "/users/verify")
+	log.Debug().Msgf("checking if request is verify password request with method=%s, pattern=%s, result=%v", method, pattern, result)
+	return result
+}
+
+func isCreateClientRequest(method, pattern string) bool {
+	result := method == http.MethodPost && strings.HasSuffix(pattern, "/clients")
+	log.Debug().Msgf("checking if request is create client request with method=%s, pattern=%s, result=%v", method, pattern, result)
+	return result
+}
+
+func isListSessionsRequest(method, pattern string) bool {
+	result := method == http.MethodGet && strings.HasSuffix(pattern, "/users/{user_id=*}/sessions")
+	log.Debug().Msgf("checking if request is list sessions request with method=%s, pattern=%s, result=%v", method, pattern, result)
+	return result
+}
+
+func isRevokeSessionRequest(method, pattern string) bool {
+	result := method == http.MethodDelete && strings.HasSuffix(pattern, "/users/{user_id=*}/sessions/{client_id=*}")
+	log.Debug().Msgf("checking if request is revoke session request with method=%s, pattern=%s, result=%v", method, pattern, result)
+	return result
+}
+
+func isUpdateClientRequest(method, pattern string) bool {
+	result := method == http.MethodPut && strings.HasSuffix(pattern, "/clients/{id=*}")
+	log.Debug().Msgf("checking if request is update client request with method=%s, pattern=%s, result=%v", method, pattern, result)
+	return result
+}
+
+func isDeleteClientRequest(method, pattern string) bool {
+	result := method == http.MethodDelete && strings.HasSuffix(pattern, "/clients/{id=*}")
+	log.Debug().Msgf("checking if request is delete client request with method=%s, pattern=%s, result=%v", method, pattern, result)
+	return result
+}
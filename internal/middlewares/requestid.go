@@ -0,0 +1,101 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// requestIDHeader is the header of the request id, set in the requests by the clients
+	// or the proxies, and in the responses
+	requestIDHeader = "X-Request-Id"
+
+	// requestIDMetadata is the gRPC metadata of the request id, in the calls to Dex
+	requestIDMetadata = "x-request-id"
+
+	// requestIDMaxLen is the maximum length of the request ids set by the clients
+	requestIDMaxLen = 128
+)
+
+// requestIDKey is the key used to store the request id in the request context
+type requestIDKey struct{}
+
+// requestLoggerKey is the key used to store the request-scoped logger in the request context,
+// in addition to the zerolog context key, so that the global logger is never updated
+type requestLoggerKey struct{}
+
+// requestIDMiddleware sets the id of the request in the request context and in the response headers,
+// and puts a request-scoped logger, with the request id and the route, in the request context.
+// The id of the X-Request-Id header is used when it is valid, a new id is generated otherwise
+func requestIDMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = generateUUID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		route, err := requestPatternGetter(r)
+		if err != nil {
+			route = "unknown"
+		}
+
+		logCtx := log.With().Str("request_id", id).Str("method", r.Method).Str("route", route)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			logCtx = logCtx.Str("trace_id", sc.TraceID().String())
+		}
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = logCtx.Logger().WithContext(ctx)
+		ctx = context.WithValue(ctx, requestLoggerKey{}, zerolog.Ctx(ctx))
+		next(w, r.WithContext(ctx), pathParams)
+	}
+}
+
+// setLogActor adds the email of the authenticated user to the request-scoped logger,
+// so that it is in the logs of the next handlers and in the access log
+func setLogActor(ctx context.Context, email string) {
+	if l, ok := ctx.Value(requestLoggerKey{}).(*zerolog.Logger); ok {
+		l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+			return c.Str("actor", email)
+		})
+	}
+}
+
+// RequestIDClientInterceptor forwards the id of the request to Dex, in the x-request-id metadata of the gRPC calls
+func RequestIDClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if id := requestID(ctx); id != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadata, id)
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// requestID returns the id of the request, or an empty string when there is none
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID returns whether the request id set by a client is not empty, not too long,
+// and only contains printable ASCII characters, so that it can safely be logged
+func validRequestID(id string) bool {
+	if id == "" || len(id) > requestIDMaxLen {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
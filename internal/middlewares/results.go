@@ -0,0 +1,57 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+// resultFlagsAsStatus is whether the already_exists and not_found flags of the Dex responses are
+// answered with 409 and 404, it is disabled for the callers that check the flags of the 200 responses
+var resultFlagsAsStatus = true
+
+// resultFlagsResponse turns the already_exists and not_found flags of the Dex responses into errors,
+// answered by errorHandler with 409 and 404 and the error body instead of the Dex response.
+// It is a forward response option of the gateway, called with the Dex response before it is written
+func resultFlagsResponse(_ context.Context, _ http.ResponseWriter, m proto.Message) error {
+	if !resultFlagsAsStatus {
+		return nil
+	}
+
+	switch resp := m.(type) {
+	case *api.CreatePasswordResp:
+		if resp.AlreadyExists {
+			return status.Error(codes.AlreadyExists, "user already exists")
+		}
+	case *api.UpdatePasswordResp:
+		if resp.NotFound {
+			return status.Error(codes.NotFound, "user not found")
+		}
+	case *api.DeletePasswordResp:
+		if resp.NotFound {
+			return status.Error(codes.NotFound, "user not found")
+		}
+	case *api.CreateClientResp:
+		if resp.AlreadyExists {
+			return status.Error(codes.AlreadyExists, "client already exists")
+		}
+	case *api.UpdateClientResp:
+		if resp.NotFound {
+			return status.Error(codes.NotFound, "client not found")
+		}
+	case *api.DeleteClientResp:
+		if resp.NotFound {
+			return status.Error(codes.NotFound, "client not found")
+		}
+	case *api.RevokeRefreshResp:
+		if resp.NotFound {
+			return status.Error(codes.NotFound, "session not found")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+func Test_resultFlagsResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    proto.Message
+		status  int
+		reason  string
+		message string
+	}{
+		{name: "user created", resp: &api.CreatePasswordResp{}, status: http.StatusOK},
+		{name: "user already exists", resp: &api.CreatePasswordResp{AlreadyExists: true}, status: http.StatusConflict, reason: "ALREADY_EXISTS", message: "user already exists"},
+		{name: "user updated", resp: &api.UpdatePasswordResp{}, status: http.StatusOK},
+		{name: "updated user not found", resp: &api.UpdatePasswordResp{NotFound: true}, status: http.StatusNotFound, reason: "NOT_FOUND"},
+		{name: "deleted user not found", resp: &api.DeletePasswordResp{NotFound: true}, status: http.StatusNotFound, reason: "NOT_FOUND"},
+		{name: "client already exists", resp: &api.CreateClientResp{AlreadyExists: true}, status: http.StatusConflict, reason: "ALREADY_EXISTS"},
+		{name: "updated client not found", resp: &api.UpdateClientResp{NotFound: true}, status: http.StatusNotFound, reason: "NOT_FOUND"},
+		{name: "deleted client not found", resp: &api.DeleteClientResp{NotFound: true}, status: http.StatusNotFound, reason: "NOT_FOUND"},
+		{name: "session not found", resp: &api.RevokeRefreshResp{NotFound: true}, status: http.StatusNotFound, reason: "NOT_FOUND"},
+		{name: "password not verified", resp: &api.VerifyPasswordResp{NotFound: true}, status: http.StatusOK},
+	}
+
+	mux := runtime.NewServeMux(ServeMuxOptions()...)
+	forward := func(resp proto.Message) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/users", nil)
+		ctx := runtime.NewServerMetadataContext(r.Context(), runtime.ServerMetadata{})
+		w := httptest.NewRecorder()
+		runtime.ForwardResponseMessage(ctx, mux, errorMarshaler, w, r.WithContext(ctx), resp, mux.GetForwardResponseOptions()...)
+		return w
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() { resultFlagsAsStatus = true }()
+
+			resultFlagsAsStatus = true
+			w := forward(tt.resp)
+			assert.Equal(t, tt.status, w.Code)
+			if tt.reason != "" {
+				body := decodeErrorBody(t, w)
+				require.Len(t, body.Details, 1)
+				assert.Equal(t, tt.reason, body.Details[0].Reason)
+				if tt.message != "" {
+					assert.Equal(t, tt.message, body.Message)
+				}
+			}
+
+			// the flags are in the body of the 200 responses with the legacy behavior
+			resultFlagsAsStatus = false
+			w = forward(tt.resp)
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			got := proto.Clone(tt.resp)
+			proto.Reset(got)
+			require.NoError(t, errorMarshaler.Unmarshal(w.Body.Bytes(), got))
+			assert.True(t, proto.Equal(tt.resp, got))
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+)
+
+// sessionsUserIDParam is the path param that carries the user on the sessions routes
+// The routes are called with the user's email, which is replaced with the Dex user id here
+const sessionsUserIDParam = "user_id"
+
+// sessionsMiddleware translates the email in the path of the list/revoke sessions requests
+// into the Dex user id. The user id is generated by createUserMiddleware and never returned
+// to the callers, so the callers address users by email.
+// This middleware is applied to list and revoke sessions requests only
+func sessionsMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		name := getRequestName(r)
+		if name != requestListSessions && name != requestRevokeSession {
+			next(w, r, pathParams)
+			return
+		}
+
+		email := strings.TrimSpace(pathParams[sessionsUserIDParam])
+		if len(email) == 0 {
+			err := &fieldError{field: "username", rule: ruleRequired, err: fmt.Errorf("username is required")}
+			log.Ctx(r.Context()).Err(err).Msg("invalid username")
+			writeError(w, r, &apiError{code: codes.InvalidArgument, message: err.Error(), violations: []*fieldError{err}})
+			return
+		}
+
+		log.Ctx(r.Context()).Debug().Msgf("sessions request, will translate user %s into the dex user id", email)
+		userID, found, err := lookupUserID(r.Context(), email)
+		if err != nil {
+			log.Ctx(r.Context()).Err(err).Msg("failed to lookup user id")
+			writeError(w, r, &apiError{code: codes.Internal, message: "failed to lookup user"})
+			return
+		}
+
+		if !found {
+			writeError(w, r, &apiError{code: codes.NotFound, message: fmt.Sprintf("user %s not found", email)})
+			return
+		}
+
+		// copy the path params so that the params owned by the mux are not modified
+		params := make(map[string]string, len(pathParams))
+		for k, v := range pathParams {
+			params[k] = v
+		}
+		params[sessionsUserIDParam] = userID
+
+		next(w, r, params)
+	}
+}
+
+// lookupUserID returns the Dex user id of the password record with the provided email
+func lookupUserID(ctx context.Context, email string) (string, bool, error) {
+	p, err := findPassword(ctx, email)
+	if err != nil || p == nil {
+		return "", false, err
+	}
+	return p.GetUserId(), true, nil
+}
@@ -0,0 +1,112 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+// fakeDexClient is a Dex client that serves the password records from memory
+// Calls to methods that are not overridden panic
+type fakeDexClient struct {
+	api.DexClient
+
+	passwords []*api.Password
+	err       error
+
+	// listCalls is the number of calls to ListPasswords
+	listCalls int
+}
+
+func (f *fakeDexClient) ListPasswords(_ context.Context, _ *api.ListPasswordReq, _ ...grpc.CallOption) (*api.ListPasswordResp, error) {
+	f.listCalls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &api.ListPasswordResp{Passwords: f.passwords}, nil
+}
+
+func Test_sessionsMiddleware(t *testing.T) {
+	dexClient = &fakeDexClient{
+		passwords: []*api.Password{
+			{Email: "admin@example.com", UserId: "08a8684b-db88-4b73-90a9-3cd1661f5466"},
+			{Email: "user@example.com", UserId: "5b2f6a2c-7c1e-4d0a-9d6e-0f5c4f1b2a3d"},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		pattern        string
+		pathParams     map[string]string
+		wantUserID     string
+		expectedStatus int
+	}{
+		{
+			name:           "list sessions",
+			method:         http.MethodGet,
+			pattern:        "/v1/users/{user_id=*}/sessions",
+			pathParams:     map[string]string{"user_id": "user@example.com"},
+			wantUserID:     "5b2f6a2c-7c1e-4d0a-9d6e-0f5c4f1b2a3d",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "revoke session with email in different case",
+			method:         http.MethodDelete,
+			pattern:        "/v1/users/{user_id=*}/sessions/{client_id=*}",
+			pathParams:     map[string]string{"user_id": "Admin@Example.com", "client_id": "dashboard"},
+			wantUserID:     "08a8684b-db88-4b73-90a9-3cd1661f5466",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "unknown user",
+			method:         http.MethodGet,
+			pattern:        "/v1/users/{user_id=*}/sessions",
+			pathParams:     map[string]string{"user_id": "unknown@example.com"},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "other requests are not modified",
+			method:         http.MethodDelete,
+			pattern:        "/v1/users/{email=*}",
+			pathParams:     map[string]string{"email": "user@example.com"},
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestPatternGetter = mockedRequestPatternGetter(tt.pattern)
+
+			mockNext := func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+				if tt.wantUserID != "" {
+					assert.Equal(t, tt.wantUserID, pathParams["user_id"])
+				} else {
+					assert.Equal(t, tt.pathParams, pathParams)
+				}
+			}
+
+			req := httptest.NewRequest(tt.method, "/v1/users", nil)
+			rr := httptest.NewRecorder()
+
+			handler := sessionsMiddleware(mockNext)
+			handler(rr, req, tt.pathParams)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func Test_lookupUserIDError(t *testing.T) {
+	dexClient = &fakeDexClient{err: fmt.Errorf("connection refused")}
+
+	_, _, err := lookupUserID(context.Background(), "user@example.com")
+	assert.Error(t, err)
+}
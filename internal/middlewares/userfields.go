@@ -0,0 +1,98 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+// userField is a field of the password records that can be exposed in the responses
+type userField struct {
+	// json is the name of the field in the responses, the name used by the gateway
+	json string
+
+	// value returns the value of the field of the record
+	value func(*api.Password) string
+}
+
+// userFields are the fields of the password records that can be exposed, by proto name
+// The bcrypt hash of the passwords is never exposed, so it is not one of them
+var userFields = map[string]userField{
+	"email":    {json: "email", value: (*api.Password).GetEmail},
+	"username": {json: "username", value: (*api.Password).GetUsername},
+	"user_id":  {json: "userId", value: (*api.Password).GetUserId},
+}
+
+// DefaultUserFields are the fields of the password records exposed by default
+var DefaultUserFields = []string{"email", "username", "user_id"}
+
+// exposedUserFields are the fields of the password records exposed in the responses
+var exposedUserFields = DefaultUserFields
+
+// setUserFields sets the fields of the password records exposed in the responses, the default ones when empty
+func setUserFields(fields []string) error {
+	if len(fields) == 0 {
+		exposedUserFields = DefaultUserFields
+		return nil
+	}
+
+	for _, f := range fields {
+		if f == "hash" {
+			return fmt.Errorf("the hash of the passwords cannot be exposed")
+		}
+		if _, ok := userFields[f]; !ok {
+			return fmt.Errorf("unknown user field %q, must be one of %s", f, strings.Join(slices.Sorted(maps.Keys(userFields)), ", "))
+		}
+	}
+	exposedUserFields = slices.Clone(fields)
+	return nil
+}
+
+// newUserResponse returns the user of the responses, with the exposed fields of the password record only
+func newUserResponse(p *api.Password) map[string]string {
+	u := make(map[string]string, len(exposedUserFields))
+	for _, f := range exposedUserFields {
+		field := userFields[f]
+		u[field.json] = field.value(p)
+	}
+	return u
+}
+
+// userFieldsRewriter replaces the password records of the list users responses with the users
+// of the responses, so that the hashes of the passwords never leave the server. The pages of the
+// paginated requests are returned instead of the whole list, see listUsersMiddleware.
+// It is the forward response rewriter of the gateway, called with the Dex response before it is marshaled
+func userFieldsRewriter(ctx context.Context, m proto.Message) (any, error) {
+	// the list users responses are wrapped by the gateway, to marshal their passwords only
+	resp, ok := m.(interface{ GetPasswords() []*api.Password })
+	if !ok {
+		return m, nil
+	}
+
+	opts, ok := ctx.Value(listUsersOptionsKey{}).(*listUsersOptions)
+	if !ok {
+		return newUserResponses(resp.GetPasswords()), nil
+	}
+
+	page, next, total := opts.apply(resp.GetPasswords())
+	return &usersPage{
+		Users:         newUserResponses(page),
+		NextPageToken: next,
+		TotalSize:     total,
+	}, nil
+}
+
+// newUserResponses returns the users of the responses of the password records
+func newUserResponses(passwords []*api.Password) []map[string]string {
+	users := make([]map[string]string, 0, len(passwords))
+	for _, p := range passwords {
+		users = append(users, newUserResponse(p))
+	}
+	return users
+}
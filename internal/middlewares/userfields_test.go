@@ -0,0 +1,134 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+)
+
+// passwordsDexServer is a Dex server that lists the password records from memory
+type passwordsDexServer struct {
+	api.UnimplementedDexServer
+
+	passwords []*api.Password
+}
+
+func (s *passwordsDexServer) ListPasswords(context.Context, *api.ListPasswordReq) (*api.ListPasswordResp, error) {
+	return &api.ListPasswordResp{Passwords: s.passwords}, nil
+}
+
+func Test_userFieldsRewriter(t *testing.T) {
+	const hash = "$2a$10$33EMT0cVYVlPy6WAMCLsceLYjWhuHpbz5yuZxu/GAFj03J9Lytjuy"
+	passwords := []*api.Password{
+		{Email: "jane@example.com", Username: "Jane", UserId: "1", Hash: []byte(hash)},
+		{Email: "john@example.com", Username: "John", UserId: "2", Hash: []byte(hash)},
+	}
+
+	tests := []struct {
+		name     string
+		fields   []string
+		expected []map[string]string
+	}{
+		{
+			name: "default fields",
+			expected: []map[string]string{
+				{"email": "jane@example.com", "username": "Jane", "userId": "1"},
+				{"email": "john@example.com", "username": "John", "userId": "2"},
+			},
+		},
+		{
+			name:   "without the user ids",
+			fields: []string{"email", "username"},
+			expected: []map[string]string{
+				{"email": "jane@example.com", "username": "Jane"},
+				{"email": "john@example.com", "username": "John"},
+			},
+		},
+		{
+			name:   "emails only",
+			fields: []string{"email"},
+			expected: []map[string]string{
+				{"email": "jane@example.com"},
+				{"email": "john@example.com"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, setUserFields(tt.fields))
+			defer func() { _ = setUserFields(nil) }()
+
+			dexClient = &fakeDexClient{passwords: passwords}
+			mux := runtime.NewServeMux(ServeMuxOptions()...)
+			require.NoError(t, api.RegisterDexHandlerServer(context.Background(), mux, &passwordsDexServer{passwords: passwords}))
+			require.NoError(t, RegisterHandlers(mux))
+
+			// list users
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/users", nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.NotContains(t, w.Body.String(), "hash")
+			assert.NotContains(t, w.Body.String(), hash)
+
+			var users []map[string]string
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &users))
+			assert.Equal(t, tt.expected, users)
+
+			// get user
+			w = httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/users/john@example.com", nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.NotContains(t, w.Body.String(), "hash")
+			assert.NotContains(t, w.Body.String(), hash)
+
+			var user map[string]string
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &user))
+			assert.Equal(t, tt.expected[1], user)
+		})
+	}
+}
+
+func Test_userFieldsRewriterEmptyList(t *testing.T) {
+	mux := runtime.NewServeMux(ServeMuxOptions()...)
+	require.NoError(t, api.RegisterDexHandlerServer(context.Background(), mux, &passwordsDexServer{}))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/users", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, "[]", w.Body.String())
+}
+
+func Test_setUserFields(t *testing.T) {
+	defer func() { _ = setUserFields(nil) }()
+
+	tests := []struct {
+		name    string
+		fields  []string
+		wantErr string
+	}{
+		{name: "default fields", fields: nil},
+		{name: "known fields", fields: []string{"email", "user_id"}},
+		{name: "hash", fields: []string{"email", "hash"}, wantErr: "the hash of the passwords cannot be exposed"},
+		{name: "unknown field", fields: []string{"email", "userId"}, wantErr: `unknown user field "userId", must be one of email, user_id, username`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := setUserFields(tt.fields)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -2,17 +2,22 @@ package middlewares
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/protobuf/encoding/protojson"
 
 	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
+	"github.com/mirantiscontainers/dex-http-server/internal/tracing"
 )
 
 var (
@@ -35,46 +40,35 @@ var (
 func createUserMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
 		if getRequestName(r) == requestCreateUser {
-			log.Debug().Msg("create user request, will modify request body to encrypt password and generate UUID")
+			log.Ctx(r.Context()).Debug().Msg("create user request, will modify request body to encrypt password and generate UUID")
 
 			// decode request body
 			// note: we are decoding req.Password (instead of req) because the request body is modified
 			//       to contain only the Password object, and not the entire CreatePasswordReq object
 			var req api.CreatePasswordReq
 			if err := marshaler.NewDecoder(r.Body).Decode(&req.Password); err != nil {
-				log.Err(err).Msg("failed to decode request body while creating user")
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				log.Ctx(r.Context()).Err(err).Msg("failed to decode request body while creating user")
+				writeError(w, r, &apiError{code: codes.InvalidArgument, message: err.Error(), violations: []*fieldError{{field: "body", rule: ruleMalformed, err: err}}})
 				return
 			}
 			_ = r.Body.Close()
 
-			// replace password with bcrypt hash
-			plaintext := req.Password.Hash
-			encrypted, err := encryptPasswordHash(plaintext)
-			if err != nil {
-				log.Err(err).Msg("failed to encrypt password")
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if req.Password == nil {
+				req.Password = &api.Password{}
+			}
+			if err := prepareNewPassword(r.Context(), req.Password); err != nil {
+				log.Ctx(r.Context()).Err(err).Msg("failed to encrypt password")
+				writeError(w, r, &apiError{code: codes.Internal, message: "failed to encrypt password"})
 				return
 			}
 
-			req.Password.Hash = []byte(encrypted)
-
-			// trim spaces from email and username
-			req.Password.Email = strings.TrimSpace(req.Password.Email)
-			req.Password.Username = strings.TrimSpace(req.Password.Username)
-
-			// Also replace user id with generate UUID
-			// Dex server accepts duplicate user ids, so we need to generate a unique id
-			// for each user. Not sure how is this field used in dex
-			req.Password.UserId = generateUUID()
-
 			// update request body
 			// note: similarly, we are encoding req.Password (instead of req) because the request body is modified
 			//       to contain only the Password object, and not the entire CreatePasswordReq object
 			newCreatePasswordReq, err := marshaler.Marshal(&req.Password)
 			if err != nil {
-				log.Err(err).Msg("failed to marshal request after encrypting password")
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				log.Ctx(r.Context()).Err(err).Msg("failed to marshal request after encrypting password")
+				writeError(w, r, &apiError{code: codes.Internal, message: "failed to encode request"})
 				return
 			}
 			r.Body = io.NopCloser(bytes.NewReader(newCreatePasswordReq))
@@ -86,26 +80,26 @@ func createUserMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
 func updateUserMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
 		if getRequestName(r) == requestUpdateUser {
-			log.Debug().Msg("update user request, will modify request body to encrypt password")
+			log.Ctx(r.Context()).Debug().Msg("update user request, will modify request body to encrypt password")
 
 			// decode request body
 			var req api.UpdatePasswordReq
 			if err := marshaler.NewDecoder(r.Body).Decode(&req); err != nil {
-				log.Err(err).Msg("failed to decode request body while updating user")
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				log.Ctx(r.Context()).Err(err).Msg("failed to decode request body while updating user")
+				writeError(w, r, &apiError{code: codes.InvalidArgument, message: err.Error(), violations: []*fieldError{{field: "body", rule: ruleMalformed, err: err}}})
 				return
 			}
 			_ = r.Body.Close()
 
 			if len(req.NewHash) > 0 {
-				log.Debug().Msg("update password request, will modify request body to encrypt password")
+				log.Ctx(r.Context()).Debug().Msg("update password request, will modify request body to encrypt password")
 
 				// replace password with base64 of bcrypt hash
 				plaintext := req.NewHash
-				encryptedHash, err := encryptPasswordHash(plaintext)
+				encryptedHash, err := encryptPasswordHash(r.Context(), plaintext)
 				if err != nil {
-					log.Err(err).Msg("failed to encrypt password")
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					log.Ctx(r.Context()).Err(err).Msg("failed to encrypt password")
+					writeError(w, r, &apiError{code: codes.Internal, message: "failed to encrypt password"})
 					return
 				}
 
@@ -117,8 +111,8 @@ func updateUserMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
 			// add back the request body
 			newUpdatePasswordReq, err := marshaler.Marshal(&req)
 			if err != nil {
-				log.Err(err).Msg("failed to marshal request after encrypting password")
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				log.Ctx(r.Context()).Err(err).Msg("failed to marshal request after encrypting password")
+				writeError(w, r, &apiError{code: codes.Internal, message: "failed to encode request"})
 				return
 			}
 			r.Body = io.NopCloser(bytes.NewReader(newUpdatePasswordReq))
@@ -128,9 +122,36 @@ func updateUserMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
 	}
 }
 
+// prepareNewPassword prepares the password record of a new user before it is sent to Dex:
+// - encrypt the password using bcrypt
+// - trim the spaces of the email and the name
+// - generate a UUID for the user
+func prepareNewPassword(ctx context.Context, p *api.Password) error {
+	// replace password with bcrypt hash
+	encrypted, err := encryptPasswordHash(ctx, p.Hash)
+	if err != nil {
+		return err
+	}
+	p.Hash = []byte(encrypted)
+
+	// trim spaces from email and username
+	p.Email = strings.TrimSpace(p.Email)
+	p.Username = strings.TrimSpace(p.Username)
+
+	// Also replace user id with generate UUID
+	// Dex server accepts duplicate user ids, so we need to generate a unique id
+	// for each user. Not sure how is this field used in dex
+	p.UserId = generateUUID()
+	return nil
+}
+
 // encryptPasswordHash encrypts the password using bcrypt and return base64 encoded hash
-func encryptPasswordHash(password []byte) (string, error) {
+func encryptPasswordHash(ctx context.Context, password []byte) (string, error) {
+	_, span := tracing.Start(ctx, "bcrypt")
+	start := time.Now()
 	hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	metrics.BcryptDuration.Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
 	if err != nil {
 		return "", err
 	}
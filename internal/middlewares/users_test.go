@@ -2,6 +2,7 @@ package middlewares
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net/http"
@@ -155,7 +156,7 @@ func Test_isUpdateUserRequest(t *testing.T) {
 
 func Test_encryptPassword(t *testing.T) {
 	password := []byte("mysecretpassword")
-	encrypted, err := encryptPasswordHash(password)
+	encrypted, err := encryptPasswordHash(context.Background(), password)
 	if err != nil {
 		t.Fatalf("encryptPasswordHash() error = %v", err)
 	}
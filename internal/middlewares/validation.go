@@ -2,20 +2,30 @@ package middlewares
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
 
 	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
+	"github.com/mirantiscontainers/dex-http-server/internal/passwordpolicy"
 )
 
+// passwordPolicy is the policy the new passwords must comply with, in the create and update user requests
+var passwordPolicy = passwordpolicy.Default()
+
 const (
-	passwordMinLen = 8
-	passwordMaxLen = 64
+	// passwordMinLen and passwordMaxLen are the lengths of the passwords of the default password policy
+	passwordMinLen = passwordpolicy.DefaultMinLength
+	passwordMaxLen = passwordpolicy.DefaultMaxLength
 
 	// minLen is the minimum length of the username, email
 	minLen = 3
@@ -24,6 +34,17 @@ const (
 	maxLen = 100
 )
 
+// Rules of the fields, reported in the error responses of the invalid requests
+const (
+	ruleRequired    = "required"
+	ruleMinLength   = "min_length"
+	ruleMaxLength   = "max_length"
+	ruleWhiteSpaces = "white_spaces"
+	ruleMalformed   = "malformed"
+	ruleInvalid     = "invalid"
+	ruleDuplicate   = "duplicate"
+)
+
 // *********************************************************************************************
 // NOTE: The fields from api.Password (Dex) are mapped to different fields in the UI
 //       api.Password.Email -> username field in the UI
@@ -51,23 +72,23 @@ func validationMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
 func validateCreateUserRequest(next runtime.HandlerFunc, w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
 	var req api.CreatePasswordReq
 	if err := marshaler.NewDecoder(r.Body).Decode(&req.Password); err != nil {
-		log.Err(err).Msg("failed to decode request body while validating create user request")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Ctx(r.Context()).Err(err).Msg("failed to decode request body while validating create user request")
+		rejectInvalidRequest(w, r, &fieldError{field: "body", rule: ruleMalformed, err: err})
 		return
 	}
 	_ = r.Body.Close()
 
 	if err := validateUserRequest(req.Password); err != nil {
-		log.Err(err).Msg("failed to validate user request")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Ctx(r.Context()).Err(err).Msg("failed to validate user request")
+		rejectInvalidRequest(w, r, err)
 		return
 	}
 
 	// add back the request body
 	newCreateUserReq, err := marshaler.Marshal(&req.Password)
 	if err != nil {
-		log.Err(err).Msg("failed to marshal request after validating create user request")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Ctx(r.Context()).Err(err).Msg("failed to marshal request after validating create user request")
+		writeError(w, r, &apiError{code: codes.Internal, message: "failed to validate request"})
 		return
 	}
 
@@ -78,8 +99,8 @@ func validateCreateUserRequest(next runtime.HandlerFunc, w http.ResponseWriter,
 func validateUpdateUserRequest(next runtime.HandlerFunc, w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
 	var req api.UpdatePasswordReq
 	if err := marshaler.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Err(err).Msg("failed to decode request body while validating update user request")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Ctx(r.Context()).Err(err).Msg("failed to decode request body while validating update user request")
+		rejectInvalidRequest(w, r, &fieldError{field: "body", rule: ruleMalformed, err: err})
 		return
 	}
 	_ = r.Body.Close()
@@ -89,8 +110,9 @@ func validateUpdateUserRequest(next runtime.HandlerFunc, w http.ResponseWriter,
 	// but that happens after this middleware is called
 	username := strings.TrimSpace(pathParams["email"])
 	if len(username) == 0 {
-		log.Err(fmt.Errorf("username is required")).Msg("invalid username")
-		http.Error(w, "username is required", http.StatusBadRequest)
+		err := &fieldError{field: "username", rule: ruleRequired, err: fmt.Errorf("username is required")}
+		log.Ctx(r.Context()).Err(err).Msg("invalid username")
+		rejectInvalidRequest(w, r, err)
 		return
 	}
 
@@ -100,17 +122,17 @@ func validateUpdateUserRequest(next runtime.HandlerFunc, w http.ResponseWriter,
 	// only username when it is provided as it is optional
 	if len(newName) > 0 {
 		if err := validateName(newName); err != nil {
-			log.Err(err).Msg("invalid name")
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Ctx(r.Context()).Err(err).Msg("invalid name")
+			rejectInvalidRequest(w, r, err)
 			return
 		}
 	}
 
 	// only validate newPassword when it is provided as it is optional
 	if len(newPassword) > 0 {
-		if err := validatePassword(newPassword); err != nil {
-			log.Err(err).Msg("invalid password")
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if err := validatePassword(newPassword, passwordUser(r.Context(), username, newName)); err != nil {
+			log.Ctx(r.Context()).Err(err).Msg("invalid password")
+			rejectInvalidRequest(w, r, err)
 			return
 		}
 	}
@@ -118,8 +140,8 @@ func validateUpdateUserRequest(next runtime.HandlerFunc, w http.ResponseWriter,
 	// add back the request body
 	newUpdatePasswordReq, err := marshaler.Marshal(&req)
 	if err != nil {
-		log.Err(err).Msg("failed to marshal request after encrypting password")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Ctx(r.Context()).Err(err).Msg("failed to marshal request after encrypting password")
+		writeError(w, r, &apiError{code: codes.Internal, message: "failed to validate request"})
 		return
 	}
 
@@ -136,7 +158,7 @@ func validateUserRequest(userPassword *api.Password) error {
 		return err
 	}
 
-	if err := validatePassword(password); err != nil {
+	if err := validatePassword(password, passwordpolicy.User{Email: username, Name: name}); err != nil {
 		return err
 	}
 
@@ -153,43 +175,114 @@ func validateUserRequest(userPassword *api.Password) error {
 // note: email is mapped to 'username' in the UI. Therefore, we validate the email as the username
 func validateUsername(username string) error {
 	if strings.Contains(username, " ") {
-		return fmt.Errorf("username cannot contain white spaces")
+		return &fieldError{field: "username", rule: ruleWhiteSpaces, err: fmt.Errorf("username cannot contain white spaces")}
 	}
 
-	if err := validateLength(username, minLen, maxLen); err != nil {
-		return fmt.Errorf("invalid username, %v", err.Error())
-	}
-	return nil
+	return validateLength("username", username, minLen, maxLen)
 }
 
-func validatePassword(password string) error {
-	// allow no white spaces in the password
-	if strings.Contains(password, " ") {
-		return fmt.Errorf("password cannot contain white spaces")
+// validatePassword checks the password of the user against the password policy, all the violated rules are returned
+func validatePassword(password string, u passwordpolicy.User) error {
+	violations := passwordPolicy.Check(password, u)
+	if len(violations) == 0 {
+		return nil
 	}
 
-	if err := validateLength(password, passwordMinLen, passwordMaxLen); err != nil {
-		return fmt.Errorf("invalid password, %v", err.Error())
+	errs := make(fieldErrors, 0, len(violations))
+	for _, v := range violations {
+		errs = append(errs, &fieldError{field: "password", rule: v.Rule, err: v})
 	}
-
-	return nil
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errs
 }
 
-func validateName(name string) error {
-	if err := validateLength(name, 0, maxLen); err != nil {
-		return fmt.Errorf("invalid name, %v", err.Error())
+// passwordUser returns the user of the new password of an update user request. The name is the
+// current name of the user when it is not updated, so that the password policy can reject it
+func passwordUser(ctx context.Context, username, newName string) passwordpolicy.User {
+	u := passwordpolicy.User{Email: username, Name: newName}
+	if newName != "" || !passwordPolicy.RejectUserInfo {
+		return u
 	}
 
-	return nil
+	p, err := findPassword(ctx, username)
+	if err != nil {
+		log.Ctx(ctx).Err(err).Msg("failed to get the name of the user, the password is checked without it")
+		return u
+	}
+	u.Name = p.GetUsername()
+	return u
 }
 
-func validateLength(s string, min, max int) error {
+func validateName(name string) error {
+	return validateLength("name", name, 0, maxLen)
+}
+
+// validateLength returns a fieldError of the field when the length of the value is out of the bounds
+func validateLength(field, s string, min, max int) error {
 	if len(s) < min {
-		return fmt.Errorf("must be at least %v characters", min)
+		return &fieldError{field: field, rule: ruleMinLength, err: fmt.Errorf("invalid %s, must be at least %v characters", field, min)}
 	}
 
 	if len(s) > max {
-		return fmt.Errorf("must be at most %v characters", max)
+		return &fieldError{field: field, rule: ruleMaxLength, err: fmt.Errorf("invalid %s, must be at most %v characters", field, max)}
 	}
 	return nil
 }
+
+// fieldError is a validation error of a field of the request
+// The fields are named after the fields in the UI, see the note above
+type fieldError struct {
+	field string
+	rule  string
+	err   error
+}
+
+func (e *fieldError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.err
+}
+
+// fieldErrors are the validation errors of a request breaking several rules, e.g. of the password policy
+type fieldErrors []*fieldError
+
+func (e fieldErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fe := range e {
+		messages = append(messages, fe.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e fieldErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, fe := range e {
+		errs = append(errs, fe)
+	}
+	return errs
+}
+
+// rejectInvalidRequest responds with a bad request error, with the violations of the invalid fields,
+// and counts the rejection by invalid field
+func rejectInvalidRequest(w http.ResponseWriter, r *http.Request, err error) {
+	var violations fieldErrors
+	if !errors.As(err, &violations) {
+		fe := &fieldError{field: "unknown", rule: ruleInvalid, err: err}
+		errors.As(err, &fe)
+		violations = fieldErrors{fe}
+	}
+
+	var fields []string
+	for _, fe := range violations {
+		if !slices.Contains(fields, fe.field) {
+			fields = append(fields, fe.field)
+			metrics.ValidationRejections.WithLabelValues(fe.field).Inc()
+		}
+	}
+
+	writeError(w, r, &apiError{code: codes.InvalidArgument, message: err.Error(), violations: violations})
+}
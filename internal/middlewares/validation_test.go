@@ -10,8 +10,10 @@ import (
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/mirantiscontainers/dex-http-server/gen/go/api"
+	"github.com/mirantiscontainers/dex-http-server/internal/passwordpolicy"
 )
 
 func Test_validationMiddlewareCreateUser(t *testing.T) {
@@ -400,3 +402,76 @@ var updateUserTests = []updateUserValidationTest{
 		expectedStatus: http.StatusBadRequest,
 	},
 }
+
+func Test_validationMiddlewarePasswordPolicy(t *testing.T) {
+	policy, err := passwordpolicy.Parse([]byte(`{minLength: 10, characterClasses: {min: 3}, rejectUserInfo: true}`))
+	require.NoError(t, err)
+	passwordPolicy = policy
+	defer func() { passwordPolicy = passwordpolicy.Default() }()
+
+	dexClient = &fakeDexClient{passwords: []*api.Password{{Email: "jane@example.com", Username: "Jane Doe"}}}
+
+	tests := []struct {
+		name       string
+		method     string
+		pattern    string
+		body       string
+		pathParams map[string]string
+		rules      string
+	}{
+		{
+			name:    "create user with a compliant password",
+			method:  http.MethodPost,
+			pattern: "/v1/users",
+			body:    `{"email": "jane@example.com", "hash": "VHIwdWI0ZG9yJjM=", "username": "Jane"}`,
+		},
+		{
+			name:    "create user with a short password of two classes",
+			method:  http.MethodPost,
+			pattern: "/v1/users",
+			body:    `{"email": "jane@example.com", "hash": "c2hvcnQx", "username": "Jane"}`,
+			rules:   "min_length,character_classes",
+		},
+		{
+			name:    "create user with the name in the password",
+			method:  http.MethodPost,
+			pattern: "/v1/users",
+			body:    `{"email": "jane@example.com", "hash": "SmFuZSMxMjM0NTY=", "username": "Jane"}`,
+			rules:   "user_info",
+		},
+		{
+			name:       "update password with the current name in it",
+			method:     http.MethodPut,
+			pattern:    "/users/{email=*}",
+			body:       `{"new_hash": "RG9lIzEyMzQ1Njc="}`,
+			pathParams: map[string]string{"email": "jane@example.com"},
+			rules:      "user_info",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestPatternGetter = mockedRequestPatternGetter(tt.pattern)
+
+			w := httptest.NewRecorder()
+			validationMiddleware(func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+				w.WriteHeader(http.StatusOK)
+			})(w, httptest.NewRequest(tt.method, "/v1/users", bytes.NewBufferString(tt.body)), tt.pathParams)
+
+			if tt.rules == "" {
+				assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+				return
+			}
+			require.Equal(t, http.StatusBadRequest, w.Code)
+
+			// each broken rule is a violation of the password
+			body := decodeErrorBody(t, w)
+			require.Len(t, body.Details, 2)
+			assert.Len(t, body.Details[0].FieldViolations, len(strings.Split(tt.rules, ",")))
+			for _, v := range body.Details[0].FieldViolations {
+				assert.Equal(t, "password", v.Field)
+			}
+			assert.Equal(t, map[string]string{"password": tt.rules}, body.Details[1].Metadata)
+		})
+	}
+}
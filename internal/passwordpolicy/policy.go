@@ -0,0 +1,342 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Rules of the policy, reported with the violations
+const (
+	RuleMinLength        = "min_length"
+	RuleMaxLength        = "max_length"
+	RuleWhiteSpaces      = "white_spaces"
+	RuleCharacterClasses = "character_classes"
+	RuleMinEntropy       = "min_entropy"
+	RuleMinStrength      = "min_strength"
+	RuleUserInfo         = "user_info"
+	RuleCommonPassword   = "common_password"
+)
+
+// Character classes of the passwords
+const (
+	ClassLower  = "lower"
+	ClassUpper  = "upper"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+// classes are the character classes, with their description in the violations
+var classes = map[string]string{
+	ClassLower:  "a lowercase letter",
+	ClassUpper:  "an uppercase letter",
+	ClassDigit:  "a digit",
+	ClassSymbol: "a symbol",
+}
+
+const (
+	// DefaultMinLength is the minimum number of characters of the passwords of the default policy
+	DefaultMinLength = 8
+
+	// DefaultMaxLength is the maximum number of characters of the passwords of the default policy
+	DefaultMaxLength = 64
+
+	// MaxStrengthScore is the score of the strongest passwords, the scores are 0 to 4 like zxcvbn
+	MaxStrengthScore = 4
+)
+
+// Policy is the policy the new passwords of the users must comply with
+//
+// Example:
+//
+//	minLength: 12
+//	maxLength: 128
+//	characterClasses:
+//	  min: 3
+//	  required: ["digit"]
+//	minEntropyBits: 50
+//	minStrengthScore: 3
+//	rejectUserInfo: true
+//	commonPasswordsFile: /etc/dex-http-server/common-passwords.txt
+type Policy struct {
+	// MinLength is the minimum number of characters, DefaultMinLength when not set
+	MinLength int `json:"minLength,omitempty"`
+
+	// MaxLength is the maximum number of characters, DefaultMaxLength when not set
+	MaxLength int `json:"maxLength,omitempty"`
+
+	// AllowWhiteSpaces allows the white spaces in the passwords
+	AllowWhiteSpaces bool `json:"allowWhiteSpaces,omitempty"`
+
+	// CharacterClasses are the character classes the passwords must contain
+	CharacterClasses CharacterClasses `json:"characterClasses,omitempty"`
+
+	// MinEntropyBits is the minimum entropy of the passwords, see Entropy. Not checked when 0
+	MinEntropyBits float64 `json:"minEntropyBits,omitempty"`
+
+	// MinStrengthScore is the minimum strength score of the passwords, 0 to 4, see Score. Not checked when 0
+	MinStrengthScore int `json:"minStrengthScore,omitempty"`
+
+	// RejectUserInfo rejects the passwords containing the email, its local part or the name of the user
+	RejectUserInfo bool `json:"rejectUserInfo,omitempty"`
+
+	// CommonPasswordsFile is the path of a file of common passwords, one per line, that are rejected.
+	// The passwords are compared case-insensitively, and the most common ones must come first,
+	// their rank is used by the strength score
+	CommonPasswordsFile string `json:"commonPasswordsFile,omitempty"`
+
+	// commonPasswords are the lower case common passwords, by rank
+	commonPasswords map[string]int
+}
+
+// CharacterClasses are the character classes the passwords must contain, among lower, upper, digit and symbol
+type CharacterClasses struct {
+	// Min is the minimum number of classes of the passwords
+	Min int `json:"min,omitempty"`
+
+	// Required are the classes that all the passwords must contain
+	Required []string `json:"required,omitempty"`
+}
+
+// User is the user of a password, the passwords containing their email or name are rejected
+// with RejectUserInfo
+type User struct {
+	Email string
+	Name  string
+}
+
+// Violation is a rule of the policy a password does not comply with
+type Violation struct {
+	Rule    string
+	Message string
+}
+
+func (v Violation) Error() string {
+	return v.Message
+}
+
+// Default returns the policy used when no policy is configured: 8 to 64 characters, without white spaces
+func Default() *Policy {
+	p := &Policy{}
+	_ = p.init()
+	return p
+}
+
+// Load reads and parses the policy from the YAML file at the provided path
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password policy file %s: %w", path, err)
+	}
+
+	p, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid password policy file %s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+// Parse parses the policy from YAML, validates it and loads its common passwords
+func Parse(data []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse password policy: %w", err)
+	}
+
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// init sets the default lengths, validates the policy and loads its common passwords
+func (p *Policy) init() error {
+	if p.MinLength == 0 {
+		p.MinLength = DefaultMinLength
+	}
+	if p.MaxLength == 0 {
+		p.MaxLength = DefaultMaxLength
+	}
+
+	if p.MinLength < 1 || p.MaxLength < p.MinLength {
+		return fmt.Errorf("minLength must be positive and at most maxLength")
+	}
+	if p.CharacterClasses.Min < 0 || p.CharacterClasses.Min > len(classes) {
+		return fmt.Errorf("characterClasses.min must be between 0 and %d", len(classes))
+	}
+	for _, c := range p.CharacterClasses.Required {
+		if _, ok := classes[c]; !ok {
+			return fmt.Errorf("unknown character class %q, must be one of %s, %s, %s or %s", c, ClassLower, ClassUpper, ClassDigit, ClassSymbol)
+		}
+	}
+	if p.MinEntropyBits < 0 {
+		return fmt.Errorf("minEntropyBits must be positive")
+	}
+	if p.MinStrengthScore < 0 || p.MinStrengthScore > MaxStrengthScore {
+		return fmt.Errorf("minStrengthScore must be between 0 and %d", MaxStrengthScore)
+	}
+
+	if p.CommonPasswordsFile != "" {
+		common, err := loadCommonPasswords(p.CommonPasswordsFile)
+		if err != nil {
+			return err
+		}
+		p.commonPasswords = common
+	}
+	return nil
+}
+
+// loadCommonPasswords reads the common passwords of the file, one per line, the empty lines
+// and the lines starting with # are ignored
+func loadCommonPasswords(path string) (map[string]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read common passwords file %s: %w", path, err)
+	}
+
+	common := map[string]int{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, ok := common[strings.ToLower(line)]; !ok {
+			common[strings.ToLower(line)] = len(common) + 1
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read common passwords file %s: %w", path, err)
+	}
+	return common, nil
+}
+
+// Check returns the violations of the policy by the password of the user, none when it complies with it.
+// The lengths are numbers of characters, not of bytes
+func (p *Policy) Check(password string, u User) []Violation {
+	var violations []Violation
+
+	if !p.AllowWhiteSpaces && strings.IndexFunc(password, unicode.IsSpace) >= 0 {
+		violations = append(violations, Violation{Rule: RuleWhiteSpaces, Message: "password cannot contain white spaces"})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violations = append(violations, Violation{Rule: RuleMinLength, Message: fmt.Sprintf("invalid password, must be at least %d characters", p.MinLength)})
+	}
+	if length > p.MaxLength {
+		violations = append(violations, Violation{Rule: RuleMaxLength, Message: fmt.Sprintf("invalid password, must be at most %d characters", p.MaxLength)})
+	}
+
+	if v, ok := p.checkCharacterClasses(password); !ok {
+		violations = append(violations, v)
+	}
+
+	if p.RejectUserInfo && containsUserInfo(password, u) {
+		violations = append(violations, Violation{Rule: RuleUserInfo, Message: "password cannot contain the username or the name"})
+	}
+
+	if _, ok := p.commonPasswords[strings.ToLower(password)]; ok {
+		violations = append(violations, Violation{Rule: RuleCommonPassword, Message: "password is too common"})
+	}
+
+	if p.MinEntropyBits > 0 {
+		if bits := Entropy(password); bits < p.MinEntropyBits {
+			violations = append(violations, Violation{Rule: RuleMinEntropy, Message: fmt.Sprintf("password is too predictable, its entropy is %.0f bits, must be at least %.0f bits", bits, p.MinEntropyBits)})
+		}
+	}
+
+	if p.MinStrengthScore > 0 {
+		if score := p.Score(password, u); score < p.MinStrengthScore {
+			violations = append(violations, Violation{Rule: RuleMinStrength, Message: fmt.Sprintf("password is too weak, its strength score is %d, must be at least %d", score, p.MinStrengthScore)})
+		}
+	}
+
+	return violations
+}
+
+func (p *Policy) checkCharacterClasses(password string) (Violation, bool) {
+	found := passwordClasses(password)
+
+	var missing []string
+	for _, c := range p.CharacterClasses.Required {
+		if !found[c] {
+			missing = append(missing, classes[c])
+		}
+	}
+	if len(missing) > 0 {
+		return Violation{Rule: RuleCharacterClasses, Message: fmt.Sprintf("password must contain %s", strings.Join(missing, " and "))}, false
+	}
+
+	if len(found) < p.CharacterClasses.Min {
+		return Violation{Rule: RuleCharacterClasses, Message: fmt.Sprintf("password must contain at least %d of lowercase letters, uppercase letters, digits and symbols", p.CharacterClasses.Min)}, false
+	}
+	return Violation{}, true
+}
+
+// passwordClasses returns the character classes of the password
+func passwordClasses(password string) map[string]bool {
+	found := map[string]bool{}
+	for _, r := range password {
+		found[runeClass(r)] = true
+	}
+	delete(found, "")
+	return found
+}
+
+// runeClass returns the character class of the rune, empty for the white spaces
+func runeClass(r rune) string {
+	switch {
+	case unicode.IsSpace(r):
+		return ""
+	case unicode.IsLower(r):
+		return ClassLower
+	case unicode.IsUpper(r):
+		return ClassUpper
+	case unicode.IsDigit(r):
+		return ClassDigit
+	default:
+		return ClassSymbol
+	}
+}
+
+// userInputs returns the lower case parts of the user info that cannot be in the passwords:
+// the email, its local part, the name and the words of the name of at least 3 characters
+func userInputs(u User) []string {
+	var inputs []string
+	add := func(s string) {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if utf8.RuneCountInString(s) >= 3 && !slices.Contains(inputs, s) {
+			inputs = append(inputs, s)
+		}
+	}
+
+	add(u.Email)
+	if local, _, ok := strings.Cut(u.Email, "@"); ok {
+		add(local)
+	}
+	add(u.Name)
+	for _, w := range strings.FieldsFunc(u.Name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		add(w)
+	}
+	return inputs
+}
+
+func containsUserInfo(password string, u User) bool {
+	lower := strings.ToLower(password)
+	for _, input := range userInputs(u) {
+		if strings.Contains(lower, input) {
+			return true
+		}
+	}
+	return false
+}
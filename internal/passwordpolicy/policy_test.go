@@ -0,0 +1,181 @@
+package passwordpolicy_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/passwordpolicy"
+)
+
+func rules(violations []passwordpolicy.Violation) []string {
+	var r []string
+	for _, v := range violations {
+		r = append(r, v.Rule)
+	}
+	return r
+}
+
+func writeCommonPasswords(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "common-passwords.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# most common first\npassword\n123456\nqwerty\n\nletmein\n"), 0o600))
+	return path
+}
+
+func TestParse(t *testing.T) {
+	common := writeCommonPasswords(t)
+
+	tests := []struct {
+		name        string
+		policy      string
+		expectError bool
+	}{
+		{name: "empty policy", policy: `{}`},
+		{name: "full policy", policy: fmt.Sprintf(`
+minLength: 12
+maxLength: 128
+characterClasses:
+  min: 3
+  required: ["digit"]
+minEntropyBits: 50
+minStrengthScore: 3
+rejectUserInfo: true
+commonPasswordsFile: %s
+`, common)},
+		{name: "min length above max length", policy: `{minLength: 20, maxLength: 10}`, expectError: true},
+		{name: "unknown character class", policy: `{characterClasses: {required: ["emoji"]}}`, expectError: true},
+		{name: "too many character classes", policy: `{characterClasses: {min: 5}}`, expectError: true},
+		{name: "strength score out of range", policy: `{minStrengthScore: 5}`, expectError: true},
+		{name: "missing common passwords file", policy: `{commonPasswordsFile: /does/not/exist}`, expectError: true},
+		{name: "unknown field", policy: `{minLen: 12}`, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := passwordpolicy.Parse([]byte(tt.policy))
+			if tt.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDefault(t *testing.T) {
+	p := passwordpolicy.Default()
+	jane := passwordpolicy.User{Email: "jane@example.com", Name: "Jane"}
+
+	tests := []struct {
+		name     string
+		password string
+		expected []string
+	}{
+		{name: "valid", password: "validpassword"},
+		{name: "min length", password: strings.Repeat("a", 8)},
+		{name: "max length", password: strings.Repeat("a", 64)},
+		{name: "multi-byte characters are counted once", password: strings.Repeat("é", 64)},
+		{name: "user info is allowed", password: "jane@example.com"},
+		{name: "short", password: "short", expected: []string{passwordpolicy.RuleMinLength}},
+		{name: "long", password: strings.Repeat("a", 65), expected: []string{passwordpolicy.RuleMaxLength}},
+		{name: "white spaces", password: "invalid password", expected: []string{passwordpolicy.RuleWhiteSpaces}},
+		{name: "tab", password: "invalid\tpassword", expected: []string{passwordpolicy.RuleWhiteSpaces}},
+		{name: "short with white spaces", password: "a b", expected: []string{passwordpolicy.RuleWhiteSpaces, passwordpolicy.RuleMinLength}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, rules(p.Check(tt.password, jane)))
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p, err := passwordpolicy.Parse([]byte(fmt.Sprintf(`
+minLength: 10
+characterClasses:
+  min: 3
+  required: ["digit"]
+minEntropyBits: 40
+minStrengthScore: 3
+rejectUserInfo: true
+commonPasswordsFile: %s
+`, writeCommonPasswords(t))))
+	require.NoError(t, err)
+	jane := passwordpolicy.User{Email: "jane.doe@example.com", Name: "Jane Doe"}
+
+	tests := []struct {
+		name     string
+		password string
+		expected []string
+	}{
+		{name: "strong", password: "Tr0ub4dor&3x"},
+		{name: "missing digit", password: "Troubador&xx", expected: []string{passwordpolicy.RuleCharacterClasses}},
+		{name: "two classes", password: "troubador3xyz", expected: []string{passwordpolicy.RuleCharacterClasses}},
+		{name: "local part of the email", password: "Jane.Doe#2024", expected: []string{passwordpolicy.RuleUserInfo, passwordpolicy.RuleMinStrength}},
+		{name: "word of the name", password: "Xx9!doe-Tr0ub", expected: []string{passwordpolicy.RuleUserInfo}},
+		{name: "common password", password: "LetMeIn", expected: []string{passwordpolicy.RuleMinLength, passwordpolicy.RuleCharacterClasses, passwordpolicy.RuleCommonPassword, passwordpolicy.RuleMinEntropy, passwordpolicy.RuleMinStrength}},
+		{name: "common password with a suffix", password: "Password123!", expected: []string{passwordpolicy.RuleMinStrength}},
+		{name: "sequence", password: "Abcdefgh1234!", expected: []string{passwordpolicy.RuleMinEntropy, passwordpolicy.RuleMinStrength}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := p.Check(tt.password, jane)
+			assert.Equal(t, tt.expected, rules(violations))
+			for _, v := range violations {
+				assert.NotEmpty(t, v.Message)
+			}
+		})
+	}
+}
+
+func TestCheckMessages(t *testing.T) {
+	p, err := passwordpolicy.Parse([]byte(`{minLength: 12, characterClasses: {required: ["upper", "symbol"]}}`))
+	require.NoError(t, err)
+
+	assert.Equal(t, []passwordpolicy.Violation{
+		{Rule: passwordpolicy.RuleMinLength, Message: "invalid password, must be at least 12 characters"},
+		{Rule: passwordpolicy.RuleCharacterClasses, Message: "password must contain an uppercase letter and a symbol"},
+	}, p.Check("lowercase", passwordpolicy.User{}))
+}
+
+func TestEntropy(t *testing.T) {
+	assert.Zero(t, passwordpolicy.Entropy(""))
+	assert.InDelta(t, 8*4.70, passwordpolicy.Entropy("qzmxtnbv"), 0.1)
+
+	// the repeated characters and the sequences add 1 bit each
+	assert.InDelta(t, 4.70+7, passwordpolicy.Entropy("aaaaaaaa"), 0.1)
+	assert.InDelta(t, 3.32+7, passwordpolicy.Entropy("12345678"), 0.1)
+
+	// the pool is the one of the character classes of the password
+	assert.Greater(t, passwordpolicy.Entropy("qzmx#NB7"), passwordpolicy.Entropy("qzmxtnbv"))
+}
+
+func TestScore(t *testing.T) {
+	p := passwordpolicy.Default()
+	jane := passwordpolicy.User{Email: "jane@example.com", Name: "Jane"}
+
+	tests := []struct {
+		password string
+		expected int
+	}{
+		{password: "aaaaaaaaaaaa", expected: 0},
+		{password: "janejane", expected: 0},
+		{password: "x7k2q", expected: 1},
+		{password: "x7k2q9m4", expected: 3},
+		{password: "correcthorsebatterystaple", expected: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			assert.Equal(t, tt.expected, p.Score(tt.password, jane))
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package passwordpolicy
+
+import (
+	"math"
+	"slices"
+	"strings"
+)
+
+// poolSizes are the number of characters of the character classes, used to estimate the entropy
+var poolSizes = map[string]int{
+	ClassLower:  26,
+	ClassUpper:  26,
+	ClassDigit:  10,
+	ClassSymbol: 33,
+}
+
+// scoreThresholds are the log2 of the numbers of guesses of the strength scores 1 to 4, the ones of zxcvbn
+var scoreThresholds = []float64{math.Log2(1e3), math.Log2(1e6), math.Log2(1e8), math.Log2(1e10)}
+
+// maxWordLength is the maximum number of characters of the common passwords and of the user info
+// matched in the passwords by the strength score
+const maxWordLength = 64
+
+// Entropy returns an estimate of the entropy of the password in bits. Each character adds the log2
+// of the size of the pool of the character classes of the password, except the characters repeating
+// the previous one or continuing a sequence, e.g. aaa or 123, that add 1 bit
+func Entropy(password string) float64 {
+	pool := 0
+	for c := range passwordClasses(password) {
+		pool += poolSizes[c]
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	perChar := math.Log2(float64(pool))
+	var bits float64
+	var prev rune
+	for i, r := range []rune(password) {
+		if i > 0 && (r == prev || r == prev+1 || r == prev-1) {
+			bits++
+		} else {
+			bits += perChar
+		}
+		prev = r
+	}
+	return bits
+}
+
+// Score returns a zxcvbn-style strength score of the password of the user, from 0, too guessable,
+// to 4, very unguessable. It estimates the number of guesses to find the password: the common
+// passwords and the user info it contains are guessed in the number of guesses of their rank, the
+// repeated characters and the sequences in a few guesses, and the other characters are brute forced
+// with 10 guesses each
+func (p *Policy) Score(password string, u User) int {
+	bits := p.guessesLog2(password, u)
+	for score, threshold := range scoreThresholds {
+		if bits < threshold {
+			return score
+		}
+	}
+	return MaxStrengthScore
+}
+
+// guessesLog2 returns the log2 of the estimated number of guesses to find the password
+func (p *Policy) guessesLog2(password string, u User) float64 {
+	runes := []rune(strings.ToLower(password))
+	inputs := userInputs(u)
+
+	var bits float64
+	for i := 0; i < len(runes); {
+		if n, rank := p.longestWord(runes[i:], inputs); n > 0 {
+			bits += math.Log2(float64(rank))
+			i += n
+			continue
+		}
+
+		if n := patternLength(runes[i:]); n >= 3 {
+			bits += math.Log2(10 * float64(n))
+			i += n
+			continue
+		}
+
+		bits += math.Log2(10)
+		i++
+	}
+	return bits
+}
+
+// longestWord returns the length and the rank of the longest common password or user info, the
+// user info has the rank 1, at the start of the runes, of at least 3 characters, or 0 when there is none
+func (p *Policy) longestWord(runes []rune, inputs []string) (int, int) {
+	for n := min(len(runes), maxWordLength); n >= 3; n-- {
+		word := string(runes[:n])
+		if slices.Contains(inputs, word) {
+			return n, 1
+		}
+		if rank, ok := p.commonPasswords[word]; ok {
+			return n, rank
+		}
+	}
+	return 0, 0
+}
+
+// patternLength returns the number of characters at the start of the runes that repeat the first
+// one, e.g. aaa, or that are a sequence, e.g. abc or 321
+func patternLength(runes []rune) int {
+	if len(runes) < 2 {
+		return len(runes)
+	}
+
+	step := runes[1] - runes[0]
+	if step < -1 || step > 1 {
+		return 1
+	}
+
+	n := 2
+	for n < len(runes) && runes[n]-runes[n-1] == step {
+		n++
+	}
+	return n
+}
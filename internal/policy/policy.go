@@ -0,0 +1,192 @@
+package policy
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Wildcard is the operation that matches all the operations
+const Wildcard = "*"
+
+// Policy maps ClusterRoles, OIDC groups and users to the operations they are allowed to perform
+// The rules are additive: a request is allowed when any of the rules allows it
+//
+// Example:
+//
+//	rules:
+//	  - name: admins
+//	    clusterRoles: ["cluster-admin"]
+//	    operations: ["*"]
+//	  - name: helpdesk
+//	    groups: ["helpdesk"]
+//	    operations: ["ListUsers", "UpdateUser"]
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule allows the operations to the subjects matching any of its ClusterRoles, groups or users
+type Rule struct {
+	// Name identifies the rule in the logs
+	Name string `json:"name"`
+
+	// ClusterRoles is the list of ClusterRoles, the users bound to any of them match the rule
+	ClusterRoles []string `json:"clusterRoles,omitempty"`
+
+	// Groups is the list of OIDC groups, the members of any of them match the rule
+	Groups []string `json:"groups,omitempty"`
+
+	// Users is the list of user emails that match the rule
+	Users []string `json:"users,omitempty"`
+
+	// Operations is the list of operations allowed by the rule, "*" allows all of them
+	Operations []string `json:"operations"`
+}
+
+// Subject is the identity a policy is evaluated for
+type Subject struct {
+	// User is the email of the user
+	User string
+
+	// Groups is the list of OIDC groups of the user
+	Groups []string
+
+	// ClusterRoles returns the ClusterRoles bound to the user
+	// It is only called when a rule needs it, as it usually requires calls to the Kubernetes API
+	ClusterRoles func() ([]string, error)
+}
+
+// Default returns the policy used when no policy is configured:
+// only the users bound to the cluster-admin ClusterRole are allowed, for all the operations
+func Default() *Policy {
+	return &Policy{
+		Rules: []Rule{
+			{
+				Name:         "cluster-admins",
+				ClusterRoles: []string{"cluster-admin"},
+				Operations:   []string{Wildcard},
+			},
+		},
+	}
+}
+
+// Load reads and parses the policy from the YAML file at the provided path
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file %s: %w", path, err)
+	}
+
+	p, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+// Parse parses the policy from YAML and validates it
+func Parse(data []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	if len(p.Rules) == 0 {
+		return fmt.Errorf("policy must have at least one rule")
+	}
+
+	for i, r := range p.Rules {
+		if len(r.ClusterRoles) == 0 && len(r.Groups) == 0 && len(r.Users) == 0 {
+			return fmt.Errorf("rule %d (%s) must have at least one of clusterRoles, groups or users", i, r.Name)
+		}
+
+		if len(r.Operations) == 0 {
+			return fmt.Errorf("rule %d (%s) must have at least one operation", i, r.Name)
+		}
+	}
+
+	return nil
+}
+
+// Operations returns the operations used in the rules of the policy, without the wildcard
+func (p *Policy) Operations() []string {
+	var ops []string
+	for _, r := range p.Rules {
+		for _, op := range r.Operations {
+			if op != Wildcard && !slices.Contains(ops, op) {
+				ops = append(ops, op)
+			}
+		}
+	}
+	return ops
+}
+
+// Allowed returns the first rule that allows the operation to the subject,
+// or nil when no rule allows it
+// The rules matching users and groups are checked first, so that the ClusterRoles of the
+// subject are only looked up when none of them allows the operation
+func (p *Policy) Allowed(operation string, s Subject) (*Rule, error) {
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !r.allowsOperation(operation) {
+			continue
+		}
+
+		if slices.Contains(r.Users, s.User) || containsAny(r.Groups, s.Groups) {
+			return r, nil
+		}
+	}
+
+	if s.ClusterRoles == nil || !p.needsClusterRoles(operation) {
+		return nil, nil
+	}
+
+	clusterRoles, err := s.ClusterRoles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster roles: %w", err)
+	}
+
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.allowsOperation(operation) && containsAny(r.ClusterRoles, clusterRoles) {
+			return r, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// needsClusterRoles returns true if any rule allows the operation through ClusterRoles
+func (p *Policy) needsClusterRoles(operation string) bool {
+	for _, r := range p.Rules {
+		if len(r.ClusterRoles) > 0 && r.allowsOperation(operation) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) allowsOperation(operation string) bool {
+	return slices.Contains(r.Operations, Wildcard) || slices.Contains(r.Operations, operation)
+}
+
+// containsAny returns true if any of the elements in arr2 are in arr1
+func containsAny(arr1, arr2 []string) bool {
+	for _, v := range arr2 {
+		if slices.Contains(arr1, v) {
+			return true
+		}
+	}
+	return false
+}
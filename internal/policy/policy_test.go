@@ -0,0 +1,152 @@
+package policy_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/policy"
+)
+
+const helpdeskPolicy = `
+rules:
+  - name: admins
+    clusterRoles: ["cluster-admin"]
+    operations: ["*"]
+  - name: helpdesk
+    groups: ["helpdesk"]
+    operations: ["ListUsers", "UpdateUser"]
+  - name: auditor
+    users: ["auditor@example.com"]
+    operations: ["ListUsers"]
+`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		expectError bool
+	}{
+		{name: "valid policy", policy: helpdeskPolicy},
+		{name: "no rules", policy: `rules: []`, expectError: true},
+		{name: "rule without subjects", policy: `rules: [{name: r, operations: ["*"]}]`, expectError: true},
+		{name: "rule without operations", policy: `rules: [{name: r, groups: ["g"]}]`, expectError: true},
+		{name: "unknown field", policy: `rules: [{name: r, group: ["g"], operations: ["*"]}]`, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := policy.Parse([]byte(tt.policy))
+			if tt.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	p, err := policy.Parse([]byte(helpdeskPolicy))
+	require.NoError(t, err)
+
+	roles := func(r ...string) func() ([]string, error) {
+		return func() ([]string, error) { return r, nil }
+	}
+
+	tests := []struct {
+		name      string
+		operation string
+		subject   policy.Subject
+		wantRule  string
+	}{
+		{
+			name:      "cluster admin can delete users",
+			operation: "DeleteUser",
+			subject:   policy.Subject{User: "admin@example.com", ClusterRoles: roles("cluster-admin")},
+			wantRule:  "admins",
+		},
+		{
+			name:      "helpdesk can reset passwords",
+			operation: "UpdateUser",
+			subject:   policy.Subject{User: "jane@example.com", Groups: []string{"helpdesk"}, ClusterRoles: roles("view")},
+			wantRule:  "helpdesk",
+		},
+		{
+			name:      "helpdesk cannot delete users",
+			operation: "DeleteUser",
+			subject:   policy.Subject{User: "jane@example.com", Groups: []string{"helpdesk"}, ClusterRoles: roles("view")},
+		},
+		{
+			name:      "single user can list users",
+			operation: "ListUsers",
+			subject:   policy.Subject{User: "auditor@example.com", ClusterRoles: roles()},
+			wantRule:  "auditor",
+		},
+		{
+			name:      "single user cannot create users",
+			operation: "CreateUser",
+			subject:   policy.Subject{User: "auditor@example.com", ClusterRoles: roles()},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := p.Allowed(tt.operation, tt.subject)
+			assert.NoError(t, err)
+			if tt.wantRule == "" {
+				assert.Nil(t, rule)
+			} else {
+				require.NotNil(t, rule)
+				assert.Equal(t, tt.wantRule, rule.Name)
+			}
+		})
+	}
+}
+
+func TestAllowedLooksUpClusterRolesOnlyWhenNeeded(t *testing.T) {
+	p, err := policy.Parse([]byte(helpdeskPolicy))
+	require.NoError(t, err)
+
+	calls := 0
+	subject := policy.Subject{
+		User:   "jane@example.com",
+		Groups: []string{"helpdesk"},
+		ClusterRoles: func() ([]string, error) {
+			calls++
+			return nil, fmt.Errorf("kubernetes api unavailable")
+		},
+	}
+
+	// ListUsers is allowed through the group, the cluster roles are not needed
+	rule, err := p.Allowed("ListUsers", subject)
+	assert.NoError(t, err)
+	require.NotNil(t, rule)
+	assert.Equal(t, "helpdesk", rule.Name)
+	assert.Equal(t, 0, calls)
+
+	// DeleteUser is only allowed through the cluster roles
+	_, err = p.Allowed("DeleteUser", subject)
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestDefault(t *testing.T) {
+	p := policy.Default()
+
+	rule, err := p.Allowed("DeleteUser", policy.Subject{
+		User:         "admin@example.com",
+		ClusterRoles: func() ([]string, error) { return []string{"cluster-admin"}, nil },
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, rule)
+
+	rule, err = p.Allowed("ListUsers", policy.Subject{
+		User:         "user@example.com",
+		ClusterRoles: func() ([]string, error) { return []string{"view"}, nil },
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, rule)
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Options contains the settings of the shutdown of the server
+type Options struct {
+	// ShutdownDelay is how long the server keeps accepting requests once the shutdown started,
+	// so that the pod is removed from the endpoints before it stops listening
+	ShutdownDelay time.Duration
+
+	// ShutdownTimeout is how long the in-flight requests are drained, before they are cut off
+	ShutdownTimeout time.Duration
+
+	// OnShutdown is called when the shutdown starts, e.g. to fail the readiness checks
+	OnShutdown func()
+}
+
+// Run listens on the address of the server and serves the requests until the context is done,
+// then shuts the server down gracefully, see Serve
+func Run(ctx context.Context, s *http.Server, opts Options) error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return Serve(ctx, s, ln, opts)
+}
+
+// Start listens on the address of the server and serves the requests in the background, until the
+// server is closed. It is used for the servers that are not drained, like the one of the health and
+// metrics endpoints, which keeps answering while the requests of the API are drained
+func Start(s *http.Server) error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := s.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msgf("failed to serve on %s", s.Addr)
+		}
+	}()
+	return nil
+}
+
+// Serve serves the requests of the listener until the context is done, with TLS when the server
+// has a TLS config. Once the context is done, OnShutdown is called, and after the shutdown delay
+// the server stops accepting connections and waits for the in-flight requests to finish, up to
+// the shutdown timeout. It returns nil when all the requests finished.
+func Serve(ctx context.Context, s *http.Server, ln net.Listener, opts Options) error {
+	errCh := make(chan error, 1)
+	go func() {
+		if s.TLSConfig != nil {
+			errCh <- s.ServeTLS(ln, "", "")
+		} else {
+			errCh <- s.Serve(ln)
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Info().Msgf("Shutting down, serving the requests for %s before draining them", opts.ShutdownDelay)
+	if opts.OnShutdown != nil {
+		opts.OnShutdown()
+	}
+	time.Sleep(opts.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		// cut off the requests that are still in flight
+		_ = s.Close()
+		return fmt.Errorf("failed to drain the requests within %s: %w", opts.ShutdownTimeout, err)
+	}
+
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Info().Msg("All the requests are drained")
+	return nil
+}
@@ -0,0 +1,159 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/server"
+)
+
+// slowServer returns a server whose requests wait for the release channel to be closed,
+// and a channel receiving a value when a request is in flight
+func slowServer(release <-chan struct{}) (*http.Server, <-chan struct{}) {
+	started := make(chan struct{}, 1)
+	return &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+			_, _ = io.WriteString(w, "created")
+		}),
+	}, started
+}
+
+type response struct {
+	status int
+	body   string
+	err    error
+}
+
+// get sends a request in the background
+func get(url string) <-chan response {
+	ch := make(chan response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			ch <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		ch <- response{status: resp.StatusCode, body: string(b), err: err}
+	}()
+	return ch
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+	s, started := slowServer(release)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	url := "http://" + ln.Addr().String()
+
+	var shuttingDown atomic.Bool
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(ctx, s, ln, server.Options{
+			ShutdownDelay:   10 * time.Millisecond,
+			ShutdownTimeout: 5 * time.Second,
+			OnShutdown:      func() { shuttingDown.Store(true) },
+		})
+	}()
+
+	inFlight := get(url)
+	<-started
+
+	// the shutdown starts while the request is in flight
+	cancel()
+	assert.Eventually(t, shuttingDown.Load, time.Second, time.Millisecond)
+
+	// the server stops accepting connections once the delay elapsed, but waits for the request
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, time.Second, time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("server stopped before the in-flight request finished: %v", err)
+	default:
+	}
+
+	close(release)
+	resp := <-inFlight
+	require.NoError(t, resp.err)
+	assert.Equal(t, http.StatusOK, resp.status)
+	assert.Equal(t, "created", resp.body)
+
+	assert.NoError(t, <-done)
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s, started := slowServer(release)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(ctx, s, ln, server.Options{ShutdownTimeout: 50 * time.Millisecond})
+	}()
+
+	inFlight := get("http://" + ln.Addr().String())
+	<-started
+	cancel()
+
+	// the request that does not finish in time is cut off
+	assert.ErrorContains(t, <-done, "failed to drain the requests within 50ms")
+	assert.Error(t, (<-inFlight).err)
+}
+
+func TestServeError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln.Close()
+
+	err = server.Serve(context.Background(), &http.Server{}, ln, server.Options{})
+	assert.Error(t, err)
+}
+
+func TestStart(t *testing.T) {
+	require.Error(t, server.Start(&http.Server{Addr: "invalid"}))
+
+	// a free port is picked, as the address of the server is the one listened on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	s := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "ok")
+		}),
+	}
+	require.NoError(t, server.Start(s))
+
+	resp := <-get("http://" + addr)
+	require.NoError(t, resp.err)
+	assert.Equal(t, "ok", resp.body)
+
+	// the requests are refused once the server is closed
+	require.NoError(t, s.Close())
+	resp = <-get("http://" + addr)
+	assert.Error(t, resp.err)
+}
@@ -0,0 +1,123 @@
+package tls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
+)
+
+// Reloader keeps the certificate, key and CA of a certs directory up to date.
+//
+// The directory uses the ca.crt/tls.crt/tls.key layout of the secrets and is watched for
+// changes, like the rotation of a Kubernetes secret by cert-manager. When the new files
+// cannot be loaded, e.g. while they are partially written, the last good ones are kept.
+// Each reload is logged and counted in the metrics, labeled with the name of the certs.
+type Reloader struct {
+	name      string
+	certDir   string
+	requireCA bool
+	watcher   *fsnotify.Watcher
+
+	mu      sync.RWMutex
+	current *keyPair
+}
+
+// NewReloader loads the certs directory, the CA is optional unless requireCA is true
+// Start must be called to watch the directory for changes
+func NewReloader(name, certDir string, requireCA bool) (*Reloader, error) {
+	r := &Reloader{
+		name:      name,
+		certDir:   certDir,
+		requireCA: requireCA,
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certs watcher: %w", err)
+	}
+
+	// the directory is watched rather than the files, as the secret volumes
+	// replace the files by swapping a symlink
+	if err := watcher.Add(certDir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch certs directory %s: %w", certDir, err)
+	}
+	r.watcher = watcher
+
+	return r, nil
+}
+
+// Start reloads the certs on every change of the directory until the context is done
+func (r *Reloader) Start(ctx context.Context) {
+	go func() {
+		defer r.watcher.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-r.watcher.Events:
+				if !ok {
+					return
+				}
+				log.Debug().Msgf("Certs directory changed: %s", event)
+
+				if err := r.reload(); err != nil {
+					log.Error().Err(err).Msgf("failed to reload %s certs from %s, keeping the previous ones", r.name, r.certDir)
+				}
+			case err, ok := <-r.watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error().Err(err).Msgf("failed to watch %s certs directory %s", r.name, r.certDir)
+			}
+		}
+	}()
+}
+
+// reload loads the certs directory and replaces the current certs if it succeeds
+// The certificate, key and CA are replaced together, so a handshake never mixes old and new files
+func (r *Reloader) reload() error {
+	kp, err := loadKeyPair(r.certDir, r.requireCA)
+	if err != nil {
+		metrics.CertReloads.WithLabelValues(r.name, "failure").Inc()
+		return err
+	}
+
+	r.mu.Lock()
+	changed := r.current != nil && !r.current.cert.Leaf.Equal(kp.cert.Leaf)
+	r.current = kp
+	r.mu.Unlock()
+
+	metrics.CertReloads.WithLabelValues(r.name, "success").Inc()
+	metrics.CertExpiry.WithLabelValues(r.name).Set(float64(kp.cert.Leaf.NotAfter.Unix()))
+
+	leaf := kp.cert.Leaf
+	log.Info().Msgf("Loaded %s certs from %s: serial %s, expires at %s, changed: %t", r.name, r.certDir, leaf.SerialNumber, leaf.NotAfter, changed)
+	return nil
+}
+
+// Certificate returns the current certificate
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current.cert
+}
+
+// CAPool returns the current CA pool, it is nil when the directory has no CA
+func (r *Reloader) CAPool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current.caPool
+}
@@ -0,0 +1,138 @@
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// ServerOptions contains the settings of the HTTPS server
+type ServerOptions struct {
+	// MinVersion is the minimum TLS version accepted by the server
+	MinVersion uint16
+
+	// CipherSuites is the list of cipher suites enabled for TLS 1.0-1.2
+	// The Go defaults are used when empty, TLS 1.3 suites are not configurable
+	CipherSuites []uint16
+
+	// ClientAuth is the policy for the client certificates, they are verified against ca.crt
+	ClientAuth tls.ClientAuthType
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":            tls.NoClientCert,
+	"verify-if-given": tls.VerifyClientCertIfGiven,
+	"require":         tls.RequireAndVerifyClientCert,
+}
+
+// ParseTLSVersion parses a TLS version, one of 1.0, 1.1, 1.2 or 1.3
+func ParseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", s)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites parses a list of cipher suite names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+// Only the secure cipher suites of the crypto/tls package are accepted
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s.ID
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseClientAuth parses a client certificate policy, one of none, verify-if-given or require
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	a, ok := clientAuthTypes[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown client auth %q", s)
+	}
+	return a, nil
+}
+
+// NewServerTLSConfig returns the TLS configuration of the HTTPS server
+// The certificate and the client CA are read from the reloader on every handshake,
+// so the rotated certificates are used without restarting the server
+func NewServerTLSConfig(r *Reloader, opts ServerOptions) (*tls.Config, error) {
+	if opts.ClientAuth != tls.NoClientCert && r.CAPool() == nil {
+		return nil, fmt.Errorf("a %s file is required to verify the client certificates", caCertFile)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   opts.MinVersion,
+		CipherSuites: opts.CipherSuites,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.Certificate(), nil
+		},
+	}
+
+	// the client certificates are verified against the current CA in VerifyPeerCertificate,
+	// as the ClientCAs of the config cannot be reloaded
+	switch opts.ClientAuth {
+	case tls.NoClientCert:
+	case tls.VerifyClientCertIfGiven:
+		cfg.ClientAuth = tls.RequestClientCert
+		cfg.VerifyPeerCertificate = verifyClientCertificate(r)
+	case tls.RequireAndVerifyClientCert:
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyPeerCertificate = verifyClientCertificate(r)
+	default:
+		return nil, fmt.Errorf("unsupported client auth %s", opts.ClientAuth)
+	}
+
+	return cfg, nil
+}
+
+// verifyClientCertificate verifies the client certificate chain against the current CA of the reloader
+func verifyClientCertificate(r *Reloader) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		// no certificate was given, RequireAnyClientCert already rejects this case
+		if len(rawCerts) == 0 {
+			return nil
+		}
+
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("failed to parse client certificate: %w", err)
+			}
+			certs = append(certs, cert)
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         r.CAPool(),
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to verify client certificate: %w", err)
+		}
+		return nil
+	}
+}
@@ -3,8 +3,10 @@ package tls
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
 
@@ -17,38 +19,98 @@ const (
 	keyFile    = "tls.key"
 )
 
-// LoadTLSConfig loads the TLS configuration from the provided directory
-func LoadTLSConfig(certDir string) (*tls.Config, error) {
-	log.Info().Msgf("Loading TLS configuration from %s", certDir)
-	ca, err := readFile(path.Join(certDir, caCertFile))
+// keyPair is a certificate with its key and the CA pool loaded from a certs directory
+type keyPair struct {
+	cert *tls.Certificate
+
+	// caPool is nil when the directory has no CA
+	caPool *x509.CertPool
+}
+
+// NewClientTLSConfig returns the TLS configuration of a client, like the Dex gRPC client.
+// The client certificate and the CA are read from the reloader on every handshake,
+// so the rotated certificates are used without restarting the server
+func NewClientTLSConfig(r *Reloader) (*tls.Config, error) {
+	if r.CAPool() == nil {
+		return nil, fmt.Errorf("a %s file is required to verify the server certificates", caCertFile)
+	}
+
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.Certificate(), nil
+		},
+		// the RootCAs of the config cannot be reloaded, the server certificates are
+		// verified against the current CA in VerifyConnection instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyServerCertificate(r, cs)
+		},
+	}, nil
+}
+
+// verifyServerCertificate verifies the server certificate chain and name against the current CA of the reloader,
+// like the default verification of the crypto/tls clients
+func verifyServerCertificate(r *Reloader, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no server certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         r.CAPool(),
+		Intermediates: intermediates,
+		DNSName:       cs.ServerName,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to read CA crt from file %s: %w", path.Join(certDir, caCertFile), err)
+		return fmt.Errorf("failed to verify server certificate: %w", err)
 	}
+	return nil
+}
+
+// loadKeyPair loads the certificate, key and CA of the certs directory
+func loadKeyPair(certDir string, requireCA bool) (*keyPair, error) {
+	log.Debug().Msgf("Loading TLS configuration from %s", certDir)
 	cert, err := readFile(path.Join(certDir, certFile))
 	if err != nil {
-		return nil, fmt.Errorf("unable to read client crt from file %s: %w", path.Join(certDir, certFile), err)
+		return nil, fmt.Errorf("unable to read crt from file %s: %w", path.Join(certDir, certFile), err)
 	}
 	key, err := readFile(path.Join(certDir, keyFile))
 	if err != nil {
-		return nil, fmt.Errorf("unable to read client key from file %s: %w", path.Join(certDir, keyFile), err)
+		return nil, fmt.Errorf("unable to read key from file %s: %w", path.Join(certDir, keyFile), err)
 	}
 
-	cPool := x509.NewCertPool()
-	if !cPool.AppendCertsFromPEM(ca) {
-		return nil, fmt.Errorf("unable to parse CA crt from file %s", path.Join(certDir, caCertFile))
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid crt data from file %s: %v", path.Join(certDir, certFile), err)
+	}
+
+	// keep the parsed leaf, it is used to log the rotations
+	if pair.Leaf == nil {
+		if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("invalid crt data from file %s: %v", path.Join(certDir, certFile), err)
+		}
 	}
 
-	clientCert, err := tls.X509KeyPair(cert, key)
+	kp := &keyPair{cert: &pair}
+
+	ca, err := readFile(path.Join(certDir, caCertFile))
+	if errors.Is(err, fs.ErrNotExist) && !requireCA {
+		return kp, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("invalid client crt data from file %s: %v", path.Join(certDir, certFile), err)
+		return nil, fmt.Errorf("unable to read CA crt from file %s: %w", path.Join(certDir, caCertFile), err)
 	}
 
-	clientTLSConfig := &tls.Config{
-		RootCAs:      cPool,
-		Certificates: []tls.Certificate{clientCert},
+	kp.caPool = x509.NewCertPool()
+	if !kp.caPool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("unable to parse CA crt from file %s", path.Join(certDir, caCertFile))
 	}
 
-	return clientTLSConfig, nil
+	return kp, nil
 }
 
 func readFile(path string) ([]byte, error) {
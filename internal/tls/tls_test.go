@@ -0,0 +1,323 @@
+package tls_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mirantiscontainers/dex-http-server/internal/metrics"
+	"github.com/mirantiscontainers/dex-http-server/internal/tls"
+)
+
+// testCA issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of a leaf certificate for localhost
+func (ca *testCA) issue(t *testing.T, serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes the file atomically, like the rotation of a secret volume
+func writeFile(t *testing.T, dir, name string, data []byte) {
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	require.NoError(t, os.WriteFile(tmp, data, 0o600))
+	require.NoError(t, os.Rename(tmp, filepath.Join(dir, name)))
+}
+
+// writeCerts writes the CA and a server certificate with the serial in a new directory
+func writeCerts(t *testing.T, ca *testCA, serial int64) string {
+	dir := t.TempDir()
+	cert, key := ca.issue(t, serial, x509.ExtKeyUsageServerAuth)
+	writeFile(t, dir, "ca.crt", ca.pem)
+	writeFile(t, dir, "tls.key", key)
+	writeFile(t, dir, "tls.crt", cert)
+	return dir
+}
+
+func TestReloaderReloadsRotatedCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	dir := writeCerts(t, ca, 1)
+
+	r, err := tls.NewReloader("test", dir, true)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Start(ctx)
+
+	assert.Equal(t, int64(1), r.Certificate().Leaf.SerialNumber.Int64())
+	assert.NotNil(t, r.CAPool())
+
+	cert, key := ca.issue(t, 2, x509.ExtKeyUsageServerAuth)
+	writeFile(t, dir, "tls.key", key)
+	writeFile(t, dir, "tls.crt", cert)
+
+	assert.Eventually(t, func() bool {
+		return r.Certificate().Leaf.SerialNumber.Int64() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReloaderKeepsLastGoodCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	dir := writeCerts(t, ca, 1)
+
+	r, err := tls.NewReloader("test", dir, true)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Start(ctx)
+
+	// a key that does not match the certificate, e.g. while the secret is partially written
+	_, key := ca.issue(t, 2, x509.ExtKeyUsageServerAuth)
+	writeFile(t, dir, "tls.key", key)
+	writeFile(t, dir, "tls.crt", []byte("not a certificate"))
+
+	// wait for the events to be processed
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int64(1), r.Certificate().Leaf.SerialNumber.Int64())
+}
+
+func TestNewReloaderCA(t *testing.T) {
+	ca := newTestCA(t)
+	dir := writeCerts(t, ca, 1)
+	require.NoError(t, os.Remove(filepath.Join(dir, "ca.crt")))
+
+	// the CA is optional unless required
+	r, err := tls.NewReloader("test", dir, false)
+	require.NoError(t, err)
+	assert.Nil(t, r.CAPool())
+
+	_, err = tls.NewReloader("test", dir, true)
+	assert.Error(t, err)
+
+	// the client certificates cannot be verified without a CA
+	_, err = tls.NewServerTLSConfig(r, tls.ServerOptions{ClientAuth: cryptotls.RequireAndVerifyClientCert})
+	assert.Error(t, err)
+}
+
+func TestServerTLSConfigClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	dir := writeCerts(t, ca, 1)
+
+	r, err := tls.NewReloader("test", dir, true)
+	require.NoError(t, err)
+
+	clientCert := func(ca *testCA) []cryptotls.Certificate {
+		cert, key := ca.issue(t, 10, x509.ExtKeyUsageClientAuth)
+		pair, err := cryptotls.X509KeyPair(cert, key)
+		require.NoError(t, err)
+		return []cryptotls.Certificate{pair}
+	}
+
+	tests := []struct {
+		name        string
+		clientAuth  cryptotls.ClientAuthType
+		clientCerts []cryptotls.Certificate
+		expectError bool
+	}{
+		{name: "no client auth", clientAuth: cryptotls.NoClientCert},
+		{name: "required and given", clientAuth: cryptotls.RequireAndVerifyClientCert, clientCerts: clientCert(ca)},
+		{name: "required but not given", clientAuth: cryptotls.RequireAndVerifyClientCert, expectError: true},
+		{name: "required but issued by another CA", clientAuth: cryptotls.RequireAndVerifyClientCert, clientCerts: clientCert(otherCA), expectError: true},
+		{name: "verified if given, not given", clientAuth: cryptotls.VerifyClientCertIfGiven},
+		{name: "verified if given, issued by another CA", clientAuth: cryptotls.VerifyClientCertIfGiven, clientCerts: clientCert(otherCA), expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tls.NewServerTLSConfig(r, tls.ServerOptions{
+				MinVersion: cryptotls.VersionTLS12,
+				ClientAuth: tt.clientAuth,
+			})
+			require.NoError(t, err)
+
+			// served like the main server, httptest would replace the certificate of the config
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			srv := &http.Server{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				}),
+				TLSConfig: cfg,
+			}
+			go func() { _ = srv.ServeTLS(ln, "", "") }()
+			defer srv.Close()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.cert)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &cryptotls.Config{
+				RootCAs:      roots,
+				Certificates: tt.clientCerts,
+			}}}
+
+			resp, err := client.Get("https://" + ln.Addr().String())
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	v, err := tls.ParseTLSVersion("1.3")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(cryptotls.VersionTLS13), v)
+
+	_, err = tls.ParseTLSVersion("1.4")
+	assert.Error(t, err)
+
+	suites, err := tls.ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{cryptotls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, suites)
+
+	// insecure suites are rejected
+	_, err = tls.ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	assert.Error(t, err)
+
+	a, err := tls.ParseClientAuth("require")
+	assert.NoError(t, err)
+	assert.Equal(t, cryptotls.RequireAndVerifyClientCert, a)
+
+	_, err = tls.ParseClientAuth("always")
+	assert.Error(t, err)
+}
+
+func TestClientTLSConfigReloadsCA(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+
+	// the server certificate is issued by ca, while the client trusts otherCA at first
+	server, err := tls.NewReloader("test-server", writeCerts(t, ca, 1), true)
+	require.NoError(t, err)
+	serverCfg, err := tls.NewServerTLSConfig(server, tls.ServerOptions{ClientAuth: cryptotls.RequireAndVerifyClientCert})
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }),
+		TLSConfig: serverCfg,
+	}
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	defer srv.Close()
+
+	clientDir := t.TempDir()
+	cert, key := ca.issue(t, 10, x509.ExtKeyUsageClientAuth)
+	writeFile(t, clientDir, "ca.crt", otherCA.pem)
+	writeFile(t, clientDir, "tls.key", key)
+	writeFile(t, clientDir, "tls.crt", cert)
+
+	client, err := tls.NewReloader("test-client", clientDir, true)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.Start(ctx)
+
+	clientCfg, err := tls.NewClientTLSConfig(client)
+	require.NoError(t, err)
+
+	get := func() error {
+		// a new transport per request, so that every request does a handshake
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg.Clone()}}
+		resp, err := c.Get("https://localhost:" + strconv.Itoa(ln.Addr().(*net.TCPAddr).Port))
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	assert.ErrorContains(t, get(), "failed to verify server certificate")
+
+	writeFile(t, clientDir, "ca.crt", ca.pem)
+	assert.Eventually(t, func() bool { return get() == nil }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReloaderMetrics(t *testing.T) {
+	ca := newTestCA(t)
+	dir := writeCerts(t, ca, 1)
+
+	r, err := tls.NewReloader("test-metrics", dir, true)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Start(ctx)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.CertReloads.WithLabelValues("test-metrics", "success")))
+	assert.Equal(t, float64(r.Certificate().Leaf.NotAfter.Unix()), testutil.ToFloat64(metrics.CertExpiry.WithLabelValues("test-metrics")))
+
+	writeFile(t, dir, "tls.crt", []byte("not a certificate"))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(metrics.CertReloads.WithLabelValues("test-metrics", "failure")) >= 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
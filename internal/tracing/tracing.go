@@ -0,0 +1,137 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/stats"
+)
+
+const (
+	// instrumentationName is the name of the tracer of the server spans
+	instrumentationName = "github.com/mirantiscontainers/dex-http-server"
+
+	// serviceName is the default service name of the spans, overridden by OTEL_SERVICE_NAME
+	serviceName = "dex-http-server"
+)
+
+// Tracer returns the tracer of the global tracer provider
+// The tracer is looked up on every call, so that the provider set by Setup, or by the tests, is used
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start starts a span, child of the span of the context
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// End ends the span, recording the error when there is one
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// GRPCClientHandler returns the stats handler tracing the gRPC calls to Dex
+// The trace context is propagated to Dex in the W3C traceparent metadata
+func GRPCClientHandler() stats.Handler {
+	return otelgrpc.NewClientHandler()
+}
+
+// Setup configures the global tracer provider from the standard OTEL_ environment variables,
+// and returns the func flushing and stopping it.
+//
+// The spans are exported with OTLP when OTEL_TRACES_EXPORTER is "otlp", or when an OTLP endpoint is set
+// with OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT. Tracing is disabled otherwise,
+// or when OTEL_SDK_DISABLED is true. The W3C trace context of the requests is propagated in any case.
+func Setup(ctx context.Context, version string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	enabled, err := exporterEnabled()
+	if err != nil || !enabled {
+		return func(context.Context) error { return nil }, err
+	}
+
+	exporter, err := newExporter(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	// the attributes of OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName), semconv.ServiceVersion(version)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	// the sampler is configured with OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG,
+	// and the batches with the OTEL_BSP_ variables
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// exporterEnabled returns whether the spans are exported, from the OTEL_ environment variables
+func exporterEnabled() (bool, error) {
+	if v := os.Getenv("OTEL_SDK_DISABLED"); v != "" {
+		disabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("invalid OTEL_SDK_DISABLED: %w", err)
+		}
+		if disabled {
+			return false, nil
+		}
+	}
+
+	switch exporter := strings.TrimSpace(os.Getenv("OTEL_TRACES_EXPORTER")); exporter {
+	case "otlp":
+		return true, nil
+	case "none":
+		return false, nil
+	case "":
+		return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "", nil
+	default:
+		return false, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q, must be 'otlp' or 'none'", exporter)
+	}
+}
+
+// newExporter returns the OTLP exporter of the protocol set by OTEL_EXPORTER_OTLP_TRACES_PROTOCOL
+// or OTEL_EXPORTER_OTLP_PROTOCOL, the endpoint, headers and TLS settings are read by the exporter
+func newExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+
+	switch protocol {
+	case "", "grpc":
+		return otlptracegrpc.New(ctx)
+	case "http/protobuf":
+		return otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, must be 'grpc' or 'http/protobuf'", protocol)
+	}
+}